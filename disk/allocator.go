@@ -0,0 +1,331 @@
+package disk
+
+import (
+	"sort"
+)
+
+// Allocator decides which free blocks a disk hands out, blocks are identified by their number,
+// block i starting at byte i*blockSize. A disk only calls its allocator while holding its lock
+type Allocator interface {
+	// Allocate takes n free blocks and returns their numbers in the order data is laid out in them,
+	// it returns nil when fewer than n blocks are free
+	Allocate(n int) []int
+	// Release returns a block taken by Allocate
+	Release(blockNum int)
+	// Available returns the number of free blocks
+	Available() int
+	// FreeBlocks returns the numbers of the free blocks, releasing them in this order to a new
+	// allocator leaves it in the same state
+	FreeBlocks() []int
+}
+
+// NewAllocator returns an allocator for a disk of blocks blocks, they all start out in use and the disk
+// releases the free ones
+type NewAllocator func(blocks int) Allocator
+
+// Option configures a disk when it is created or opened
+type Option func(*options)
+
+type options struct {
+	newAllocator NewAllocator
+}
+
+// WithAllocator makes the disk hand out blocks with the allocator returned by newAllocator,
+// NewStackAllocator is used otherwise
+func WithAllocator(newAllocator NewAllocator) Option {
+	return func(o *options) {
+		o.newAllocator = newAllocator
+	}
+}
+
+func applyOptions(opts []Option) options {
+	o := options{newAllocator: NewStackAllocator}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// stackAllocator hands out the last released block first. Blocks are released in order on a new disk,
+// so files are laid out from the end of the disk backwards and freed blocks are reused right away
+type stackAllocator struct {
+	blocks []int
+}
+
+func NewStackAllocator(blocks int) Allocator {
+	return &stackAllocator{blocks: make([]int, 0, blocks)}
+}
+
+func (a *stackAllocator) Allocate(n int) []int {
+	if n > len(a.blocks) {
+		return nil
+	}
+	blockNums := make([]int, n)
+	for i := range blockNums {
+		blockNums[i] = a.blocks[len(a.blocks)-1-i]
+	}
+	a.blocks = a.blocks[:len(a.blocks)-n]
+	return blockNums
+}
+
+func (a *stackAllocator) Release(blockNum int) {
+	a.blocks = append(a.blocks, blockNum)
+}
+
+func (a *stackAllocator) Available() int {
+	return len(a.blocks)
+}
+
+func (a *stackAllocator) FreeBlocks() []int {
+	blockNums := make([]int, len(a.blocks))
+	copy(blockNums, a.blocks)
+	return blockNums
+}
+
+// firstFitAllocator serves an allocation from the first run of free blocks holding all of it, found
+// through the summary tree of its bitmap. When no run is large enough it is spread over the first runs
+type firstFitAllocator struct {
+	free *bitmap
+}
+
+func NewFirstFitAllocator(blocks int) Allocator {
+	return &firstFitAllocator{free: newBitmap(blocks)}
+}
+
+func (a *firstFitAllocator) Allocate(n int) []int {
+	if n > a.free.free {
+		return nil
+	}
+	blockNums := make([]int, 0, n)
+	for len(blockNums) < n {
+		remaining := n - len(blockNums)
+		start, length := a.free.firstRun(remaining), remaining
+		if start == -1 {
+			start = a.free.nextFree(0)
+			length = a.free.runLength(start)
+		}
+		for blockNum := start; blockNum < start+length; blockNum++ {
+			a.free.setFree(blockNum, false)
+			blockNums = append(blockNums, blockNum)
+		}
+	}
+	return blockNums
+}
+
+func (a *firstFitAllocator) Release(blockNum int) {
+	a.free.setFree(blockNum, true)
+}
+
+func (a *firstFitAllocator) Available() int {
+	return a.free.free
+}
+
+func (a *firstFitAllocator) FreeBlocks() []int {
+	return a.free.freeBlocks()
+}
+
+// extent is a run of length blocks starting at block start
+type extent struct {
+	start  int
+	length int
+}
+
+// bestFitAllocator keeps the free blocks as extents sorted by start, adjacent extents are always merged.
+// An allocation is served from the smallest extent holding all of it when there is one, otherwise it is
+// spread over the largest ones
+type bestFitAllocator struct {
+	free      []extent
+	available int
+}
+
+func NewBestFitAllocator(blocks int) Allocator {
+	return &bestFitAllocator{}
+}
+
+func (a *bestFitAllocator) Allocate(n int) []int {
+	if n > a.available {
+		return nil
+	}
+	blockNums := make([]int, 0, n)
+	for len(blockNums) < n {
+		i := a.pick(n - len(blockNums))
+		take := a.free[i].length
+		if take > n-len(blockNums) {
+			take = n - len(blockNums)
+		}
+		for blockNum := a.free[i].start; blockNum < a.free[i].start+take; blockNum++ {
+			blockNums = append(blockNums, blockNum)
+		}
+		a.free[i].start += take
+		a.free[i].length -= take
+		if a.free[i].length == 0 {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+		}
+	}
+	a.available -= n
+	return blockNums
+}
+
+// pick returns the index of the extent the next n blocks are taken from
+func (a *bestFitAllocator) pick(n int) int {
+	chosen, largest := -1, 0
+	for i, free := range a.free {
+		if free.length >= n && (chosen == -1 || free.length < a.free[chosen].length) {
+			chosen = i
+		}
+		if free.length > a.free[largest].length {
+			largest = i
+		}
+	}
+	if chosen == -1 {
+		return largest
+	}
+	return chosen
+}
+
+func (a *bestFitAllocator) Release(blockNum int) {
+	a.available++
+	i := sort.Search(len(a.free), func(i int) bool {
+		return a.free[i].start > blockNum
+	})
+	joinsPrevious := i > 0 && a.free[i-1].start+a.free[i-1].length == blockNum
+	joinsNext := i < len(a.free) && a.free[i].start == blockNum+1
+	switch {
+	case joinsPrevious && joinsNext:
+		a.free[i-1].length += 1 + a.free[i].length
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	case joinsPrevious:
+		a.free[i-1].length++
+	case joinsNext:
+		a.free[i].start--
+		a.free[i].length++
+	default:
+		a.free = append(a.free, extent{})
+		copy(a.free[i+1:], a.free[i:])
+		a.free[i] = extent{start: blockNum, length: 1}
+	}
+}
+
+func (a *bestFitAllocator) Available() int {
+	return a.available
+}
+
+func (a *bestFitAllocator) FreeBlocks() []int {
+	blockNums := make([]int, 0, a.available)
+	for _, free := range a.free {
+		for blockNum := free.start; blockNum < free.start+free.length; blockNum++ {
+			blockNums = append(blockNums, blockNum)
+		}
+	}
+	return blockNums
+}
+
+// buddyAllocator keeps the free blocks as aligned runs of a power of two blocks, a free run is merged with
+// its buddy, the run it was split from, as soon as both are free. An allocation is served from the smallest
+// run holding all of it, split down to the smallest power of two covering it, and the unused tail of that
+// run is released again. When no run is large enough the allocation is spread over the largest ones
+type buddyAllocator struct {
+	// free[k] holds the first block of every free run of 1<<k blocks, sorted
+	free      [][]int
+	available int
+}
+
+func NewBuddyAllocator(blocks int) Allocator {
+	orders := 1
+	for 1<<orders <= blocks {
+		orders++
+	}
+	return &buddyAllocator{free: make([][]int, orders)}
+}
+
+func (a *buddyAllocator) Allocate(n int) []int {
+	if n > a.available {
+		return nil
+	}
+	blockNums := make([]int, 0, n)
+	for len(blockNums) < n {
+		remaining := n - len(blockNums)
+		order := 0
+		for 1<<order < remaining {
+			order++
+		}
+		from := -1
+		for k := order; k < len(a.free) && from == -1; k++ {
+			if len(a.free[k]) > 0 {
+				from = k
+			}
+		}
+		for k := len(a.free) - 1; k >= 0 && from == -1; k-- {
+			if len(a.free[k]) > 0 {
+				from = k
+			}
+		}
+		start := a.free[from][0]
+		a.free[from] = removeSorted(a.free[from], start)
+		a.available -= 1 << from
+		for from > order {
+			from--
+			a.free[from] = insertSorted(a.free[from], start+1<<from)
+			a.available += 1 << from
+		}
+		take := 1 << from
+		if take > remaining {
+			take = remaining
+		}
+		for blockNum := start; blockNum < start+take; blockNum++ {
+			blockNums = append(blockNums, blockNum)
+		}
+		for blockNum := start + take; blockNum < start+1<<from; blockNum++ {
+			a.Release(blockNum)
+		}
+	}
+	return blockNums
+}
+
+func (a *buddyAllocator) Release(blockNum int) {
+	a.available++
+	start, order := blockNum, 0
+	for order+1 < len(a.free) {
+		buddy := start ^ 1<<order
+		i := sort.SearchInts(a.free[order], buddy)
+		if i == len(a.free[order]) || a.free[order][i] != buddy {
+			break
+		}
+		a.free[order] = append(a.free[order][:i], a.free[order][i+1:]...)
+		if buddy < start {
+			start = buddy
+		}
+		order++
+	}
+	a.free[order] = insertSorted(a.free[order], start)
+}
+
+func (a *buddyAllocator) Available() int {
+	return a.available
+}
+
+func (a *buddyAllocator) FreeBlocks() []int {
+	blockNums := make([]int, 0, a.available)
+	for order, starts := range a.free {
+		for _, start := range starts {
+			for blockNum := start; blockNum < start+1<<order; blockNum++ {
+				blockNums = append(blockNums, blockNum)
+			}
+		}
+	}
+	sort.Ints(blockNums)
+	return blockNums
+}
+
+func insertSorted(values []int, value int) []int {
+	i := sort.SearchInts(values, value)
+	values = append(values, 0)
+	copy(values[i+1:], values[i:])
+	values[i] = value
+	return values
+}
+
+func removeSorted(values []int, value int) []int {
+	i := sort.SearchInts(values, value)
+	return append(values[:i], values[i+1:]...)
+}
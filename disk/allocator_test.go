@@ -0,0 +1,175 @@
+package disk
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allocators = []struct {
+	name         string
+	newAllocator NewAllocator
+}{
+	{"stack", NewStackAllocator},
+	{"first-fit", NewFirstFitAllocator},
+	{"best-fit", NewBestFitAllocator},
+	{"buddy", NewBuddyAllocator},
+}
+
+func blockRange(start int, end int) []int {
+	blockNums := make([]int, 0, end-start)
+	for blockNum := start; blockNum < end; blockNum++ {
+		blockNums = append(blockNums, blockNum)
+	}
+	return blockNums
+}
+
+func TestAllocators(t *testing.T) {
+	expected := map[string][][]int{
+		"stack":     {{15, 14, 13, 12, 11, 10, 9, 8, 7, 6}, {5}, {4, 3, 2}, {2, 3, 4}},
+		"first-fit": {blockRange(0, 10), {10}, {11, 12, 13}, {0, 1, 2}},
+		"best-fit":  {blockRange(0, 10), {10}, {11, 12, 13}, {11, 12, 13}},
+		"buddy":     {blockRange(0, 10), {10}, {12, 13, 14}, {12, 13, 14}},
+	}
+	for _, testcase := range allocators {
+		allocator := testcase.newAllocator(16)
+		for blockNum := 0; blockNum < 16; blockNum++ {
+			allocator.Release(blockNum)
+		}
+		assert.Nil(t, allocator.Allocate(17), testcase.name)
+		first := allocator.Allocate(10)
+		second := allocator.Allocate(1)
+		third := allocator.Allocate(3)
+		for _, blockNum := range append(first, third...) {
+			allocator.Release(blockNum)
+		}
+		fourth := allocator.Allocate(3)
+		assert.Equal(t, expected[testcase.name], [][]int{first, second, third, fourth}, testcase.name)
+		assert.Equal(t, 12, allocator.Available(), testcase.name)
+
+		//releasing the free blocks in order to a new allocator restores its state
+		restored := testcase.newAllocator(16)
+		for _, blockNum := range allocator.FreeBlocks() {
+			restored.Release(blockNum)
+		}
+		assert.Equal(t, allocator.FreeBlocks(), restored.FreeBlocks(), testcase.name)
+		fifth := allocator.Allocate(5)
+		assert.Equal(t, fifth, restored.Allocate(5), testcase.name)
+
+		//an allocation no single run holds is spread over several
+		rest := allocator.Allocate(allocator.Available())
+		assert.Len(t, rest, 7, testcase.name)
+		assert.Equal(t, 0, allocator.Available(), testcase.name)
+		assert.Nil(t, allocator.Allocate(1), testcase.name)
+		used := append(append(append(append([]int{}, second...), fourth...), fifth...), rest...)
+		sort.Ints(used)
+		assert.Equal(t, blockRange(0, 16), used, testcase.name)
+	}
+
+	//buddy runs never go past the end of a disk whose block count is not a power of two
+	buddy := NewBuddyAllocator(10)
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		buddy.Release(blockNum)
+	}
+	assert.Equal(t, blockRange(0, 10), buddy.Allocate(10))
+}
+
+func TestDiskAllocator(t *testing.T) {
+	for _, testcase := range allocators {
+		disk, _ := NewDisk(1000, 10, WithAllocator(testcase.newAllocator))
+		manifests := make([]*BlockRecord, 0)
+		for i := 0; i < 20; i++ {
+			manifest, err := disk.Write(bytes.Repeat([]byte{byte(i)}, 5*i))
+			assert.Nil(t, err, testcase.name)
+			manifests = append(manifests, manifest)
+		}
+		for i := 0; i < 20; i += 2 {
+			disk.Delete(manifests[i])
+		}
+		for i := 1; i < 20; i += 2 {
+			assert.Nil(t, disk.Append(manifests[i], bytes.Repeat([]byte{byte(i)}, 33)), testcase.name)
+			data, _ := disk.Read(manifests[i])
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 5*i+33), data, testcase.name)
+		}
+		for i := 1; i < 20; i += 2 {
+			disk.Delete(manifests[i])
+		}
+		assert.Equal(t, 1000, disk.GetAvailableMemory(), testcase.name)
+	}
+
+	//the stack allocator lays files out backwards, the others forwards
+	stacked, _ := NewDisk(100, 10)
+	manifest, _ := stacked.Write(make([]byte, 25))
+	assert.Equal(t, []int{90, 80, 70}, startIndexes(manifest))
+	firstFit, _ := NewDisk(100, 10, WithAllocator(NewFirstFitAllocator))
+	manifest, _ = firstFit.Write(make([]byte, 25))
+	assert.Equal(t, []int{0, 10, 20}, startIndexes(manifest))
+
+	//a disk loaded with the allocator it was saved with hands out the same blocks, the one block hole is skipped
+	hole, _ := firstFit.Write(make([]byte, 10))
+	firstFit.Write(make([]byte, 10))
+	firstFit.Delete(hole)
+	var image bytes.Buffer
+	assert.Nil(t, firstFit.Save(&image))
+	loaded, err := LoadDisk(&image, WithAllocator(NewFirstFitAllocator))
+	assert.Nil(t, err)
+	expected, _ := firstFit.Write(make([]byte, 20))
+	actual, _ := loaded.Write(make([]byte, 20))
+	assert.Equal(t, []int{50, 60}, startIndexes(expected))
+	assert.Equal(t, expected, actual)
+}
+
+func startIndexes(blockRecord *BlockRecord) []int {
+	starts := blockRecord.blockNums()
+	for i := range starts {
+		starts[i] *= 10
+	}
+	return starts
+}
+
+// BenchmarkFragmentation churns a disk with files of random sizes, deleting random ones whenever it is
+// three quarters full, and reports how scattered the files and the free space are at the end
+func BenchmarkFragmentation(b *testing.B) {
+	const blockSize, blocks, operations = 64, 4096, 20000
+	for _, testcase := range allocators {
+		b.Run(testcase.name, func(b *testing.B) {
+			var fileRuns, freeRuns float64
+			for n := 0; n < b.N; n++ {
+				random := rand.New(rand.NewSource(1))
+				d, _ := NewDisk(blockSize*blocks, blockSize, WithAllocator(testcase.newAllocator))
+				manifests := make([]*BlockRecord, 0)
+				for op := 0; op < operations; op++ {
+					if d.GetAvailableMemory() > blockSize*blocks/4 {
+						manifest, err := d.Write(make([]byte, blockSize*(1+random.Intn(32))))
+						if err == nil {
+							manifests = append(manifests, manifest)
+							continue
+						}
+					}
+					i := random.Intn(len(manifests))
+					d.Delete(manifests[i])
+					manifests[i] = manifests[len(manifests)-1]
+					manifests = manifests[:len(manifests)-1]
+				}
+				total := 0
+				for _, manifest := range manifests {
+					total += manifest.ExtentCount()
+				}
+				fileRuns = float64(total) / float64(len(manifests))
+				free := d.(*disk).allocator.FreeBlocks()
+				sort.Ints(free)
+				freeRuns = 0
+				for i := range free {
+					if i == 0 || free[i] != free[i-1]+1 {
+						freeRuns++
+					}
+				}
+			}
+			b.ReportMetric(fileRuns, "runs/file")
+			b.ReportMetric(freeRuns, "free-runs")
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package disk
+
+import "math/bits"
+
+// bitmap tracks which of the blocks of a disk are free, bit i of word i/64 is set while block i is in use.
+// Bits past the last block are always set. A summary tree over the words keeps, for every range of words,
+// the free blocks at its start and end and the longest run of free blocks within it, so runs are found in
+// a number of steps logarithmic in the number of words
+type bitmap struct {
+	words  []uint64
+	blocks int
+	free   int
+	// summary is a complete binary tree stored breadth first from index 1, the leaves start at index
+	// leaves and stand for the words, padded with leaves for words past the end that hold no free block
+	summary []summary
+	leaves  int
+}
+
+// summary describes the free blocks of a range of size blocks: prefix of them free at its start, suffix
+// free at its end and longest free in a row anywhere in it
+type summary struct {
+	prefix  int
+	suffix  int
+	longest int
+	size    int
+}
+
+// newBitmap returns a bitmap of blocks blocks, all of them in use
+func newBitmap(blocks int) *bitmap {
+	b := &bitmap{words: make([]uint64, (blocks+63)/64), blocks: blocks, leaves: 1}
+	for i := range b.words {
+		b.words[i] = ^uint64(0)
+	}
+	for b.leaves < len(b.words) {
+		b.leaves *= 2
+	}
+	b.summary = make([]summary, 2*b.leaves)
+	for i := 0; i < b.leaves; i++ {
+		b.summary[b.leaves+i] = summary{size: 64}
+	}
+	for node := b.leaves - 1; node > 0; node-- {
+		b.summary[node] = combine(b.summary[2*node], b.summary[2*node+1])
+	}
+	return b
+}
+
+func (b *bitmap) isFree(blockNum int) bool {
+	return blockNum >= 0 && blockNum < b.blocks && b.words[blockNum/64]&(1<<(blockNum%64)) == 0
+}
+
+// setFree marks blockNum free when free is set and in use otherwise
+func (b *bitmap) setFree(blockNum int, free bool) {
+	if b.isFree(blockNum) == free {
+		return
+	}
+	if free {
+		b.words[blockNum/64] &^= 1 << (blockNum % 64)
+		b.free++
+	} else {
+		b.words[blockNum/64] |= 1 << (blockNum % 64)
+		b.free--
+	}
+	node := b.leaves + blockNum/64
+	b.summary[node] = summarize(b.words[blockNum/64])
+	for node /= 2; node > 0; node /= 2 {
+		b.summary[node] = combine(b.summary[2*node], b.summary[2*node+1])
+	}
+}
+
+// firstRun returns the first block of the first run of at least n free blocks, -1 when there is none
+func (b *bitmap) firstRun(n int) int {
+	if n <= 0 || b.summary[1].longest < n {
+		return -1
+	}
+	node, start := 1, 0
+	for node < b.leaves {
+		left, right := b.summary[2*node], b.summary[2*node+1]
+		if left.longest >= n {
+			node = 2 * node
+			continue
+		}
+		if left.suffix+right.prefix >= n {
+			return start + left.size - left.suffix
+		}
+		start += left.size
+		node = 2*node + 1
+	}
+	free := ^b.words[node-b.leaves]
+	for offset := 0; offset+n <= 64; offset++ {
+		if run := bits.TrailingZeros64(^(free >> offset)); run >= n {
+			return start + offset
+		}
+	}
+	return -1
+}
+
+// runLength returns the number of free blocks in a row starting at blockNum
+func (b *bitmap) runLength(blockNum int) int {
+	length := 0
+	for blockNum+length < b.blocks {
+		word, offset := (blockNum+length)/64, (blockNum+length)%64
+		run := bits.TrailingZeros64(b.words[word] >> offset)
+		if run > 64-offset {
+			run = 64 - offset
+		}
+		length += run
+		if offset+run < 64 {
+			break
+		}
+	}
+	return length
+}
+
+// nextFree returns the first free block at or after blockNum, -1 when there is none
+func (b *bitmap) nextFree(blockNum int) int {
+	for word := blockNum / 64; word < len(b.words); word++ {
+		free := ^b.words[word]
+		if word == blockNum/64 {
+			free &^= 1<<(blockNum%64) - 1
+		}
+		if free != 0 {
+			return word*64 + bits.TrailingZeros64(free)
+		}
+	}
+	return -1
+}
+
+// freeBlocks returns the free blocks in order
+func (b *bitmap) freeBlocks() []int {
+	blockNums := make([]int, 0, b.free)
+	for blockNum := b.nextFree(0); blockNum != -1; blockNum = b.nextFree(blockNum + 1) {
+		blockNums = append(blockNums, blockNum)
+	}
+	return blockNums
+}
+
+// bytes returns the bitmap as the free map persisted by disks, one bit per block set while it is in use
+func (b *bitmap) bytes() []byte {
+	freeMap := make([]byte, (b.blocks+7)/8)
+	for i := range freeMap {
+		freeMap[i] = byte(b.words[i/8] >> (8 * (i % 8)))
+	}
+	return freeMap
+}
+
+// bitmapFromBytes returns the bitmap of blocks blocks persisted as freeMap by bytes
+func bitmapFromBytes(freeMap []byte, blocks int) *bitmap {
+	b := newBitmap(blocks)
+	for blockNum := 0; blockNum < blocks; blockNum++ {
+		if freeMap[blockNum/8]&(1<<(blockNum%8)) == 0 {
+			b.setFree(blockNum, true)
+		}
+	}
+	return b
+}
+
+// summarize returns the summary of the 64 blocks of word
+func summarize(word uint64) summary {
+	free := ^word
+	longest := 0
+	for run := free; run != 0; run &= run << 1 {
+		longest++
+	}
+	return summary{prefix: bits.TrailingZeros64(word), suffix: bits.LeadingZeros64(word), longest: longest, size: 64}
+}
+
+func combine(left summary, right summary) summary {
+	combined := summary{prefix: left.prefix, suffix: right.suffix, longest: left.suffix + right.prefix, size: left.size + right.size}
+	if left.prefix == left.size {
+		combined.prefix += right.prefix
+	}
+	if right.suffix == right.size {
+		combined.suffix += left.suffix
+	}
+	if left.longest > combined.longest {
+		combined.longest = left.longest
+	}
+	if right.longest > combined.longest {
+		combined.longest = right.longest
+	}
+	return combined
+}
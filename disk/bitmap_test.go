@@ -0,0 +1,102 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitmap(t *testing.T) {
+	b := newBitmap(200)
+	assert.Equal(t, 0, b.free)
+	assert.Equal(t, -1, b.firstRun(1))
+	assert.Equal(t, -1, b.nextFree(0))
+	for _, blockNum := range blockRange(60, 70) {
+		b.setFree(blockNum, true)
+	}
+	b.setFree(65, true)
+	b.setFree(199, true)
+	assert.Equal(t, 11, b.free)
+	assert.True(t, b.isFree(63))
+	assert.False(t, b.isFree(70))
+	assert.False(t, b.isFree(200))
+	assert.False(t, b.isFree(-1))
+
+	//runs are found across word boundaries
+	assert.Equal(t, 60, b.firstRun(10))
+	assert.Equal(t, -1, b.firstRun(11))
+	assert.Equal(t, 199, b.nextFree(70))
+	assert.Equal(t, 6, b.runLength(64))
+	assert.Equal(t, 1, b.runLength(199))
+	assert.Equal(t, 0, b.runLength(70))
+	assert.Equal(t, append(blockRange(60, 70), 199), b.freeBlocks())
+
+	b.setFree(64, false)
+	assert.Equal(t, 60, b.firstRun(4))
+	assert.Equal(t, 65, b.firstRun(5))
+	assert.Equal(t, 10, b.free)
+
+	//the free map takes a bit per block and restores the same bitmap
+	freeMap := b.bytes()
+	assert.Len(t, freeMap, 25)
+	restored := bitmapFromBytes(freeMap, 200)
+	assert.Equal(t, b.freeBlocks(), restored.freeBlocks())
+	assert.Equal(t, b.summary, restored.summary)
+}
+
+func TestBitmapRuns(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	blocks := 1000
+	b, free := newBitmap(blocks), make([]bool, blocks)
+	for i := 0; i < 5000; i++ {
+		blockNum := random.Intn(blocks)
+		free[blockNum] = random.Intn(3) > 0
+		b.setFree(blockNum, free[blockNum])
+		n := 1 + random.Intn(12)
+		assert.Equal(t, naiveFirstRun(free, n), b.firstRun(n), "run of %d", n)
+	}
+}
+
+func naiveFirstRun(free []bool, n int) int {
+	length := 0
+	for blockNum, isFree := range free {
+		if !isFree {
+			length = 0
+			continue
+		}
+		length++
+		if length == n {
+			return blockNum - n + 1
+		}
+	}
+	return -1
+}
+
+func TestVerify(t *testing.T) {
+	d, _ := NewDisk(100, 10)
+	manifest, _ := d.Write([]byte("spans two blocks"))
+	assert.Nil(t, d.Verify([]*BlockRecord{manifest, nil}))
+	stale := &BlockRecord{extents: []extent{{5, 1}}, size: 1}
+	assert.Equal(t, ErrInvalidRecord, d.Verify([]*BlockRecord{manifest, stale}))
+	outside := &BlockRecord{extents: []extent{{9, 2}}, size: 11}
+	assert.Equal(t, ErrInvalidRecord, d.Verify([]*BlockRecord{outside}))
+	d.Delete(manifest)
+	assert.Equal(t, ErrInvalidRecord, d.Verify([]*BlockRecord{manifest}))
+}
+
+func TestLoadDiskVersion1(t *testing.T) {
+	var image bytes.Buffer
+	image.WriteString(imageMagic)
+	binary.Write(&image, binary.LittleEndian, uint32(1))
+	for _, value := range []int64{40, 10, 2, 30, 10} {
+		binary.Write(&image, binary.LittleEndian, value)
+	}
+	image.Write(bytes.Repeat([]byte("x"), 40))
+	loaded, err := LoadDisk(&image)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, loaded.GetAvailableMemory())
+	assert.Equal(t, []int{1, 3}, loaded.(*disk).free.freeBlocks())
+}
@@ -0,0 +1,133 @@
+package disk
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrRecordsMismatch = errors.New("the records do not list the blocks in use")
+
+// DefragmentProgress tells how far a defragmentation got, the first Placed of the Total blocks in use
+// hold the data they end up with
+type DefragmentProgress struct {
+	Placed int
+	Total  int
+}
+
+// Defragment moves the blocks in use to the start of the disk, laid out in the order of blockManifests
+// so that every record is a single extent, and leaves the free space as a single region at the end.
+// blockManifests must list every block in use, a block shared by several records is placed where the
+// first of them needs it. Their extents are updated in place, callers must keep anyone else from using
+// them meanwhile. progress, when not nil, is called after every block moved and once every block is placed,
+// it runs with the disk locked and must not use it.
+// When ctx is done the blocks stop moving and the records are updated to where their blocks are,
+// the disk is left partly defragmented and ctx.Err() is returned
+func (disk *disk) Defragment(ctx context.Context, blockManifests []*BlockRecord, progress func(DefragmentProgress)) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	numberOfBlocks := disk.size / disk.blockSize
+	//holder[pos] is the block whose data is at pos and where[blockNum] the position of the data of blockNum,
+	//blocks are numbered as they were before the defragmentation and free positions are held by -1
+	holder := make([]int, numberOfBlocks)
+	where := make([]int, numberOfBlocks)
+	for blockNum := range holder {
+		holder[blockNum], where[blockNum] = blockNum, blockNum
+	}
+	free := disk.free.freeBlocks()
+	for _, blockNum := range free {
+		holder[blockNum], where[blockNum] = -1, -1
+	}
+
+	records := make([]*BlockRecord, 0, len(blockManifests))
+	seen := map[*BlockRecord]bool{}
+	order := make([]int, 0, numberOfBlocks-len(free))
+	placed := make([]bool, numberOfBlocks)
+	for _, blockManifest := range blockManifests {
+		if blockManifest == nil || seen[blockManifest] {
+			continue
+		}
+		seen[blockManifest] = true
+		records = append(records, blockManifest)
+		for _, blockNum := range blockManifest.blockNums() {
+			if blockNum < 0 || blockNum >= numberOfBlocks || where[blockNum] == -1 {
+				return ErrRecordsMismatch
+			}
+			if !placed[blockNum] {
+				placed[blockNum] = true
+				order = append(order, blockNum)
+			}
+		}
+	}
+	if len(order) != numberOfBlocks-len(free) {
+		return ErrRecordsMismatch
+	}
+
+	var err error
+	reported := 0
+	data, spare := make([]byte, disk.blockSize), make([]byte, disk.blockSize)
+	for target, blockNum := range order {
+		from := where[blockNum]
+		if from == target {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		occupant := holder[target]
+		if occupant == -1 {
+			err = disk.copyBlock(from, target, data)
+		} else {
+			err = disk.swapBlocks(from, target, data, spare)
+		}
+		if err != nil {
+			break
+		}
+		holder[from] = occupant
+		if occupant != -1 {
+			where[occupant] = from
+		}
+		holder[target], where[blockNum] = blockNum, target
+		if progress != nil {
+			reported = target + 1
+			progress(DefragmentProgress{Placed: reported, Total: len(order)})
+		}
+	}
+	if err == nil && progress != nil && reported != len(order) {
+		progress(DefragmentProgress{Placed: len(order), Total: len(order)})
+	}
+
+	for _, blockManifest := range records {
+		blockNums := blockManifest.blockNums()
+		for i := range blockNums {
+			blockNums[i] = where[blockNums[i]]
+		}
+		blockManifest.setBlocks(blockNums)
+	}
+	refs := map[int]int{}
+	for blockNum, count := range disk.refs {
+		refs[where[blockNum]] = count
+	}
+	disk.refs = refs
+	disk.free, disk.allocator = newBitmap(numberOfBlocks), disk.newAllocator(numberOfBlocks)
+	for pos, blockNum := range holder {
+		if blockNum == -1 {
+			disk.releaseBlock(pos)
+		}
+	}
+	return err
+}
+
+// swapBlocks exchanges the data of the blocks numbered a and b through two block sized buffers
+func (disk *disk) swapBlocks(a int, b int, data []byte, spare []byte) error {
+	if _, err := disk.buffer.ReadAt(data, int64(a*disk.blockSize)); err != nil {
+		return err
+	}
+	if _, err := disk.buffer.ReadAt(spare, int64(b*disk.blockSize)); err != nil {
+		return err
+	}
+	if _, err := disk.buffer.WriteAt(data, int64(b*disk.blockSize)); err != nil {
+		return err
+	}
+	_, err := disk.buffer.WriteAt(spare, int64(a*disk.blockSize))
+	return err
+}
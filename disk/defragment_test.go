@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupFragmented returns a disk whose records are scattered backwards with holes in between, along with
+// the records in use and the data they hold
+func setupFragmented(t *testing.T) (*disk, []*BlockRecord, [][]byte) {
+	d, _ := NewDisk(200, 10)
+	manifests, contents := make([]*BlockRecord, 0), make([][]byte, 0)
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 5+7*i)
+		manifest, err := d.Write(data)
+		assert.Nil(t, err)
+		manifests, contents = append(manifests, manifest), append(contents, data)
+	}
+	for _, i := range []int{4, 1} {
+		d.Delete(manifests[i])
+		manifests, contents = append(manifests[:i], manifests[i+1:]...), append(contents[:i], contents[i+1:]...)
+	}
+	assert.Nil(t, d.Append(manifests[0], []byte("appended")))
+	contents[0] = append(contents[0], "appended"...)
+	return d.(*disk), manifests, contents
+}
+
+func assertContents(t *testing.T, d Disk, manifests []*BlockRecord, contents [][]byte) {
+	for i, manifest := range manifests {
+		data, err := d.Read(manifest)
+		assert.Nil(t, err)
+		assert.Equal(t, contents[i], data)
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	d, manifests, contents := setupFragmented(t)
+	available := d.GetAvailableMemory()
+	shared := d.Clone(manifests[1])
+	updates := make([]DefragmentProgress, 0)
+	err := d.Defragment(context.Background(), append(manifests, shared, manifests[0]), func(progress DefragmentProgress) {
+		updates = append(updates, progress)
+	})
+	assert.Nil(t, err)
+	assertContents(t, d, manifests, contents)
+	assert.Equal(t, available, d.GetAvailableMemory())
+
+	//records follow one another from the start of the disk, new blocks come out of the free region after them
+	next := 0
+	for _, manifest := range manifests {
+		assert.Equal(t, []extent{{next, manifest.BlockCount()}}, manifest.extents)
+		next += manifest.BlockCount()
+	}
+	assert.True(t, shared.Equal(manifests[1]))
+	free := d.allocator.FreeBlocks()
+	sort.Ints(free)
+	assert.Equal(t, blockRange(next, 20), free)
+	assert.NotEmpty(t, updates)
+	assert.Equal(t, DefragmentProgress{Placed: next, Total: next}, updates[len(updates)-1])
+
+	manifest, _ := d.Write([]byte("fresh"))
+	assert.GreaterOrEqual(t, manifest.blockNums()[0], next)
+	d.Delete(manifest)
+
+	//shared blocks are still shared
+	_, err = d.WriteAt(shared, []byte("X"), 0)
+	assert.Nil(t, err)
+	assertContents(t, d, manifests, contents)
+	d.Delete(manifests[1])
+	data, _ := d.Read(shared)
+	assert.Equal(t, append([]byte("X"), contents[1][1:]...), data)
+}
+
+func TestDefragmentCancel(t *testing.T) {
+	d, manifests, contents := setupFragmented(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	moves := 0
+	err := d.Defragment(ctx, manifests, func(progress DefragmentProgress) {
+		moves++
+		if moves == 2 {
+			cancel()
+		}
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, moves)
+	assertContents(t, d, manifests, contents)
+
+	//the disk is consistent and the defragmentation can be picked up again
+	assert.Nil(t, d.Defragment(context.Background(), manifests, nil))
+	assertContents(t, d, manifests, contents)
+	for _, manifest := range manifests {
+		assert.Equal(t, 1, manifest.ExtentCount())
+	}
+}
+
+func TestDefragmentMismatch(t *testing.T) {
+	d, manifests, contents := setupFragmented(t)
+	assert.Equal(t, ErrRecordsMismatch, d.Defragment(context.Background(), manifests[1:], nil))
+	stale := &BlockRecord{extents: []extent{{0, 1}}, size: 1}
+	assert.Equal(t, ErrRecordsMismatch, d.Defragment(context.Background(), append(manifests, stale), nil))
+	assertContents(t, d, manifests, contents)
+}
@@ -2,159 +2,426 @@ package disk
 
 import (
 	"archive/zip"
-	"bytes"
+	"context"
 	"errors"
+	"io"
 	"log"
 	"math"
 	"os"
-
+	"sync"
 	"time"
-
-	"github.com/Saf1u/smpfs/pool"
 )
 
 // Package disk defines a in memory byte block allocator
-type block struct {
-	startIndex int
-	endIndex   int
-	used       int
-	size       int
-}
-
-func (b *block) Reset() {
-	b.used = b.size
-}
-func (b *block) SetUsed(size int) {
-	b.used = size
-}
 
+// disk is safe for concurrent use, mu guards the free map and the allocator while callers are expected
+// to serialize access to any single BlockRecord themselves. free tells which blocks are free whatever
+// the allocator, it is what manifests are checked against and what is persisted
 type disk struct {
-	buffer    []byte
-	blockPool *pool.Pool
-	blockSize int
+	mu        sync.Mutex
+	buffer    storage
+	size      int
+	free      *bitmap
+	allocator Allocator
+	//newAllocator makes the allocator again when the blocks are rearranged
+	newAllocator NewAllocator
+	blockSize    int
+	refs         map[int]int
 }
 
 type Disk interface {
 	Write(fileBytes []byte) (*BlockRecord, error)
 	Read(blockManifest *BlockRecord) ([]byte, error)
+	ReadAt(blockManifest *BlockRecord, p []byte, off int) (int, error)
+	WriteAt(blockManifest *BlockRecord, p []byte, off int) (int, error)
+	Append(blockManifest *BlockRecord, fileBytes []byte) error
 	Delete(blockManifest *BlockRecord)
+	Clone(blockManifest *BlockRecord) *BlockRecord
+	RebuildReferences(blockManifests []*BlockRecord)
+	Verify(blockManifests []*BlockRecord) error
+	Defragment(ctx context.Context, blockManifests []*BlockRecord, progress func(DefragmentProgress)) error
+	Resize(newSize int, blockManifests []*BlockRecord) error
 	GetAvailableMemory() int 
 	SaveDisk()
+	Save(w io.Writer) error
 }
 
+// BlockRecord lists the blocks holding a file as extents, runs of contiguous blocks, in the order the
+// data is laid out in. Every block is full but the last one, so a byte offset maps to a block without
+// visiting them all
 type BlockRecord struct {
-	blocks []block
+	extents []extent
+	size    int
 }
 
 func NewBlockRecord() *BlockRecord {
-	return &BlockRecord{make([]block, 0)}
+	return &BlockRecord{extents: make([]extent, 0)}
 }
 
-func (blockRecord *BlockRecord) addBlock(b block) {
-	blockRecord.blocks = append(blockRecord.blocks, b)
+// addBlock appends the block numbered blockNum to the record, it extends the last extent when the
+// block follows it
+func (blockRecord *BlockRecord) addBlock(blockNum int) {
+	blockRecord.addExtent(extent{start: blockNum, length: 1})
 }
 
-func (blockRecord *BlockRecord) getUnfilledBlock() *block {
-	if len(blockRecord.blocks) == 0 {
-		return nil
+func (blockRecord *BlockRecord) addExtent(ext extent) {
+	if last := len(blockRecord.extents) - 1; last >= 0 && blockRecord.extents[last].start+blockRecord.extents[last].length == ext.start {
+		blockRecord.extents[last].length += ext.length
+		return
 	}
-	lastBlock := blockRecord.blocks[len(blockRecord.blocks)-1]
-	if lastBlock.size == lastBlock.used {
-		return nil
+	blockRecord.extents = append(blockRecord.extents, ext)
+}
+
+// blockNums returns the numbers of the blocks of the record in order
+func (blockRecord *BlockRecord) blockNums() []int {
+	blockNums := make([]int, 0, blockRecord.BlockCount())
+	for _, ext := range blockRecord.extents {
+		for blockNum := ext.start; blockNum < ext.start+ext.length; blockNum++ {
+			blockNums = append(blockNums, blockNum)
+		}
+	}
+	return blockNums
+}
+
+// blockAt returns the number of the i-th block of the record
+func (blockRecord *BlockRecord) blockAt(i int) int {
+	for _, ext := range blockRecord.extents {
+		if i < ext.length {
+			return ext.start + i
+		}
+		i -= ext.length
 	}
-	return &lastBlock
+	return -1
+}
+
+// setBlocks replaces the blocks of the record, keeping its size
+func (blockRecord *BlockRecord) setBlocks(blockNums []int) {
+	blockRecord.extents = make([]extent, 0, len(blockRecord.extents))
+	for _, blockNum := range blockNums {
+		blockRecord.addBlock(blockNum)
+	}
+}
+
+// Size returns the number of bytes stored across the blocks of the record
+func (blockRecord *BlockRecord) Size() int {
+	if blockRecord == nil {
+		return 0
+	}
+	return blockRecord.size
+}
+
+// BlockCount returns the number of blocks the record spans
+func (blockRecord *BlockRecord) BlockCount() int {
+	if blockRecord == nil {
+		return 0
+	}
+	count := 0
+	for _, ext := range blockRecord.extents {
+		count += ext.length
+	}
+	return count
+}
+
+// ExtentCount returns the number of runs of contiguous blocks the record spans
+func (blockRecord *BlockRecord) ExtentCount() int {
+	if blockRecord == nil {
+		return 0
+	}
+	return len(blockRecord.extents)
 }
 
 var (
 	ErrBlockSizeExceedsDriveSize = errors.New("block size is greater than available disk")
 	ErrInsufficentMemoryError    = errors.New("not enough memory present to store file")
+	ErrNegativeOffset            = errors.New("offset is negative")
+	ErrInvalidRecord             = errors.New("the record lists a block that is free or past the end of the disk")
 )
 
-func NewDisk(size int, blockSize int) (Disk, error) {
+func NewDisk(size int, blockSize int, opts ...Option) (Disk, error) {
 	if blockSize > size {
 		return nil, ErrBlockSizeExceedsDriveSize
 	}
-	pool := pool.NewPool()
-	numberOfBlocks := size / blockSize
-	//floor div
+	return newDisk(make(memoryStorage, size), size, blockSize, nil, opts), nil
+}
 
-	startIndex := 0
-	endIndex := blockSize - 1
-	for blockNum := 0; blockNum < numberOfBlocks; blockNum++ {
-		pool.AddToPool(block{startIndex, endIndex, 0, blockSize})
-		startIndex = endIndex + 1
-		endIndex = (endIndex + blockSize)
+// newDisk returns a disk over buffer whose allocator is handed the free blocks in the order of
+// freeBlocks, every block that fits in size bytes is free when freeBlocks is nil
+func newDisk(buffer storage, size int, blockSize int, freeBlocks []int, opts []Option) *disk {
+	//floor div
+	numberOfBlocks := size / blockSize
+	newAllocator := applyOptions(opts).newAllocator
+	allocator := newAllocator(numberOfBlocks)
+	free := newBitmap(numberOfBlocks)
+	if freeBlocks == nil {
+		for blockNum := 0; blockNum < numberOfBlocks; blockNum++ {
+			allocator.Release(blockNum)
+			free.setFree(blockNum, true)
+		}
+	}
+	for _, blockNum := range freeBlocks {
+		allocator.Release(blockNum)
+		free.setFree(blockNum, true)
 	}
 	return &disk{
-		buffer:    make([]byte, size),
-		blockPool: pool,
-		blockSize: blockSize,
-	}, nil
+		buffer:       buffer,
+		size:         size,
+		free:         free,
+		allocator:    allocator,
+		newAllocator: newAllocator,
+		blockSize:    blockSize,
+		refs:         map[int]int{},
+	}
 }
-func (disk *disk) GetAvailableMemory() int {
-	return disk.blockPool.AvaialbleResourceUnits() * disk.blockSize
+
+// allocateBlocks takes n blocks from the allocator and marks them in use, it returns nil when fewer
+// than n blocks are free
+func (disk *disk) allocateBlocks(n int) []int {
+	blockNums := disk.allocator.Allocate(n)
+	for _, blockNum := range blockNums {
+		disk.free.setFree(blockNum, false)
+	}
+	return blockNums
 }
 
-func (disk *disk) Write(fileBytes []byte) (*BlockRecord, error) {
-	availableBlocks := disk.blockPool.AvaialbleResourceUnits()
-	blocksNeeded := int(math.Ceil(float64(len(fileBytes)) / float64(disk.blockSize)))
-	if blocksNeeded > availableBlocks {
+// allocate takes n blocks from the allocator and returns them as a record holding no data
+func (disk *disk) allocate(n int) (*BlockRecord, error) {
+	blockNums := disk.allocateBlocks(n)
+	if blockNums == nil {
 		return nil, ErrInsufficentMemoryError
 	}
-	blockManifest := &BlockRecord{}
-
-	//Wrap buffer for easy reads
-	fileBuffer := bytes.NewBuffer(fileBytes)
+	blockManifest := NewBlockRecord()
+	blockManifest.setBlocks(blockNums)
+	return blockManifest, nil
+}
 
-	var dataBlock block
+// releaseBlock marks the block numbered blockNum free and returns it to the allocator
+func (disk *disk) releaseBlock(blockNum int) {
+	disk.free.setFree(blockNum, true)
+	disk.allocator.Release(blockNum)
+}
 
-	for blocksNeeded != 0 {
-		dataBlock = disk.blockPool.GetResource().(block)
-		readSize := disk.writeDataToBlock(&dataBlock, fileBuffer, dataBlock.startIndex, dataBlock.endIndex+1)
-		dataBlock.SetUsed(readSize)
-		blockManifest.addBlock(dataBlock)
-		blocksNeeded--
+func (disk *disk) releaseBlocks(blockNums []int) {
+	for _, blockNum := range blockNums {
+		disk.releaseBlock(blockNum)
 	}
+}
 
+func (disk *disk) GetAvailableMemory() int {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	return disk.free.free * disk.blockSize
+}
+
+func (disk *disk) Write(fileBytes []byte) (*BlockRecord, error) {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	return disk.write(fileBytes)
+}
+
+func (disk *disk) write(fileBytes []byte) (*BlockRecord, error) {
+	blocksNeeded := int(math.Ceil(float64(len(fileBytes)) / float64(disk.blockSize)))
+	blockManifest, err := disk.allocate(blocksNeeded)
+	if err != nil {
+		return nil, err
+	}
+	blockManifest.size = len(fileBytes)
+	if _, err := disk.copyAt(blockManifest, fileBytes, 0, true); err != nil {
+		disk.release(blockManifest)
+		return nil, err
+	}
 	return blockManifest, nil
 }
-func (disk *disk) writeDataToBlock(dataBlock *block, fileBuffer *bytes.Buffer, startIndex, endIndex int) int {
 
-	memoryBlock := disk.buffer[startIndex:endIndex]
-	readSize, err := fileBuffer.Read(memoryBlock)
+func (disk *disk) Read(blockManifest *BlockRecord) ([]byte, error) {
+	if blockManifest == nil {
+		return []byte{}, nil
+	}
+	outBuffer := make([]byte, blockManifest.Size())
+	if _, err := disk.copyAt(blockManifest, outBuffer, 0, false); err != nil {
+		return nil, err
+	}
+	return outBuffer, nil
+}
+
+// ReadAt reads len(p) bytes of the file described by blockManifest starting at byte offset off,
+// only the extents covering the requested range are visited and no copy of the whole file is made
+func (disk *disk) ReadAt(blockManifest *BlockRecord, p []byte, off int) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	n, err := disk.copyAt(blockManifest, p, off, false)
 	if err != nil {
-		panic(err)
+		return n, err
 	}
-	return readSize
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
 
+// WriteAt writes p into the file described by blockManifest starting at byte offset off,
+// the file is grown with new blocks when the write goes past its end, any gap is zero filled
+func (disk *disk) WriteAt(blockManifest *BlockRecord, p []byte, off int) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	disk.mu.Lock()
+	err := disk.unshareRange(blockManifest, off, off+len(p))
+	if end := off + len(p); err == nil && end > blockManifest.Size() {
+		err = disk.grow(blockManifest, end)
+	}
+	disk.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return disk.copyAt(blockManifest, p, off, true)
 }
 
-func (disk *disk) Read(blockManifest *BlockRecord) ([]byte, error) {
-	outBuffer := make([]byte, 0)
-	bufferWrapper := bytes.NewBuffer(outBuffer)
-	for _, blocks := range blockManifest.blocks {
-		_, err := bufferWrapper.Write(disk.buffer[blocks.startIndex : blocks.startIndex+blocks.used])
-		if err != nil {
-			panic(err)
+// copyAt copies between p and the bytes of the record starting at offset off, up to its size,
+// towards the disk when write is set and out of it otherwise. Each extent is copied in one go
+func (disk *disk) copyAt(blockManifest *BlockRecord, p []byte, off int, write bool) (int, error) {
+	end := off + len(p)
+	if end > blockManifest.Size() {
+		end = blockManifest.Size()
+	}
+	copied := 0
+	if off >= end {
+		return copied, nil
+	}
+	err := disk.spans(blockManifest, off, end, func(diskOffset int64, recordOffset int, length int) error {
+		chunk := p[recordOffset-off : recordOffset-off+length]
+		var err error
+		if write {
+			_, err = disk.buffer.WriteAt(chunk, diskOffset)
+		} else {
+			_, err = disk.buffer.ReadAt(chunk, diskOffset)
+		}
+		if err == nil {
+			copied += length
+		}
+		return err
+	})
+	return copied, err
+}
+
+// spans calls fn with the disk offset of every contiguous part of the bytes [from, to) of the blocks of
+// the record, along with the offset of the part in the record and its length. It stops at the first error
+func (disk *disk) spans(blockManifest *BlockRecord, from int, to int, fn func(diskOffset int64, recordOffset int, length int) error) error {
+	extentOffset := 0
+	for _, ext := range blockManifest.extents {
+		if extentOffset >= to {
+			break
+		}
+		extentEnd := extentOffset + ext.length*disk.blockSize
+		if extentEnd > from {
+			start, end := from, to
+			if start < extentOffset {
+				start = extentOffset
+			}
+			if end > extentEnd {
+				end = extentEnd
+			}
+			if err := fn(int64(ext.start*disk.blockSize+start-extentOffset), start, end-start); err != nil {
+				return err
+			}
 		}
+		extentOffset = extentEnd
+	}
+	return nil
+}
+
+// zero zero fills the bytes [from, to) of the blocks of the record
+func (disk *disk) zero(blockManifest *BlockRecord, from int, to int) error {
+	if from >= to {
+		return nil
+	}
+	zeros := make([]byte, disk.blockSize)
+	return disk.spans(blockManifest, from, to, func(diskOffset int64, recordOffset int, length int) error {
+		for length > 0 {
+			chunk := zeros
+			if length < len(chunk) {
+				chunk = chunk[:length]
+			}
+			if _, err := disk.buffer.WriteAt(chunk, diskOffset); err != nil {
+				return err
+			}
+			diskOffset += int64(len(chunk))
+			length -= len(chunk)
+		}
+		return nil
+	})
+}
+
+// grow extends the file described by blockManifest to size bytes, filling the unused tail of
+// its last block before allocating new ones, the newly covered bytes are zeroed
+func (disk *disk) grow(blockManifest *BlockRecord, size int) error {
+	capacity := blockManifest.BlockCount() * disk.blockSize
+	copies := 0
+	if blockManifest.size < capacity && disk.refs[blockManifest.blockAt(blockManifest.size/disk.blockSize)] > 0 {
+		copies = 1
+	}
+	blocksNeeded := 0
+	if size > capacity {
+		blocksNeeded = int(math.Ceil(float64(size-capacity) / float64(disk.blockSize)))
+	}
+	if blocksNeeded+copies > disk.free.free {
+		return ErrInsufficentMemoryError
+	}
 
+	tailEnd := size
+	if tailEnd > capacity {
+		tailEnd = capacity
 	}
-	return bufferWrapper.Bytes(), nil
+	if err := disk.unshareRange(blockManifest, blockManifest.size, tailEnd); err != nil {
+		return err
+	}
+	if err := disk.zero(blockManifest, blockManifest.size, tailEnd); err != nil {
+		return err
+	}
+	grown, err := disk.allocate(blocksNeeded)
+	if err != nil {
+		return err
+	}
+	if err := disk.zero(grown, 0, blocksNeeded*disk.blockSize); err != nil {
+		disk.release(grown)
+		return err
+	}
+	mergeBlockRecords(blockManifest, grown)
+	blockManifest.size = size
+	return nil
 }
 
+// Append adds fileBytes to the end of the file described by blockManifest, the unused tail of
+// its last block is filled first and new blocks are only allocated for the remainder
 func (disk *disk) Append(blockManifest *BlockRecord, fileBytes []byte) error {
-	//Wrap buffer for easy reads
-	fileBuffer := bytes.NewBuffer(fileBytes)
-	extraBlock := blockManifest.getUnfilledBlock()
-	dataToReadSize := len(fileBytes)
-	if extraBlock != nil {
-		numBytesRead := disk.writeDataToBlock(extraBlock, fileBuffer, extraBlock.used+extraBlock.startIndex, extraBlock.endIndex+1)
-		if numBytesRead == dataToReadSize {
+	if len(fileBytes) == 0 {
+		return nil
+	}
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	tail := blockManifest.BlockCount()*disk.blockSize - blockManifest.size
+	if tail > len(fileBytes) {
+		tail = len(fileBytes)
+	}
+	if err := disk.unshareRange(blockManifest, blockManifest.size, blockManifest.size+tail); err != nil {
+		return err
+	}
+	remainder := len(fileBytes) - tail
+	if remainder > 0 && int(math.Ceil(float64(remainder)/float64(disk.blockSize))) > disk.free.free {
+		return ErrInsufficentMemoryError
+	}
+
+	if tail > 0 {
+		blockManifest.size += tail
+		if _, err := disk.copyAt(blockManifest, fileBytes[:tail], blockManifest.size-tail, true); err != nil {
+			blockManifest.size -= tail
+			return err
+		}
+		if remainder == 0 {
 			return nil
 		}
-		dataToReadSize = dataToReadSize - numBytesRead
 	}
-	appendedRecords, err := disk.Write(fileBytes[dataToReadSize:])
+	appendedRecords, err := disk.write(fileBytes[tail:])
 	if err != nil {
 		return err
 	}
@@ -163,21 +430,59 @@ func (disk *disk) Append(blockManifest *BlockRecord, fileBytes []byte) error {
 
 }
 
+// mergeBlockRecords appends the blocks and data of blockSrc to blockDest, whose last block must be full
 func mergeBlockRecords(blockDest, blockSrc *BlockRecord) {
-	for i := 0; i < len(blockSrc.blocks); i++ {
-		blockDest.addBlock(blockDest.blocks[i])
+	for _, ext := range blockSrc.extents {
+		blockDest.addExtent(ext)
 	}
+	blockDest.size += blockSrc.size
 }
 
 func (disk *disk) Delete(blockManifest *BlockRecord) {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	disk.release(blockManifest)
+}
+
+func (disk *disk) release(blockManifest *BlockRecord) {
 	//no zeroing needed
-	for _, block := range blockManifest.blocks {
-		block.SetUsed(0)
-		disk.blockPool.AddToPool(block)
+	for _, ext := range blockManifest.extents {
+		for blockNum := ext.start; blockNum < ext.start+ext.length; blockNum++ {
+			if disk.refs[blockNum] > 0 {
+				disk.unref(blockNum)
+				continue
+			}
+			disk.releaseBlock(blockNum)
+		}
 	}
 }
 
+// Verify checks that every block listed by blockManifests is in use, it fails with ErrInvalidRecord
+// when one of them is free or past the end of the disk
+func (disk *disk) Verify(blockManifests []*BlockRecord) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	for _, blockManifest := range blockManifests {
+		if blockManifest == nil {
+			continue
+		}
+		for _, ext := range blockManifest.extents {
+			if ext.start < 0 || ext.start+ext.length > disk.free.blocks {
+				return ErrInvalidRecord
+			}
+			for blockNum := ext.start; blockNum < ext.start+ext.length; blockNum++ {
+				if disk.free.isFree(blockNum) {
+					return ErrInvalidRecord
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (disk *disk) SaveDisk() {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
 	name := "DISKSNAPSHOT-" + time.Now().Format("Jan _2 15:04:05.000000000")
 	zipFile, err := os.Create(name + ".zip")
 	if err != nil {
@@ -185,7 +490,10 @@ func (disk *disk) SaveDisk() {
 	}
 	zipper := zip.NewWriter(zipFile)
 	saveFile, err := zipper.Create(name)
-	saveFile.Write(disk.buffer)
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.Copy(saveFile, io.NewSectionReader(disk.buffer, 0, int64(disk.size)))
 	if err != nil {
 		panic(err)
 	}
@@ -1,6 +1,12 @@
 package disk
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -65,7 +71,7 @@ func TestWrite(t *testing.T) {
 		rec, err := disk.Write(testcase.data)
 		assert.Equal(t, testcase.expectedErr, err)
 		if err == nil {
-			assert.Equal(t, len(rec.blocks), testcase.blocksUsed)
+			assert.Equal(t, rec.BlockCount(), testcase.blocksUsed)
 		}
 	}
 }
@@ -99,16 +105,339 @@ func TestRead(t *testing.T) {
 	}
 }
 
-func TestGetUnfilledBlock(t *testing.T) {
+func TestBlockRecordExtents(t *testing.T) {
 	record := NewBlockRecord()
-	record.addBlock(block{startIndex: 0, endIndex: 100, used: 95, size: 100})
-	extraBlock := record.getUnfilledBlock()
-	assert.Equal(t, block{startIndex: 0, endIndex: 100, used: 95, size: 100}, *extraBlock)
-
-	record = NewBlockRecord()
-	record.addBlock(block{startIndex: 0, endIndex: 100, used: 100, size: 100})
-	extraBlock = record.getUnfilledBlock()
-	var block *block
-	//nil block
-	assert.Equal(t, extraBlock, block)
+	for _, blockNum := range []int{4, 5, 6, 2, 3, 7} {
+		record.addBlock(blockNum)
+	}
+	assert.Equal(t, []extent{{4, 3}, {2, 2}, {7, 1}}, record.extents)
+	assert.Equal(t, 6, record.BlockCount())
+	assert.Equal(t, 3, record.ExtentCount())
+	assert.Equal(t, 2, record.blockAt(3))
+	assert.Equal(t, []int{4, 5, 6, 2, 3, 7}, record.blockNums())
+
+	//appended extents are merged with the last one when they follow it
+	mergeBlockRecords(record, &BlockRecord{extents: []extent{{8, 2}, {0, 1}}, size: 25})
+	assert.Equal(t, []extent{{4, 3}, {2, 2}, {7, 3}, {0, 1}}, record.extents)
+	assert.Equal(t, 25, record.Size())
+
+	//records listing every block are read as extents
+	var legacy bytes.Buffer
+	enc := &encoder{w: &legacy}
+	for _, value := range []int{3, 20, 29, 10, 10, 30, 39, 10, 10, 0, 9, 4, 10} {
+		enc.writeInt(value)
+	}
+	decoded := NewBlockRecord()
+	assert.Nil(t, decoded.UnmarshalBinary(legacy.Bytes()))
+	assert.Equal(t, []extent{{2, 2}, {0, 1}}, decoded.extents)
+	assert.Equal(t, 24, decoded.Size())
+	encoded, _ := decoded.MarshalBinary()
+	reencoded := NewBlockRecord()
+	assert.Nil(t, reencoded.UnmarshalBinary(encoded))
+	assert.True(t, reencoded.Equal(decoded))
+	assert.Equal(t, ErrInvalidImage, reencoded.UnmarshalBinary(encoded[:len(encoded)-1]))
+}
+
+func TestReadAtWriteAt(t *testing.T) {
+	tests := []struct {
+		name         string
+		expectedErr  error
+		initialData  []byte
+		data         []byte
+		offset       int
+		expectedData []byte
+	}{
+		{name: "overwrite inside a block",
+			initialData:  []byte("hello world"),
+			data:         []byte("WORLD"),
+			offset:       6,
+			expectedData: []byte("hello WORLD"),
+		},
+		{name: "overwrite across blocks and grow",
+			initialData:  []byte("hello world"),
+			data:         []byte("big wide world"),
+			offset:       6,
+			expectedData: []byte("hello big wide world"),
+		},
+		{name: "write past the end zero fills the gap",
+			initialData:  []byte("abc"),
+			data:         []byte("xyz"),
+			offset:       12,
+			expectedData: append(append([]byte("abc"), make([]byte, 9)...), []byte("xyz")...),
+		},
+		{name: "write exceeding available disk space",
+			initialData: []byte("abc"),
+			data:        make([]byte, 100),
+			offset:      3,
+			expectedErr: ErrInsufficentMemoryError,
+		},
+		{name: "negative offset",
+			initialData: []byte("abc"),
+			data:        []byte("abc"),
+			offset:      -1,
+			expectedErr: ErrNegativeOffset,
+		},
+	}
+	for _, testcase := range tests {
+		disk, _ := NewDisk(100, 5)
+		//dirty the disk so stale bytes would show up in gaps
+		stale, _ := disk.Write(bytes.Repeat([]byte{0xff}, 100))
+		disk.Delete(stale)
+		manifest, _ := disk.Write(testcase.initialData)
+		_, err := disk.WriteAt(manifest, testcase.data, testcase.offset)
+		assert.Equal(t, testcase.expectedErr, err, testcase.name)
+		if err != nil {
+			continue
+		}
+		data, _ := disk.Read(manifest)
+		assert.Equal(t, testcase.expectedData, data, testcase.name)
+
+		partial := make([]byte, 4)
+		n, err := disk.ReadAt(manifest, partial, len(testcase.expectedData)-2)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, testcase.expectedData[len(testcase.expectedData)-2:], partial[:n])
+	}
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name           string
+		expectedErr    error
+		initialData    []byte
+		data           []byte
+		expectedData   []byte
+		expectedBlocks int
+		expectedMemory int
+	}{
+		{name: "append fitting in the tail block",
+			initialData:    []byte("hello"),
+			data:           []byte(" you"),
+			expectedData:   []byte("hello you"),
+			expectedBlocks: 1,
+			expectedMemory: 90,
+		},
+		{name: "append spilling into new blocks",
+			initialData:    []byte("hello"),
+			data:           []byte(" world, appended"),
+			expectedData:   []byte("hello world, appended"),
+			expectedBlocks: 3,
+			expectedMemory: 70,
+		},
+		{name: "append to an empty record",
+			initialData:    []byte{},
+			data:           []byte("fresh"),
+			expectedData:   []byte("fresh"),
+			expectedBlocks: 1,
+			expectedMemory: 90,
+		},
+		{name: "append exceeding available disk space",
+			initialData:    []byte("hello"),
+			data:           make([]byte, 96),
+			expectedErr:    ErrInsufficentMemoryError,
+			expectedData:   []byte("hello"),
+			expectedBlocks: 1,
+			expectedMemory: 90,
+		},
+	}
+	for _, testcase := range tests {
+		disk, _ := NewDisk(100, 10)
+		manifest, _ := disk.Write(testcase.initialData)
+		err := disk.Append(manifest, testcase.data)
+		assert.Equal(t, testcase.expectedErr, err, testcase.name)
+		data, _ := disk.Read(manifest)
+		assert.Equal(t, testcase.expectedData, data, testcase.name)
+		assert.Equal(t, testcase.expectedBlocks, manifest.BlockCount(), testcase.name)
+		assert.Equal(t, testcase.expectedMemory, disk.GetAvailableMemory(), testcase.name)
+	}
+}
+
+func TestCloneCopyOnWrite(t *testing.T) {
+	disk, _ := NewDisk(100, 10)
+	original, _ := disk.Write([]byte("shared data here"))
+	clone := disk.Clone(original)
+	assert.True(t, clone.Equal(original))
+	assert.Equal(t, 80, disk.GetAvailableMemory())
+
+	//writing to the clone copies only the block it touches
+	_, err := disk.WriteAt(clone, []byte("SH"), 0)
+	assert.Nil(t, err)
+	assert.False(t, clone.Equal(original))
+	assert.Equal(t, 70, disk.GetAvailableMemory())
+	data, _ := disk.Read(original)
+	assert.Equal(t, []byte("shared data here"), data)
+	data, _ = disk.Read(clone)
+	assert.Equal(t, []byte("SHared data here"), data)
+
+	//appending to the original copies its shared tail block
+	assert.Nil(t, disk.Append(original, []byte("!")))
+	assert.Equal(t, 60, disk.GetAvailableMemory())
+	data, _ = disk.Read(clone)
+	assert.Equal(t, []byte("SHared data here"), data)
+
+	//the blocks still shared are only freed with their last record
+	disk.Delete(original)
+	assert.Equal(t, 80, disk.GetAvailableMemory())
+	data, _ = disk.Read(clone)
+	assert.Equal(t, []byte("SHared data here"), data)
+	disk.Delete(clone)
+	assert.Equal(t, 100, disk.GetAvailableMemory())
+
+	//a full disk cannot copy a shared block
+	full, _ := disk.Write(make([]byte, 100))
+	fullClone := disk.Clone(full)
+	_, err = disk.WriteAt(fullClone, []byte("x"), 0)
+	assert.Equal(t, ErrInsufficentMemoryError, err)
+
+	disk.RebuildReferences([]*BlockRecord{full})
+	_, err = disk.WriteAt(full, []byte("x"), 0)
+	assert.Nil(t, err)
+}
+
+func TestConcurrentWriteDelete(t *testing.T) {
+	disk, _ := NewDisk(1000, 10)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 10; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(worker)}, 25)
+			for i := 0; i < 200; i++ {
+				manifest, err := disk.Write(data)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				assert.Nil(t, disk.Append(manifest, data))
+				read, _ := disk.Read(manifest)
+				assert.Equal(t, append(data, data...), read)
+				disk.Delete(manifest)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	assert.Equal(t, 1000, disk.GetAvailableMemory())
+}
+
+func TestSaveLoadDisk(t *testing.T) {
+	original, _ := NewDisk(100, 10)
+	first, _ := original.Write([]byte("first file spanning blocks"))
+	second, _ := original.Write([]byte("second"))
+	original.Delete(first)
+
+	var image bytes.Buffer
+	assert.Nil(t, original.Save(&image))
+	saved := append([]byte{}, image.Bytes()...)
+	loaded, err := LoadDisk(&image)
+	assert.Nil(t, err)
+	assert.Equal(t, original.GetAvailableMemory(), loaded.GetAvailableMemory())
+
+	encoded, err := second.MarshalBinary()
+	assert.Nil(t, err)
+	manifest := NewBlockRecord()
+	assert.Nil(t, manifest.UnmarshalBinary(encoded))
+	data, _ := loaded.Read(manifest)
+	assert.Equal(t, []byte("second"), data)
+
+	//both disks hand out the same blocks after loading with an allocator that only depends on the free blocks
+	original, _ = NewDisk(100, 10, WithAllocator(NewFirstFitAllocator))
+	first, _ = original.Write([]byte("first file spanning blocks"))
+	original.Write([]byte("second"))
+	original.Delete(first)
+	image.Reset()
+	assert.Nil(t, original.Save(&image))
+	loaded, err = LoadDisk(&image, WithAllocator(NewFirstFitAllocator))
+	assert.Nil(t, err)
+	expected, _ := original.Write([]byte("third"))
+	actual, _ := loaded.Write([]byte("third"))
+	assert.Equal(t, expected, actual)
+
+	var resaved bytes.Buffer
+	reloaded, _ := LoadDisk(bytes.NewReader(saved))
+	assert.Nil(t, reloaded.Save(&resaved))
+	assert.Equal(t, saved, resaved.Bytes())
+
+	_, err = LoadDisk(bytes.NewReader([]byte("not a disk image")))
+	assert.Equal(t, ErrInvalidImage, err)
+	_, err = LoadDisk(bytes.NewReader(saved[:len(saved)-1]))
+	assert.Equal(t, ErrInvalidImage, err)
+}
+
+func TestFileDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	fileDisk, err := NewFileDisk(path, 100, 10)
+	assert.Nil(t, err)
+	kept, err := fileDisk.Write([]byte("data that outlives the process"))
+	assert.Nil(t, err)
+	dropped, _ := fileDisk.Write([]byte("dropped"))
+	fileDisk.Delete(dropped)
+	assert.Nil(t, fileDisk.Append(kept, []byte(", appended")))
+	assert.Nil(t, fileDisk.Close())
+	assert.Equal(t, ErrDiskClosed, fileDisk.Close())
+
+	_, err = NewFileDisk(path, 100, 10)
+	assert.True(t, errors.Is(err, os.ErrExist))
+
+	reopened, err := OpenFileDisk(path)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 60, reopened.GetAvailableMemory())
+	data, err := reopened.Read(kept)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data that outlives the process, appended"), data)
+
+	//freed blocks are handed out again, kept ones are not
+	other, err := reopened.Write(make([]byte, 60))
+	assert.Nil(t, err)
+	data, _ = reopened.Read(kept)
+	assert.Equal(t, []byte("data that outlives the process, appended"), data)
+	_, err = reopened.Write([]byte("x"))
+	assert.Equal(t, ErrInsufficentMemoryError, err)
+	reopened.Delete(other)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.img")
+	assert.Nil(t, os.WriteFile(garbage, []byte("not a disk"), 0644))
+	_, err = OpenFileDisk(garbage)
+	assert.Equal(t, ErrInvalidSuperblock, err)
+}
+
+// BenchmarkRecord writes, reads and deletes a 1MB file on 64 byte blocks. The stack allocator hands blocks
+// out backwards so every block is an extent of its own, as every block had an entry before records were
+// made of extents, while first fit lays the file out as a single extent
+func BenchmarkRecord(b *testing.B) {
+	const blockSize, fileSize = 64, 1 << 20
+	data := bytes.Repeat([]byte("extent"), fileSize/6+1)[:fileSize]
+	for _, testcase := range []struct {
+		name         string
+		newAllocator NewAllocator
+	}{{"scattered", NewStackAllocator}, {"contiguous", NewFirstFitAllocator}} {
+		b.Run("write/"+testcase.name, func(b *testing.B) {
+			disk, _ := NewDisk(fileSize, blockSize, WithAllocator(testcase.newAllocator))
+			b.SetBytes(fileSize)
+			for n := 0; n < b.N; n++ {
+				manifest, _ := disk.Write(data)
+				disk.Delete(manifest)
+			}
+		})
+		b.Run("read/"+testcase.name, func(b *testing.B) {
+			disk, _ := NewDisk(fileSize, blockSize, WithAllocator(testcase.newAllocator))
+			manifest, _ := disk.Write(data)
+			encoded, _ := manifest.MarshalBinary()
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				disk.Read(manifest)
+			}
+			b.ReportMetric(float64(len(encoded)), "manifest-bytes")
+		})
+		b.Run("delete/"+testcase.name, func(b *testing.B) {
+			disk, _ := NewDisk(fileSize, blockSize, WithAllocator(testcase.newAllocator))
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				manifest, _ := disk.Write(data)
+				b.StartTimer()
+				disk.Delete(manifest)
+			}
+		})
+	}
 }
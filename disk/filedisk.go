@@ -0,0 +1,245 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// file layout, integers are little endian:
+//
+//	superblock: magic [4]byte "SMPB" | version uint32 | size int64 | blockSize int64 | free map offset int64
+//	blocks:     size bytes
+//	free map:   one bit per block, set while the block is in use, at the free map offset past the blocks
+//
+// the blocks never move within the file. Resizing writes the free map of the new size where the current
+// layout does not reach and then switches to it with a single write of the superblock, so a crash leaves
+// either layout whole. Version 1 files have no free map offset, their free map follows the superblock and
+// the blocks follow it, they still open but cannot be resized
+const (
+	superblockMagic      = "SMPB"
+	superblockVersion    = uint32(2)
+	superblockSize       = 32
+	legacySuperblockSize = 24
+)
+
+var (
+	ErrInvalidSuperblock = errors.New("the file does not hold a valid disk superblock")
+	ErrDiskClosed        = errors.New("the disk is closed")
+)
+
+// FileDisk is a Disk storing its blocks in an image file rather than in memory, it can hold more data
+// than fits in RAM and be reopened with OpenFileDisk after the process restarts.
+// The free map is persisted on Sync and Close
+type FileDisk interface {
+	Disk
+	Sync() error
+	Close() error
+}
+
+type fileDisk struct {
+	*disk
+	file          imageFile
+	closed        bool
+	version       uint32
+	freeMapOffset int64
+}
+
+// NewFileDisk creates the image file at path and formats it as a disk of size bytes,
+// it fails if the file already exists. opts select the allocator as for NewDisk
+func NewFileDisk(path string, size int, blockSize int, opts ...Option) (FileDisk, error) {
+	if blockSize > size {
+		return nil, ErrBlockSizeExceedsDriveSize
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	freeMapOffset := int64(superblockSize + size)
+	if _, err := file.WriteAt(encodeSuperblock(size, blockSize, freeMapOffset), 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	//sparse on most filesystems, blocks only take space once written
+	if err := file.Truncate(freeMapOffset + int64(freeMapSize(size, blockSize))); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileDisk{
+		disk:          newDisk(&fileStorage{file: file, offset: superblockSize}, size, blockSize, nil, opts),
+		file:          file,
+		version:       superblockVersion,
+		freeMapOffset: freeMapOffset,
+	}, nil
+}
+
+// OpenFileDisk opens an image file created by NewFileDisk, restoring the free map saved by its last Sync or Close.
+// The allocator is not part of the image, opts select it as for NewDisk
+func OpenFileDisk(path string, opts ...Option) (FileDisk, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := openFileDisk(file, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return loaded, nil
+}
+
+func openFileDisk(file *os.File, opts []Option) (*fileDisk, error) {
+	superblock := make([]byte, superblockSize)
+	if _, err := file.ReadAt(superblock[:legacySuperblockSize], 0); err != nil {
+		return nil, ErrInvalidSuperblock
+	}
+	if string(superblock[:4]) != superblockMagic {
+		return nil, ErrInvalidSuperblock
+	}
+	version := binary.LittleEndian.Uint32(superblock[4:])
+	if version == 0 || version > superblockVersion {
+		return nil, ErrUnsupportedImageVersion
+	}
+	size := int(binary.LittleEndian.Uint64(superblock[8:]))
+	blockSize := int(binary.LittleEndian.Uint64(superblock[16:]))
+	if blockSize <= 0 || size < blockSize {
+		return nil, ErrInvalidSuperblock
+	}
+	dataOffset, freeMapOffset := int64(superblockSize), int64(legacySuperblockSize)
+	if version == 1 {
+		dataOffset = int64(legacySuperblockSize + freeMapSize(size, blockSize))
+	} else {
+		if _, err := file.ReadAt(superblock[legacySuperblockSize:], legacySuperblockSize); err != nil {
+			return nil, ErrInvalidSuperblock
+		}
+		freeMapOffset = int64(binary.LittleEndian.Uint64(superblock[24:]))
+		if freeMapOffset < dataOffset+int64(size) {
+			return nil, ErrInvalidSuperblock
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < dataOffset+int64(size) || info.Size() < freeMapOffset+int64(freeMapSize(size, blockSize)) {
+		return nil, ErrInvalidSuperblock
+	}
+	freeMap := make([]byte, freeMapSize(size, blockSize))
+	if _, err := file.ReadAt(freeMap, freeMapOffset); err != nil {
+		return nil, err
+	}
+
+	return &fileDisk{
+		disk:          newDisk(&fileStorage{file: file, offset: dataOffset}, size, blockSize, bitmapFromBytes(freeMap, size/blockSize).freeBlocks(), opts),
+		file:          file,
+		version:       version,
+		freeMapOffset: freeMapOffset,
+	}, nil
+}
+
+func encodeSuperblock(size int, blockSize int, freeMapOffset int64) []byte {
+	superblock := make([]byte, superblockSize)
+	copy(superblock, superblockMagic)
+	binary.LittleEndian.PutUint32(superblock[4:], superblockVersion)
+	binary.LittleEndian.PutUint64(superblock[8:], uint64(size))
+	binary.LittleEndian.PutUint64(superblock[16:], uint64(blockSize))
+	binary.LittleEndian.PutUint64(superblock[24:], uint64(freeMapOffset))
+	return superblock
+}
+
+// Sync persists the free map and flushes the image file to stable storage
+func (disk *fileDisk) Sync() error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	if disk.closed {
+		return ErrDiskClosed
+	}
+	return disk.sync()
+}
+
+// Close syncs the disk and closes the image file
+func (disk *fileDisk) Close() error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	if disk.closed {
+		return ErrDiskClosed
+	}
+	disk.closed = true
+	if err := disk.sync(); err != nil {
+		disk.file.Close()
+		return err
+	}
+	return disk.file.Close()
+}
+
+func (disk *fileDisk) sync() error {
+	if _, err := disk.file.WriteAt(disk.free.bytes(), disk.freeMapOffset); err != nil {
+		return err
+	}
+	return disk.file.Sync()
+}
+
+// Resize changes the size of the disk as Disk.Resize does. The blocks moved out of the truncated tail are
+// copied into free blocks and the new size and free map are synced with a single write of the superblock,
+// so a crash leaves the file either as it was or resized. Version 1 files fail with ErrUnsupportedImageVersion
+func (disk *fileDisk) Resize(newSize int, blockManifests []*BlockRecord) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	if disk.closed {
+		return ErrDiskClosed
+	}
+	if disk.version < superblockVersion {
+		return ErrUnsupportedImageVersion
+	}
+	if err := disk.resize(newSize, blockManifests, disk.commitSize); err != nil {
+		return err
+	}
+	return disk.compact()
+}
+
+// commitSize switches the file to a disk of size bytes whose free map is free. The free map is written
+// right after the blocks when that is past the end of the current free map, and after the current free
+// map otherwise, where it overwrites nothing a crash could still need
+func (disk *fileDisk) commitSize(size int, free *bitmap) error {
+	offset := int64(superblockSize + size)
+	if end := disk.freeMapOffset + int64(freeMapSize(disk.size, disk.blockSize)); offset < end {
+		offset = end
+	}
+	return disk.commitLayout(size, offset, free.bytes())
+}
+
+// compact moves the free map back to right after the blocks once the resized disk no longer needs what
+// is there, then truncates the file past the free map
+func (disk *fileDisk) compact() error {
+	freeMap := disk.free.bytes()
+	offset := int64(superblockSize + disk.size)
+	if offset != disk.freeMapOffset && offset+int64(len(freeMap)) <= disk.freeMapOffset {
+		if err := disk.commitLayout(disk.size, offset, freeMap); err != nil {
+			return err
+		}
+	}
+	return disk.file.Truncate(disk.freeMapOffset + int64(len(freeMap)))
+}
+
+// commitLayout writes freeMap at offset and syncs it along with any block written before, then points the
+// superblock at it with a single write, the commit point of the new layout
+func (disk *fileDisk) commitLayout(size int, offset int64, freeMap []byte) error {
+	if _, err := disk.file.WriteAt(freeMap, offset); err != nil {
+		return err
+	}
+	if err := disk.file.Sync(); err != nil {
+		return err
+	}
+	if _, err := disk.file.WriteAt(encodeSuperblock(size, disk.blockSize, offset), 0); err != nil {
+		return err
+	}
+	if err := disk.file.Sync(); err != nil {
+		return err
+	}
+	disk.freeMapOffset = offset
+	return nil
+}
+
+func freeMapSize(size int, blockSize int) int {
+	return (size/blockSize + 7) / 8
+}
@@ -0,0 +1,206 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// image layout, all integers are little endian int64 unless noted:
+//
+//	magic [4]byte "SMPD" | version uint32 | size | blockSize | free map | buffer
+//
+// the free map holds a bit per block, set while the block is in use, as the one of a FileDisk.
+// Version 1 images stored a free block count followed by the start index of every free block instead
+const (
+	imageMagic   = "SMPD"
+	imageVersion = uint32(2)
+)
+
+var (
+	ErrInvalidImage            = errors.New("the data is not a valid disk image")
+	ErrUnsupportedImageVersion = errors.New("the disk image version is not supported")
+)
+
+// Save writes the buffer and the free blocks of the disk to w
+func (disk *disk) Save(w io.Writer) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	enc := &encoder{w: w}
+	enc.write([]byte(imageMagic))
+	enc.write(imageVersion)
+	enc.writeInt(disk.size)
+	enc.writeInt(disk.blockSize)
+	enc.write(disk.free.bytes())
+	if enc.err != nil {
+		return enc.err
+	}
+	_, err := io.Copy(w, io.NewSectionReader(disk.buffer, 0, int64(disk.size)))
+	return err
+}
+
+// LoadDisk reads a disk written by Save, the returned disk holds the same data and the same free blocks as
+// the saved one. The allocator is not part of the image, opts select it as for NewDisk and it is handed the
+// free blocks in order, so the stack allocator hands out the last free block first
+func LoadDisk(r io.Reader, opts ...Option) (Disk, error) {
+	dec := &decoder{r: r}
+	magic := make([]byte, len(imageMagic))
+	dec.read(magic)
+	var version uint32
+	dec.read(&version)
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if string(magic) != imageMagic {
+		return nil, ErrInvalidImage
+	}
+	if version == 0 || version > imageVersion {
+		return nil, ErrUnsupportedImageVersion
+	}
+	size := dec.readInt()
+	blockSize := dec.readInt()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if blockSize <= 0 || size < blockSize {
+		return nil, ErrInvalidImage
+	}
+	var freeBlocks []int
+	if version == 1 {
+		freeBlocks = dec.readFreeList(size, blockSize)
+	} else {
+		freeMap := make([]byte, freeMapSize(size, blockSize))
+		dec.read(freeMap)
+		if dec.err == nil {
+			freeBlocks = bitmapFromBytes(freeMap, size/blockSize).freeBlocks()
+		}
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	buffer := make(memoryStorage, size)
+	dec.read([]byte(buffer))
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return newDisk(buffer, size, blockSize, freeBlocks, opts), nil
+}
+
+// readFreeList reads the free blocks of a version 1 image
+func (dec *decoder) readFreeList(size int, blockSize int) []int {
+	freeCount := dec.readInt()
+	if dec.err == nil && (freeCount < 0 || freeCount > size/blockSize) {
+		dec.err = ErrInvalidImage
+	}
+	if dec.err != nil {
+		return nil
+	}
+	freeBlocks := make([]int, freeCount)
+	for i := range freeBlocks {
+		startIndex := dec.readInt()
+		if dec.err == nil && (startIndex < 0 || startIndex%blockSize != 0 || startIndex+blockSize > size) {
+			dec.err = ErrInvalidImage
+		}
+		freeBlocks[i] = startIndex / blockSize
+	}
+	return freeBlocks
+}
+
+// records are encoded as
+//
+//	extentRecord | size | extent count | extents as start block, length in blocks
+//
+// older records listed every block instead, as block count | blocks as start index, end index, used, size.
+// Counts are never negative, extentRecord tells both apart
+const extentRecord = -1
+
+// MarshalBinary encodes the extents listed in the record
+func (blockRecord *BlockRecord) MarshalBinary() ([]byte, error) {
+	var buffer bytes.Buffer
+	enc := &encoder{w: &buffer}
+	enc.writeInt(extentRecord)
+	enc.writeInt(blockRecord.size)
+	enc.writeInt(len(blockRecord.extents))
+	for _, ext := range blockRecord.extents {
+		enc.writeInt(ext.start)
+		enc.writeInt(ext.length)
+	}
+	return buffer.Bytes(), enc.err
+}
+
+// UnmarshalBinary decodes a record encoded by MarshalBinary, replacing the extents of the record.
+// Records listing every block are read as well
+func (blockRecord *BlockRecord) UnmarshalBinary(data []byte) error {
+	dec := &decoder{r: bytes.NewReader(data)}
+	decoded := NewBlockRecord()
+	count := dec.readInt()
+	if count != extentRecord {
+		if dec.err != nil || count < 0 || count > len(data) {
+			return ErrInvalidImage
+		}
+		for i := 0; i < count; i++ {
+			startIndex, _, used, size := dec.readInt(), dec.readInt(), dec.readInt(), dec.readInt()
+			if dec.err != nil || startIndex < 0 || size <= 0 || startIndex%size != 0 || used < 0 || used > size {
+				return ErrInvalidImage
+			}
+			decoded.addBlock(startIndex / size)
+			decoded.size += used
+		}
+		*blockRecord = *decoded
+		return nil
+	}
+	decoded.size = dec.readInt()
+	count = dec.readInt()
+	if dec.err != nil || decoded.size < 0 || count < 0 || count > len(data) {
+		return ErrInvalidImage
+	}
+	for i := 0; i < count; i++ {
+		ext := extent{start: dec.readInt(), length: dec.readInt()}
+		if dec.err != nil || ext.start < 0 || ext.length <= 0 {
+			return ErrInvalidImage
+		}
+		decoded.addExtent(ext)
+	}
+	*blockRecord = *decoded
+	return nil
+}
+
+// encoder writes little endian values to w, keeping the first error it runs into
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (enc *encoder) write(data interface{}) {
+	if enc.err != nil {
+		return
+	}
+	enc.err = binary.Write(enc.w, binary.LittleEndian, data)
+}
+
+func (enc *encoder) writeInt(value int) {
+	enc.write(int64(value))
+}
+
+// decoder reads little endian values from r, keeping the first error it runs into
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (dec *decoder) read(data interface{}) {
+	if dec.err != nil {
+		return
+	}
+	dec.err = binary.Read(dec.r, binary.LittleEndian, data)
+	if errors.Is(dec.err, io.EOF) || errors.Is(dec.err, io.ErrUnexpectedEOF) {
+		dec.err = ErrInvalidImage
+	}
+}
+
+func (dec *decoder) readInt() int {
+	var value int64
+	dec.read(&value)
+	return int(value)
+}
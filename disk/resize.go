@@ -0,0 +1,150 @@
+package disk
+
+import "fmt"
+
+// ResizeError is returned by Resize when the blocks in use do not fit in the requested size,
+// it wraps ErrInsufficentMemoryError
+type ResizeError struct {
+	// Size is the size asked for and Required the smallest size holding every block in use
+	Size     int
+	Required int
+}
+
+func (err *ResizeError) Error() string {
+	return fmt.Sprintf("cannot resize the disk to %d bytes, the blocks in use take %d", err.Size, err.Required)
+}
+
+func (err *ResizeError) Unwrap() error {
+	return ErrInsufficentMemoryError
+}
+
+// Resize changes the size of the disk to newSize bytes. Growing adds the new blocks to the free ones.
+// Shrinking first moves the blocks in use past the new end into free blocks before it, so blockManifests
+// must list every block in use there, and their extents are updated in place as for Defragment.
+// It fails with a *ResizeError, leaving the disk untouched, when the blocks in use do not fit in newSize
+func (disk *disk) Resize(newSize int, blockManifests []*BlockRecord) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	return disk.resize(newSize, blockManifests, func(size int, free *bitmap) error {
+		buffer := make(memoryStorage, size)
+		copy(buffer, disk.buffer.(memoryStorage))
+		disk.buffer = buffer
+		return nil
+	})
+}
+
+// resize moves the blocks out of the truncated tail, calls resizeStorage to give the storage newSize bytes
+// along with the free blocks it then has, and last brings the records, the references and the allocator
+// in line with the new size. Nothing but free blocks changes until resizeStorage succeeds
+func (disk *disk) resize(newSize int, blockManifests []*BlockRecord, resizeStorage func(size int, free *bitmap) error) error {
+	if disk.blockSize > newSize {
+		return ErrBlockSizeExceedsDriveSize
+	}
+	numberOfBlocks, newNumberOfBlocks := disk.size/disk.blockSize, newSize/disk.blockSize
+	//moved maps the blocks in use past the new end to the blocks they are moved to
+	moved := map[int]int{}
+	if newNumberOfBlocks < numberOfBlocks {
+		var err error
+		if moved, err = disk.evacuate(newSize, blockManifests); err != nil {
+			return err
+		}
+	}
+	taken := map[int]bool{}
+	for _, to := range moved {
+		taken[to] = true
+	}
+	//free blocks are handed back in the order of the allocator so it keeps handing them out the same way
+	released := make([]int, 0, newNumberOfBlocks)
+	for _, blockNum := range disk.allocator.FreeBlocks() {
+		if blockNum < newNumberOfBlocks && !taken[blockNum] {
+			released = append(released, blockNum)
+		}
+	}
+	for blockNum := numberOfBlocks; blockNum < newNumberOfBlocks; blockNum++ {
+		released = append(released, blockNum)
+	}
+	free := newBitmap(newNumberOfBlocks)
+	for _, blockNum := range released {
+		free.setFree(blockNum, true)
+	}
+	if err := resizeStorage(newSize, free); err != nil {
+		return err
+	}
+
+	if len(moved) > 0 {
+		seen := map[*BlockRecord]bool{}
+		for _, blockManifest := range blockManifests {
+			if blockManifest == nil || seen[blockManifest] {
+				continue
+			}
+			seen[blockManifest] = true
+			blockNums := blockManifest.blockNums()
+			for i, blockNum := range blockNums {
+				if to, ok := moved[blockNum]; ok {
+					blockNums[i] = to
+				}
+			}
+			blockManifest.setBlocks(blockNums)
+		}
+		for from, to := range moved {
+			if count, ok := disk.refs[from]; ok {
+				disk.refs[to] = count
+				delete(disk.refs, from)
+			}
+		}
+	}
+	disk.free, disk.allocator = free, disk.newAllocator(newNumberOfBlocks)
+	for _, blockNum := range released {
+		disk.allocator.Release(blockNum)
+	}
+	disk.size = newSize
+	return nil
+}
+
+// evacuate copies the blocks in use past the first newSize bytes into the first free blocks before them
+// and returns where each of them went. Nothing but free blocks is written to, so the disk is unchanged
+// until the records are pointed at the copies
+func (disk *disk) evacuate(newSize int, blockManifests []*BlockRecord) (map[int]int, error) {
+	numberOfBlocks, newNumberOfBlocks := disk.size/disk.blockSize, newSize/disk.blockSize
+	tail := make([]int, 0)
+	for blockNum := newNumberOfBlocks; blockNum < numberOfBlocks; blockNum++ {
+		if !disk.free.isFree(blockNum) {
+			tail = append(tail, blockNum)
+		}
+	}
+	inUse := numberOfBlocks - disk.free.free
+	if inUse > newNumberOfBlocks {
+		return nil, &ResizeError{Size: newSize, Required: inUse * disk.blockSize}
+	}
+	listed := map[int]bool{}
+	for _, blockManifest := range blockManifests {
+		if blockManifest == nil {
+			continue
+		}
+		for _, ext := range blockManifest.extents {
+			for blockNum := ext.start; blockNum < ext.start+ext.length; blockNum++ {
+				if blockNum < 0 || blockNum >= numberOfBlocks || disk.free.isFree(blockNum) {
+					return nil, ErrRecordsMismatch
+				}
+				if blockNum >= newNumberOfBlocks {
+					listed[blockNum] = true
+				}
+			}
+		}
+	}
+	if len(listed) != len(tail) {
+		return nil, ErrRecordsMismatch
+	}
+
+	moved := make(map[int]int, len(tail))
+	data := make([]byte, disk.blockSize)
+	to := -1
+	for _, from := range tail {
+		to = disk.free.nextFree(to + 1)
+		if err := disk.copyBlock(from, to, data); err != nil {
+			return nil, err
+		}
+		moved[from] = to
+	}
+	return moved, nil
+}
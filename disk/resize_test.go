@@ -0,0 +1,210 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResize(t *testing.T) {
+	d, manifests, contents := setupFragmented(t)
+	available := d.GetAvailableMemory()
+	assert.Nil(t, d.Resize(300, manifests))
+	assert.Equal(t, available+100, d.GetAvailableMemory())
+	assertContents(t, d, manifests, contents)
+	manifest, err := d.Write(make([]byte, available+100))
+	assert.Nil(t, err)
+	d.Delete(manifest)
+
+	//shrinking to exactly the blocks in use moves every one of them before the new end, clones included
+	shared := d.Clone(manifests[1])
+	inUse := 30 - d.GetAvailableMemory()/10
+	assert.Nil(t, d.Resize(inUse*10+5, append(manifests, shared)))
+	assert.Equal(t, 0, d.GetAvailableMemory())
+	assertContents(t, d, manifests, contents)
+	assert.True(t, shared.Equal(manifests[1]))
+	assert.Nil(t, d.Verify(append(manifests, shared)))
+	for _, manifest := range manifests {
+		for _, blockNum := range manifest.blockNums() {
+			assert.Less(t, blockNum, inUse)
+		}
+	}
+
+	//the clone still shares its blocks and is copied on write
+	d.Delete(manifests[0])
+	manifests, contents = manifests[1:], contents[1:]
+	_, err = d.WriteAt(shared, []byte("X"), 0)
+	assert.Nil(t, err)
+	assertContents(t, d, manifests, contents)
+	data, _ := d.Read(shared)
+	assert.Equal(t, append([]byte("X"), contents[0][1:]...), data)
+}
+
+func TestResizeTooSmall(t *testing.T) {
+	d, manifests, contents := setupFragmented(t)
+	available := d.GetAvailableMemory()
+	err := d.Resize(50, manifests)
+	var resizeErr *ResizeError
+	assert.True(t, errors.As(err, &resizeErr))
+	assert.Equal(t, ResizeError{Size: 50, Required: 200 - available}, *resizeErr)
+	assert.True(t, errors.Is(err, ErrInsufficentMemoryError))
+	assert.Equal(t, ErrBlockSizeExceedsDriveSize, d.Resize(5, manifests))
+
+	//records that leave out blocks past the new end are rejected before anything moves
+	assert.Equal(t, ErrRecordsMismatch, d.Resize(200-available, nil))
+	assert.Equal(t, available, d.GetAvailableMemory())
+	assertContents(t, d, manifests, contents)
+}
+
+func TestFileDiskResize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	fileDisk, _ := NewFileDisk(path, 100, 10, WithAllocator(NewBuddyAllocator))
+	data := bytes.Repeat([]byte("0123456789"), 3)
+	manifest, err := fileDisk.Write(data)
+	assert.Nil(t, err)
+
+	//growing the free map moves the blocks further into the file
+	assert.Nil(t, fileDisk.Resize(1000, []*BlockRecord{manifest}))
+	read, _ := fileDisk.Read(manifest)
+	assert.Equal(t, data, read)
+	assert.Nil(t, fileDisk.Close())
+	assert.Equal(t, ErrDiskClosed, fileDisk.Resize(100, []*BlockRecord{manifest}))
+	fileDisk, err = OpenFileDisk(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 970, fileDisk.GetAvailableMemory())
+	read, _ = fileDisk.Read(manifest)
+	assert.Equal(t, data, read)
+
+	//shrinking moves the blocks past the new end back in and the free map with them
+	moved, _ := fileDisk.Write(data)
+	assert.GreaterOrEqual(t, moved.blockNums()[0], 90)
+	assert.Nil(t, fileDisk.Resize(90, []*BlockRecord{manifest, moved}))
+	assert.Nil(t, fileDisk.Close())
+	fileDisk, err = OpenFileDisk(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, fileDisk.GetAvailableMemory())
+	for _, manifest := range []*BlockRecord{manifest, moved} {
+		read, _ = fileDisk.Read(manifest)
+		assert.Equal(t, data, read)
+	}
+	assert.Nil(t, fileDisk.Close())
+}
+
+// recordingFile keeps the writes and truncations made to an image file so that a crash after any
+// number of them can be replayed on a copy of the file
+type recordingFile struct {
+	imageFile
+	ops []func(image []byte) []byte
+}
+
+func (file *recordingFile) WriteAt(p []byte, off int64) (int, error) {
+	data := append([]byte{}, p...)
+	file.ops = append(file.ops, func(image []byte) []byte {
+		if end := int(off) + len(data); end > len(image) {
+			image = append(image, make([]byte, end-len(image))...)
+		}
+		copy(image[off:], data)
+		return image
+	})
+	return file.imageFile.WriteAt(p, off)
+}
+
+func (file *recordingFile) Truncate(size int64) error {
+	file.ops = append(file.ops, func(image []byte) []byte {
+		if int(size) < len(image) {
+			return image[:size]
+		}
+		return append(image, make([]byte, int(size)-len(image))...)
+	})
+	return file.imageFile.Truncate(size)
+}
+
+func TestFileDiskResizeCrash(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		newSize  int
+		fileSize int64
+	}{
+		{name: "shrink moving blocks and the free map twice", newSize: 300, fileSize: 32 + 300 + 4},
+		//the free map stays past the old one, which the blocks now overlap
+		{name: "grow by less than the free map", newSize: 1010, fileSize: 32 + 1000 + 13 + 13},
+		{name: "grow past the free map", newSize: 2000, fileSize: 32 + 2000 + 25},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "disk.img")
+		created, _ := NewFileDisk(path, 1000, 10)
+		resizing := created.(*fileDisk)
+		manifests, contents := make([]*BlockRecord, 0), make([][]byte, 0)
+		for i := 0; i < 5; i++ {
+			data := bytes.Repeat([]byte{byte('a' + i)}, 25+i)
+			manifest, err := resizing.Write(data)
+			assert.Nil(t, err)
+			manifests, contents = append(manifests, manifest), append(contents, data)
+		}
+		assert.Nil(t, resizing.Sync())
+		before, _ := os.ReadFile(path)
+		oldRecords := make([][]byte, len(manifests))
+		for i, manifest := range manifests {
+			oldRecords[i], _ = manifest.MarshalBinary()
+		}
+		recorder := &recordingFile{imageFile: resizing.file}
+		resizing.file, resizing.buffer.(*fileStorage).file = recorder, recorder
+		assert.Nil(t, resizing.Resize(test.newSize, manifests), test.name)
+		assert.Nil(t, resizing.Close())
+
+		//whatever write the crash came after, the file opens either as it was or resized
+		resized := 0
+		for crash := 0; crash <= len(recorder.ops); crash++ {
+			image := append([]byte{}, before...)
+			for _, op := range recorder.ops[:crash] {
+				image = op(image)
+			}
+			crashPath := filepath.Join(dir, "crash.img")
+			assert.Nil(t, os.WriteFile(crashPath, image, 0644))
+			reopened, err := OpenFileDisk(crashPath)
+			assert.Nil(t, err, "%s: crash after %d writes", test.name, crash)
+			records := manifests
+			if size := reopened.(*fileDisk).size; size == test.newSize {
+				resized++
+			} else {
+				assert.Equal(t, 1000, size)
+				records = make([]*BlockRecord, len(oldRecords))
+				for i, encoded := range oldRecords {
+					records[i] = NewBlockRecord()
+					assert.Nil(t, records[i].UnmarshalBinary(encoded))
+				}
+			}
+			assert.Nil(t, reopened.Verify(records), "%s: crash after %d writes", test.name, crash)
+			assertContents(t, reopened, records, contents)
+			assert.Nil(t, reopened.Close())
+		}
+		assert.NotZero(t, resized, test.name)
+		info, _ := os.Stat(path)
+		assert.Equal(t, test.fileSize, info.Size(), test.name)
+	}
+}
+
+func TestResizeLegacyFileDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	image := make([]byte, legacySuperblockSize+2+100)
+	copy(image, superblockMagic)
+	binary.LittleEndian.PutUint32(image[4:], 1)
+	binary.LittleEndian.PutUint64(image[8:], 100)
+	binary.LittleEndian.PutUint64(image[16:], 10)
+	image[legacySuperblockSize] = 1
+	copy(image[legacySuperblockSize+2:], "legacy")
+	assert.Nil(t, os.WriteFile(path, image, 0644))
+	legacy, err := OpenFileDisk(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 90, legacy.GetAvailableMemory())
+	manifest := &BlockRecord{extents: []extent{{0, 1}}, size: 6}
+	data, _ := legacy.Read(manifest)
+	assert.Equal(t, []byte("legacy"), data)
+	assert.Equal(t, ErrUnsupportedImageVersion, legacy.Resize(200, []*BlockRecord{manifest}))
+	assert.Nil(t, legacy.Close())
+}
@@ -0,0 +1,114 @@
+package disk
+
+// Blocks can be shared between several records, refs counts the references a block has beyond
+// its first one by block number. A shared block is only returned to the allocator once every record
+// referencing it is deleted, and it is copied before any record writes to it
+
+// Clone returns a record listing the same blocks as blockManifest, no data is copied
+func (disk *disk) Clone(blockManifest *BlockRecord) *BlockRecord {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	clone := &BlockRecord{extents: make([]extent, len(blockManifest.extents)), size: blockManifest.size}
+	copy(clone.extents, blockManifest.extents)
+	for _, blockNum := range clone.blockNums() {
+		disk.refs[blockNum]++
+	}
+	return clone
+}
+
+// RebuildReferences recomputes the reference counts from every record in use, it is meant for
+// records restored from a saved image since the counts are not part of it
+func (disk *disk) RebuildReferences(blockManifests []*BlockRecord) {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	disk.refs = map[int]int{}
+	seen := map[int]bool{}
+	for _, blockManifest := range blockManifests {
+		for _, blockNum := range blockManifest.blockNums() {
+			if seen[blockNum] {
+				disk.refs[blockNum]++
+			}
+			seen[blockNum] = true
+		}
+	}
+}
+
+// unshareRange gives blockManifest its own copy of every shared block holding bytes in [start, end),
+// the copies are allocated at once so that runs of shared blocks stay contiguous
+func (disk *disk) unshareRange(blockManifest *BlockRecord, start int, end int) error {
+	if len(disk.refs) == 0 || start >= end {
+		return nil
+	}
+	blockNums := blockManifest.blockNums()
+	first := start / disk.blockSize
+	last := (end + disk.blockSize - 1) / disk.blockSize
+	if last > len(blockNums) {
+		last = len(blockNums)
+	}
+	shared := 0
+	for i := first; i < last; i++ {
+		if disk.refs[blockNums[i]] > 0 {
+			shared++
+		}
+	}
+	if shared == 0 {
+		return nil
+	}
+	copies := disk.allocateBlocks(shared)
+	if copies == nil {
+		return ErrInsufficentMemoryError
+	}
+	data := make([]byte, disk.blockSize)
+	for i := first; i < last; i++ {
+		if disk.refs[blockNums[i]] == 0 {
+			continue
+		}
+		err := disk.copyBlock(blockNums[i], copies[0], data)
+		if err != nil {
+			disk.releaseBlocks(copies)
+			blockManifest.setBlocks(blockNums)
+			return err
+		}
+		disk.unref(blockNums[i])
+		blockNums[i] = copies[0]
+		copies = copies[1:]
+	}
+	blockManifest.setBlocks(blockNums)
+	return nil
+}
+
+// copyBlock copies the block numbered from into the one numbered to through data, a block sized buffer
+func (disk *disk) copyBlock(from int, to int, data []byte) error {
+	if _, err := disk.buffer.ReadAt(data, int64(from*disk.blockSize)); err != nil {
+		return err
+	}
+	_, err := disk.buffer.WriteAt(data, int64(to*disk.blockSize))
+	return err
+}
+
+func (disk *disk) unref(startIndex int) {
+	disk.refs[startIndex]--
+	if disk.refs[startIndex] == 0 {
+		delete(disk.refs, startIndex)
+	}
+}
+
+// Equal reports whether both records list the same blocks holding the same amount of data,
+// records cloned from one another are equal until either is written to
+func (blockRecord *BlockRecord) Equal(other *BlockRecord) bool {
+	if blockRecord.Size() != other.Size() {
+		return false
+	}
+	if blockRecord == nil || other == nil {
+		return true
+	}
+	if len(blockRecord.extents) != len(other.extents) {
+		return false
+	}
+	for i := range blockRecord.extents {
+		if blockRecord.extents[i] != other.extents[i] {
+			return false
+		}
+	}
+	return true
+}
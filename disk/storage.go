@@ -0,0 +1,57 @@
+package disk
+
+import "io"
+
+// storage holds the bytes of the blocks of a disk, offsets are relative to the first block
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// memoryStorage keeps the blocks in a byte slice
+type memoryStorage []byte
+
+func (buffer memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(buffer)) {
+		return 0, io.EOF
+	}
+	n := copy(p, buffer[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (buffer memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(buffer)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(buffer[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// imageFile is what a FileDisk uses of its image file, an *os.File
+type imageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// fileStorage keeps the blocks in a file, starting offset bytes into it
+type fileStorage struct {
+	file   imageFile
+	offset int64
+}
+
+func (storage *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return storage.file.ReadAt(p, storage.offset+off)
+}
+
+func (storage *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return storage.file.WriteAt(p, storage.offset+off)
+}
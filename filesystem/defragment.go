@@ -0,0 +1,100 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+var ErrJournaledFileDisk = errors.New("a journaled file disk cannot be defragmented or resized, the last checkpoint points at its blocks")
+
+// Defragment rearranges the blocks of the disk so that the data of every file and every list of extended
+// attributes, snapshots included, is contiguous and the free space is a single region. Files are laid out
+// in the order Walk visits them and snapshots follow the live tree. No other operation runs meanwhile.
+// progress, when not nil, is called as blocks are moved. Cancelling ctx stops the blocks from moving,
+// the files are then left consistent and partly defragmented, and ctx.Err() is returned.
+// Defragmenting is not journaled since it does not change what the files hold. The checkpoint of any
+// other disk holds a copy of its blocks, but a disk.FileDisk keeps them in place and a crash would leave
+// the checkpointed tree pointing at moved blocks, so a journaled one fails with ErrJournaledFileDisk.
+// Mount it without a journal to defragment it and save the tree afterwards
+func (f *fileSystem) Defragment(ctx context.Context, progress func(disk.DefragmentProgress)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if f.pinnedByCheckpoint() {
+		return ErrJournaledFileDisk
+	}
+	return f.disk.Defragment(ctx, f.manifests(), progress)
+}
+
+// pinnedByCheckpoint reports whether the blocks must stay where they are until the next checkpoint,
+// which is the case of a journaled disk.FileDisk
+func (f *fileSystem) pinnedByCheckpoint() bool {
+	_, isFileDisk := f.disk.(disk.FileDisk)
+	return isFileDisk && f.journal != nil
+}
+
+// Resize changes the size of the disk to size bytes, moving the blocks past the new end of the files,
+// snapshots included, into free space before it. It fails with a *disk.ResizeError when they do not fit.
+// No other operation runs meanwhile. It is journaled, since a replayed write may need the space it added,
+// but as for Defragment a journaled disk.FileDisk fails with ErrJournaledFileDisk: the disk keeps its new
+// size and free map across a crash while the checkpointed tree expects the old ones
+func (f *fileSystem) Resize(size int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pinnedByCheckpoint() {
+		return ErrJournaledFileDisk
+	}
+	return f.logged(record{op: opResize, offset: size}, func() error {
+		return f.disk.Resize(size, f.manifests())
+	})
+}
+
+// manifests returns the records of the live tree laid out as Walk visits it, followed by those of the
+// snapshots in the order of their names, f.mu must be held
+func (f *fileSystem) manifests() []*disk.BlockRecord {
+	manifests := collectManifests(f.root.(*directory), nil)
+	names := make([]string, 0, len(f.snapshots))
+	for name := range f.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		manifests = collectManifests(f.snapshots[name].root, manifests)
+	}
+	return manifests
+}
+
+// collectManifests appends the records of dir and everything below it to manifests, entries sorted by name
+func collectManifests(dir *directory, manifests []*disk.BlockRecord) []*disk.BlockRecord {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	if dir.xattrs != nil {
+		manifests = append(manifests, dir.xattrs)
+	}
+	names := make([]string, 0, len(dir.contents))
+	for name := range dir.contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch fsItem := dir.contents[name].(type) {
+		case *directory:
+			manifests = collectManifests(fsItem, manifests)
+		case *file:
+			fsItem.mu.RLock()
+			if fsItem.info != nil {
+				manifests = append(manifests, fsItem.info)
+			}
+			if fsItem.xattrs != nil {
+				manifests = append(manifests, fsItem.xattrs)
+			}
+			fsItem.mu.RUnlock()
+		}
+	}
+	return manifests
+}
@@ -0,0 +1,195 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefragment(t *testing.T) {
+	d, _ := disk.NewDisk(1000, 10, disk.WithAllocator(disk.NewFirstFitAllocator))
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/home"))
+	contents := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		path := fmt.Sprintf("/home/%d.txt", i)
+		contents[path] = bytes.Repeat([]byte{byte('a' + i)}, 15+10*i)
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, contents[path]))
+	}
+	for _, i := range []int{1, 4, 6} {
+		path := fmt.Sprintf("/home/%d.txt", i)
+		assert.Nil(t, fileSys.DeleteFile(path))
+		delete(contents, path)
+	}
+	fl, _ := fileSys.OpenFile("/home/0.txt")
+	assert.Nil(t, fileSys.AppendFile(fl, []byte("appended")))
+	contents["/home/0.txt"] = append(contents["/home/0.txt"], "appended"...)
+	assert.Nil(t, fileSys.SetXattr("/home", "user.team", []byte("storage")))
+	assert.Nil(t, fileSys.Snapshot("before"))
+	handle, _ := fileSys.OpenHandle("/home/2.txt")
+	_, err := handle.WriteAt([]byte("CHANGED"), 0)
+	assert.Nil(t, err)
+	snapshotted := contents["/home/2.txt"]
+	contents["/home/2.txt"] = append([]byte("CHANGED"), snapshotted[7:]...)
+	assert.Greater(t, handle.file.getManifest().ExtentCount(), 1)
+	available := fileSys.GetAvailableMemory()
+
+	updates := 0
+	assert.Nil(t, fileSys.Defragment(context.Background(), func(progress disk.DefragmentProgress) {
+		updates++
+	}))
+	assert.NotZero(t, updates)
+	assert.Equal(t, available, fileSys.GetAvailableMemory())
+
+	//every file is a single extent and reads back the same, snapshots included
+	for path, data := range contents {
+		fl, _ := fileSys.OpenFile(path)
+		read, err := fileSys.ReadFile(fl)
+		assert.Nil(t, err)
+		assert.Equal(t, data, read, path)
+		assert.Equal(t, 1, fl.getManifest().ExtentCount(), path)
+	}
+	value, _ := fileSys.GetXattr("/home", "user.team")
+	assert.Equal(t, []byte("storage"), value)
+	before, _ := fileSys.MountSnapshot("before")
+	fl, _ = before.OpenFile("/home/2.txt")
+	read, _ := before.ReadFile(fl)
+	assert.Equal(t, snapshotted, read)
+	assert.Equal(t, ErrReadOnly, before.Defragment(context.Background(), nil))
+
+	//the free space is a single region, a file as large as all of it is a single extent
+	assert.Nil(t, fileSys.CreateFile("/home/large.txt"))
+	fl, _ = fileSys.OpenFile("/home/large.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, make([]byte, available)))
+	assert.Equal(t, 1, fl.getManifest().ExtentCount())
+
+	//the defragmented tree survives a save and a load
+	var image bytes.Buffer
+	assert.Nil(t, fileSys.Save(&image))
+	loaded, err := Load(&image)
+	assert.Nil(t, err)
+	fl, _ = loaded.OpenFile("/home/5.txt")
+	read, _ = loaded.ReadFile(fl)
+	assert.Equal(t, contents["/home/5.txt"], read)
+}
+
+func TestDefragmentJournaled(t *testing.T) {
+	//the checkpoint of a disk in memory holds its blocks, replaying on it ignores where they were moved
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := setupJournaled(t, d)
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+	assert.Nil(t, fileSys.DeleteFile("/home/notes.txt"))
+	assert.Nil(t, fileSys.Defragment(context.Background(), nil))
+	assert.Nil(t, fileSys.CreateFile("/home/after.txt"))
+	fl, _ := fileSys.OpenFile("/home/after.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, []byte("written after defragmenting")))
+	recovered, err := Load(bytes.NewReader(image.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes())))
+	assert.Equal(t, dumpState(t, fileSys), dumpState(t, recovered))
+
+	//a file disk is refused, so a crash after syncing it still recovers from the checkpoint
+	dir := t.TempDir()
+	diskPath := filepath.Join(dir, "disk.img")
+	fileDisk, _ := disk.NewFileDisk(diskPath, 200, 10)
+	fileSys = setupJournaled(t, fileDisk)
+	var tree bytes.Buffer
+	journal.Reset()
+	assert.Nil(t, fileSys.Checkpoint(&tree, &journal))
+	assert.Equal(t, ErrJournaledFileDisk, fileSys.Defragment(context.Background(), nil))
+	assert.Equal(t, ErrJournaledFileDisk, fileSys.Resize(100))
+	assert.Nil(t, fileDisk.Sync())
+	assert.Nil(t, fileSys.CreateFile("/home/after.txt"))
+	fl, _ = fileSys.OpenFile("/home/after.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, []byte("written after syncing")))
+	crashed, _ := os.ReadFile(diskPath)
+	crashPath := filepath.Join(dir, "crash.img")
+	assert.Nil(t, os.WriteFile(crashPath, crashed, 0644))
+	reopened, err := disk.OpenFileDisk(crashPath)
+	assert.Nil(t, err)
+	recovered, err = Mount(reopened, bytes.NewReader(tree.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes())))
+	assert.Equal(t, dumpState(t, fileSys), dumpState(t, recovered))
+	assert.Nil(t, reopened.Close())
+
+	//without a journal the file disk can be defragmented
+	tree.Reset()
+	assert.Nil(t, fileSys.SaveTree(&tree))
+	unjournaled, err := Mount(fileDisk, bytes.NewReader(tree.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, unjournaled.Defragment(context.Background(), nil))
+	assert.Nil(t, unjournaled.Resize(400))
+	assert.Equal(t, dumpState(t, fileSys), dumpState(t, unjournaled))
+	assert.Nil(t, fileDisk.Close())
+}
+
+func TestDefragmentCancel(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	for i := 0; i < 4; i++ {
+		path := fmt.Sprintf("/%d.txt", i)
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, bytes.Repeat([]byte{byte('a' + i)}, 25)))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, fileSys.Defragment(ctx, nil))
+	for i := 0; i < 4; i++ {
+		fl, _ := fileSys.OpenFile(fmt.Sprintf("/%d.txt", i))
+		read, _ := fileSys.ReadFile(fl)
+		assert.Equal(t, bytes.Repeat([]byte{byte('a' + i)}, 25), read)
+	}
+	assert.Equal(t, ErrPermissionDenied, as(fileSys, alice).Defragment(context.Background(), nil))
+}
+
+func TestResize(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	contents := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		path := fmt.Sprintf("/%d.txt", i)
+		contents[path] = bytes.Repeat([]byte{byte('a' + i)}, 25)
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, contents[path]))
+	}
+	assert.Nil(t, fileSys.Snapshot("before"))
+	fl, _ := fileSys.OpenFile("/0.txt")
+	assert.Nil(t, fileSys.AppendFile(fl, []byte("appended")))
+	used := 200 - fileSys.GetAvailableMemory()
+
+	var resizeErr *disk.ResizeError
+	assert.True(t, errors.As(fileSys.Resize(used-10), &resizeErr))
+	assert.Equal(t, used, resizeErr.Required)
+	assert.Nil(t, fileSys.Resize(used))
+	assert.Equal(t, 0, fileSys.GetAvailableMemory())
+	for path, data := range contents {
+		fl, _ := fileSys.OpenFile(path)
+		read, _ := fileSys.ReadFile(fl)
+		if path == "/0.txt" {
+			data = append(data, "appended"...)
+		}
+		assert.Equal(t, data, read, path)
+	}
+	before, _ := fileSys.MountSnapshot("before")
+	fl, _ = before.OpenFile("/0.txt")
+	read, _ := before.ReadFile(fl)
+	assert.Equal(t, contents["/0.txt"], read)
+	assert.Equal(t, ErrReadOnly, before.Resize(1000))
+	assert.Equal(t, ErrPermissionDenied, as(fileSys, alice).Resize(1000))
+
+	assert.Nil(t, fileSys.Resize(1000))
+	assert.Equal(t, 1000-used, fileSys.GetAvailableMemory())
+}
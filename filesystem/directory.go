@@ -1,8 +1,38 @@
 package filesystem
 
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// directory guards its contents with mu, lookups descend the tree holding a read lock on one
+// directory at a time while mutations only write lock the directory they change.
+// names holds the names of contents sorted, entries are added and removed with addEntry and removeEntry
+// to keep it so. lastAccessed is guarded by accessMu alone, so reading a directory only takes a read lock.
+// xattrs is the record holding the extended attributes, nil without any. ino never changes
 type directory struct {
-	dirName  string
-	contents map[string]item
+	mu           sync.RWMutex
+	ino          uint64
+	dirName      string
+	contents     map[string]item
+	names        []string
+	createdAt    time.Time
+	lastModified time.Time
+	accessMu     sync.Mutex
+	lastAccessed time.Time
+	lastChanged  time.Time
+	perm         permissions
+	xattrs       *disk.BlockRecord
+}
+
+func newDirectory(name string) *directory {
+	now := time.Now()
+	return &directory{dirName: name, contents: map[string]item{}, createdAt: now, lastModified: now, lastAccessed: now, lastChanged: now,
+		perm: permissions{mode: defaultDirMode}}
 }
 
 func (dir *directory) isFile() bool {
@@ -12,77 +42,300 @@ func (dir *directory) name() string {
 	return dir.dirName
 }
 
-func (dir *directory) createFile(levels []string) error {
+func (dir *directory) getIno() uint64 {
+	return dir.ino
+}
+
+func (dir *directory) getPermissions() permissions {
+	return dir.perm
+}
+
+func (dir *directory) setPermissions(perm permissions) {
+	dir.perm = perm
+	dir.lastChanged = time.Now()
+}
+
+func (dir *directory) getLock() *sync.RWMutex {
+	return &dir.mu
+}
+
+func (dir *directory) getXattrs() *disk.BlockRecord {
+	return dir.xattrs
+}
+
+// setXattrs replaces the extended attributes, which is a change of the directory
+func (dir *directory) setXattrs(xattrs *disk.BlockRecord) {
+	dir.xattrs = xattrs
+	dir.lastChanged = time.Now()
+}
+
+// addEntry adds fsItem to the contents under name or replaces the item already there, callers hold mu
+func (dir *directory) addEntry(name string, fsItem item) {
+	if _, exist := dir.contents[name]; !exist {
+		i := sort.SearchStrings(dir.names, name)
+		dir.names = append(dir.names, "")
+		copy(dir.names[i+1:], dir.names[i:])
+		dir.names[i] = name
+	}
+	dir.contents[name] = fsItem
+}
+
+// removeEntry removes the item under name from the contents, callers hold mu
+func (dir *directory) removeEntry(name string) {
+	if _, exist := dir.contents[name]; !exist {
+		return
+	}
+	delete(dir.contents, name)
+	if i := sort.SearchStrings(dir.names, name); i < len(dir.names) && dir.names[i] == name {
+		dir.names = append(dir.names[:i], dir.names[i+1:]...)
+	}
+}
+
+// touch sets the access timestamp, callers need not hold mu
+func (dir *directory) touch(accessedAt time.Time) {
+	dir.accessMu.Lock()
+	dir.lastAccessed = accessedAt
+	dir.accessMu.Unlock()
+}
+
+func (dir *directory) accessedAt() time.Time {
+	dir.accessMu.Lock()
+	defer dir.accessMu.Unlock()
+	return dir.lastAccessed
+}
+
+// updateModifiedTs records a change of the entries, callers hold mu
+func (dir *directory) updateModifiedTs(time time.Time) {
+	dir.lastModified = time
+	dir.lastChanged = time
+}
+
+// createFile creates the file at the end of levels, owned by the owners of perm, numbered by inodes and
+// added to quotas
+func (dir *directory) createFile(levels []string, perm permissions, inodes *inodeTable, quotas *quotaTable) error {
 	baseDir, err := dir.findParentDir(levels)
 	if err != nil {
 		return err
 	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
 
 	fileName := levels[len(levels)-1]
-	if fsItem, exist := baseDir.(*directory).contents[fileName]; exist && fsItem.isFile() {
+	if fsItem, exist := concDir.contents[fileName]; exist && fsItem.isFile() {
 		return ErrFileAlreadyExist
+	} else if exist {
+		return ErrDirrAlreadyExist
 	} else {
-		newFile := NewFile(fileName).(item)
-		baseDir.(*directory).contents[fileName] = newFile
+		newFile := NewFile(fileName)
+		ino, err := inodes.allocate(newFile.(item))
+		if err != nil {
+			return err
+		}
+		newFile.setPath("/" + strings.Join(levels, "/"))
+		newFile.(*file).perm.uid, newFile.(*file).perm.gid = perm.uid, perm.gid
+		newFile.(*file).ino = ino
+		concDir.addEntry(fileName, newFile.(item))
+		quotas.created(concDir, newFile.(item))
+		concDir.updateModifiedTs(time.Now())
 		return nil
 	}
 
 }
+
+// createSymlink creates a symlink to target at the end of levels, owned by the owners of perm, numbered by
+// inodes and added to quotas
+func (dir *directory) createSymlink(levels []string, target string, perm permissions, inodes *inodeTable, quotas *quotaTable) error {
+	baseDir, err := dir.findParentDir(levels)
+	if err != nil {
+		return err
+	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
+
+	linkName := levels[len(levels)-1]
+	if fsItem, exist := concDir.contents[linkName]; exist && fsItem.isFile() {
+		return ErrFileAlreadyExist
+	} else if exist {
+		return ErrDirrAlreadyExist
+	}
+	link := newSymlink(linkName, target)
+	ino, err := inodes.allocate(link)
+	if err != nil {
+		return err
+	}
+	link.ino = ino
+	link.perm.uid, link.perm.gid = perm.uid, perm.gid
+	concDir.addEntry(linkName, link)
+	quotas.created(concDir, link)
+	concDir.updateModifiedTs(time.Now())
+	return nil
+}
+
+// link adds an entry for fl at the end of levels and charges it to quotas
+func (dir *directory) link(levels []string, fl *file, quotas *quotaTable) error {
+	baseDir, err := dir.findParentDir(levels)
+	if err != nil {
+		return err
+	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
+
+	fileName := levels[len(levels)-1]
+	if fsItem, exist := concDir.contents[fileName]; exist && fsItem.isFile() {
+		return ErrFileAlreadyExist
+	} else if exist {
+		return ErrDirrAlreadyExist
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.unlinked {
+		return ErrFileDoesNotExist
+	}
+	fl.addLink()
+	concDir.addEntry(fileName, fl)
+	quotas.linked(concDir, fl, fl.info.Size())
+	concDir.updateModifiedTs(time.Now())
+	return nil
+}
+
 func (dir *directory) openFile(levels []string) (File, error) {
 	baseDir, err := dir.findParentDir(levels)
 	if err != nil {
 		return nil, err
 	}
+	concDir := baseDir.(*directory)
+	concDir.mu.RLock()
+	defer concDir.mu.RUnlock()
 
 	fileName := levels[len(levels)-1]
-	if fsItem, exist := baseDir.(*directory).contents[fileName]; exist && fsItem.isFile() {
-		return fsItem.(File), nil
+	if fl, ok := concDir.contents[fileName].(File); ok {
+		return fl, nil
 	} else {
 		return nil, ErrFileDoesNotExist
 	}
 
 }
-func (dir *directory) deleteFile(levels []string) (File, error) {
+
+// deleteFile removes the file or symlink at the end of levels from the tree and from quotas and returns it
+func (dir *directory) deleteFile(levels []string, quotas *quotaTable) (item, error) {
 	baseDir, err := dir.findParentDir(levels)
 	if err != nil {
 		return nil, err
 	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
 
 	fileName := levels[len(levels)-1]
-	if fsItem, exist := baseDir.(*directory).contents[fileName]; exist && fsItem.isFile() {
-		delete(baseDir.(*directory).contents, fileName)
-		return fsItem.(File), nil
+	if fsItem, exist := concDir.contents[fileName]; exist && fsItem.isFile() {
+		concDir.removeEntry(fileName)
+		concDir.updateModifiedTs(time.Now())
+		quotas.unlinked(concDir, fsItem, itemSize(fsItem))
+		return fsItem, nil
 	} else {
 		return nil, ErrFileDoesNotExist
 	}
 }
 
-func (dir *directory) createDir(levels []string) error {
+// removeDir removes the empty directory at the end of levels from the tree and from quotas and returns it
+func (dir *directory) removeDir(levels []string, quotas *quotaTable) (*directory, error) {
+	baseDir, err := dir.findParentDir(levels)
+	if err != nil {
+		return nil, err
+	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
+
+	folderName := levels[len(levels)-1]
+	fsItem, exist := concDir.contents[folderName]
+	if !exist {
+		return nil, ErrPathDoesNotExists
+	} else if fsItem.isFile() {
+		return nil, ErrNotDirectory
+	} else if len(fsItem.(*directory).contents) > 0 {
+		return nil, ErrDirNotEmpty
+	}
+	concDir.removeEntry(folderName)
+	concDir.updateModifiedTs(time.Now())
+	quotas.unlinked(concDir, fsItem, 0)
+	return fsItem.(*directory), nil
+}
+
+// remove detaches the file or directory at the end of levels from the tree and from quotas and returns it
+func (dir *directory) remove(levels []string, quotas *quotaTable) (item, error) {
+	baseDir, err := dir.findParentDir(levels)
+	if err != nil {
+		return nil, err
+	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
+
+	itemName := levels[len(levels)-1]
+	fsItem, exist := concDir.contents[itemName]
+	if !exist {
+		return nil, ErrPathDoesNotExists
+	}
+	concDir.removeEntry(itemName)
+	concDir.updateModifiedTs(time.Now())
+	quotas.moved(concDir, nil, subtree(fsItem))
+	return fsItem, nil
+}
+
+// createDir creates the directory at the end of levels, owned by the owners of perm, numbered by inodes and
+// added to quotas
+func (dir *directory) createDir(levels []string, perm permissions, inodes *inodeTable, quotas *quotaTable) error {
 	baseDir, err := dir.findParentDir(levels)
 	if err != nil {
 		return err
 	}
+	concDir := baseDir.(*directory)
+	concDir.mu.Lock()
+	defer concDir.mu.Unlock()
 
 	folderName := levels[len(levels)-1]
-	if fsItem, exist := baseDir.(*directory).contents[folderName]; exist && !fsItem.isFile() {
+	if fsItem, exist := concDir.contents[folderName]; exist && !fsItem.isFile() {
 		return ErrDirrAlreadyExist
+	} else if exist {
+		return ErrFileAlreadyExist
 	} else {
-		newDir := &directory{folderName, map[string]item{}}
-		baseDir.(*directory).contents[folderName] = newDir
+		newDir := newDirectory(folderName)
+		ino, err := inodes.allocate(newDir)
+		if err != nil {
+			return err
+		}
+		newDir.ino = ino
+		newDir.perm.uid, newDir.perm.gid = perm.uid, perm.gid
+		concDir.addEntry(folderName, newDir)
+		quotas.created(concDir, newDir)
+		concDir.updateModifiedTs(time.Now())
 		return nil
 	}
 
 }
-func (dir *directory) listDir(levels []string) ([]string, error) {
+
+// listDir lists the entries of the directory holding the last level sorted, its access timestamp is set
+// to accessedAt unless accessedAt is zero
+func (dir *directory) listDir(levels []string, accessedAt time.Time) ([]string, error) {
 	baseDir, err := dir.findParentDir(levels)
 	if err != nil {
 		return nil, err
 	}
 	concDir := baseDir.(*directory)
-	items := make([]string, 0)
+	if !accessedAt.IsZero() {
+		concDir.touch(accessedAt)
+	}
+	concDir.mu.RLock()
+	defer concDir.mu.RUnlock()
+	items := make([]string, 0, len(concDir.contents))
 	for names := range concDir.contents {
 		items = append(items, names)
 	}
+	sort.Strings(items)
 	return items, nil
 }
 
@@ -91,9 +344,68 @@ func (dir *directory) findParentDir(levels []string) (item, error) {
 	if len(levels) == 1 {
 		return dir, nil
 	}
-	if item, exist := dir.contents[folderName]; !exist || item.isFile() {
+	dir.mu.RLock()
+	childItem, exist := dir.contents[folderName]
+	dir.mu.RUnlock()
+	if !exist || childItem.isFile() {
 		return nil, ErrPathDoesNotExists
 	}
-	childDir := dir.contents[folderName].(*directory)
+	childDir := childItem.(*directory)
 	return childDir.findParentDir(levels[1:])
 }
+
+// lookup returns the item found at the end of levels, an empty levels slice refers to dir itself
+func (dir *directory) lookup(levels []string) (item, error) {
+	if len(levels) == 0 {
+		return dir, nil
+	}
+	baseDir, err := dir.findParentDir(levels)
+	if err != nil {
+		return nil, err
+	}
+	concDir := baseDir.(*directory)
+	concDir.mu.RLock()
+	fsItem, exist := concDir.contents[levels[len(levels)-1]]
+	concDir.mu.RUnlock()
+	if !exist {
+		return nil, ErrPathDoesNotExists
+	}
+	return fsItem, nil
+}
+
+// setPaths updates the path of every file below dir once dir has been moved to dirPath
+func (dir *directory) setPaths(dirPath string) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	for name, fsItem := range dir.contents {
+		switch fsItem := fsItem.(type) {
+		case *file:
+			fsItem.mu.Lock()
+			fsItem.path = dirPath + "/" + name
+			fsItem.mu.Unlock()
+		case *directory:
+			fsItem.setPaths(dirPath + "/" + name)
+		}
+	}
+}
+
+// search checks caller may search every directory leading to the last level, dir included.
+// It stops quietly at a missing level, leaving the operation to report it
+func (dir *directory) search(levels []string, caller Caller) error {
+	if caller.isSuperuser() {
+		return nil
+	}
+	if err := caller.check(dir.perm, permExecute); err != nil {
+		return err
+	}
+	if len(levels) <= 1 {
+		return nil
+	}
+	dir.mu.RLock()
+	childItem, exist := dir.contents[levels[0]]
+	dir.mu.RUnlock()
+	if !exist || childItem.isFile() {
+		return nil
+	}
+	return childItem.(*directory).search(levels[1:], caller)
+}
@@ -1,30 +1,60 @@
 package filesystem
 
 import (
+	"sync"
 	"time"
 
 	"github.com/Saf1u/smpfs/disk"
 )
 
+// file guards its manifest and timestamps with mu, callers take it through getLock.
+// A file linked under several names is a single file referenced by several directory entries,
+// nlink counts them and path is any one of them. xattrs is the record holding the extended attributes,
+// nil without any. ino never changes
 type file struct {
+	mu           sync.RWMutex
+	ino          uint64
 	fileName     string
+	path         string
+	nlink        int
+	unlinked     bool
 	info         *disk.BlockRecord
 	createdAt    time.Time
 	lastModified time.Time
+	lastAccessed time.Time
+	lastChanged  time.Time
+	perm         permissions
+	xattrs       *disk.BlockRecord
 }
 
 type File interface {
 	setCreationTs(time.Time)
 	updateAccessTs(time.Time)
+	updateModifiedTs(time.Time)
 	getSize() int
 	getManifest() *disk.BlockRecord
 	setManifest(*disk.BlockRecord)
 	isFile() bool
-	name() string 
+	name() string
+	getLock() *sync.RWMutex
+	getPath() string
+	setPath(string)
+	isUnlinked() bool
+	setUnlinked()
+	linkCount() int
+	addLink()
+	dropLink() int
+	getPermissions() permissions
+	setPermissions(permissions)
+	getXattrs() *disk.BlockRecord
+	setXattrs(*disk.BlockRecord)
+	getIno() uint64
 }
 
 func NewFile(name string) File {
-	return &file{fileName: name, info: disk.NewBlockRecord(), createdAt: time.Now(), lastModified: time.Now()}
+	now := time.Now()
+	return &file{fileName: name, nlink: 1, info: disk.NewBlockRecord(), createdAt: now, lastModified: now, lastAccessed: now, lastChanged: now,
+		perm: permissions{mode: defaultFileMode}}
 }
 
 func (fl *file) isFile() bool {
@@ -33,8 +63,18 @@ func (fl *file) isFile() bool {
 func (fl *file) name() string {
 	return fl.fileName
 }
+
+func (fl *file) getIno() uint64 {
+	return fl.ino
+}
 func (fl *file) updateAccessTs(time time.Time) {
+	fl.lastAccessed = time
+}
+
+// updateModifiedTs records a change of the contents, which is a change of the file as well
+func (fl *file) updateModifiedTs(time time.Time) {
 	fl.lastModified = time
+	fl.lastChanged = time
 }
 
 func (fl *file) setCreationTs(time time.Time) {
@@ -49,6 +89,63 @@ func (fl *file) setManifest(manifest *disk.BlockRecord) {
 	fl.info = manifest
 }
 
+func (fl *file) getPermissions() permissions {
+	return fl.perm
+}
+
+func (fl *file) setPermissions(perm permissions) {
+	fl.perm = perm
+	fl.lastChanged = time.Now()
+}
+
+func (fl *file) getXattrs() *disk.BlockRecord {
+	return fl.xattrs
+}
+
+// setXattrs replaces the extended attributes, which is a change of the file
+func (fl *file) setXattrs(xattrs *disk.BlockRecord) {
+	fl.xattrs = xattrs
+	fl.lastChanged = time.Now()
+}
+
+func (fl *file) getLock() *sync.RWMutex {
+	return &fl.mu
+}
+
+// getPath returns the path the file was created at, it is what the journal refers to the file by
+func (fl *file) getPath() string {
+	return fl.path
+}
+
+func (fl *file) setPath(path string) {
+	fl.path = path
+}
+
+// isUnlinked reports whether the file was deleted, handles still referring to it can no longer write
+func (fl *file) isUnlinked() bool {
+	return fl.unlinked
+}
+
+func (fl *file) setUnlinked() {
+	fl.unlinked = true
+}
+
+func (fl *file) linkCount() int {
+	return fl.nlink
+}
+
+func (fl *file) addLink() {
+	fl.nlink++
+	fl.lastChanged = time.Now()
+}
+
+// dropLink removes a link and returns how many are left
+func (fl *file) dropLink() int {
+	fl.nlink--
+	fl.lastChanged = time.Now()
+	return fl.nlink
+}
+
 func (fl *file) getSize() int {
-	return 0
+	return fl.info.Size()
 }
@@ -1,28 +1,89 @@
 package filesystem
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Saf1u/smpfs/disk"
 )
 
+// fileSystem shares mu between all operations, operations that need a consistent view of the
+// whole tree (Save, Snapshot), move or remove parts of it (Rename, RemoveDir, RemoveAll) or change
+// permissions (Chmod, Chown) hold it exclusively. A fileSystem runs every operation as the Superuser,
+// WithContext returns a view running them as another caller
 type fileSystem struct {
-	root item
-	disk disk.Disk
+	mu      sync.RWMutex
+	root    item
+	disk    disk.Disk
+	journal *journal
+	//snapshots are frozen copies of the tree, readOnly is set on the views returned by MountSnapshot
+	snapshots map[string]*snapshot
+	readOnly  bool
+	//maxSymlinkDepth is zero until set, which stands for DefaultMaxSymlinkDepth
+	maxSymlinkDepth int
+	//quotas are keyed by the directory they limit and by the uid of the user they limit, see quota.go
+	dirQuotas  map[*directory]Quota
+	userQuotas map[int]Quota
+	quotas     quotaTable
+	//inodes numbers the items of the live tree, see inode.go
+	inodes inodeTable
+	//watchers receive the changes made to the tree, see watch.go
+	watchMu  sync.Mutex
+	watchers map[*Watcher]struct{}
 }
 
 type FileSystem interface {
 	CreateDir(path string) error
 	WriteFile(fileHandle File, data []byte) error
+	AppendFile(fileHandle File, data []byte) error
 	ReadFile(fileHandle File) ([]byte, error)
 	CreateFile(path string) error
 	OpenFile(path string) (File, error)
+	OpenHandle(path string) (*Handle, error)
+	OpenByID(ino uint64) (*Handle, error)
 	ListDir(path string) ([]string, error)
+	ReadDir(path string, opts ReadDirOptions) ([]DirEntry, string, error)
+	Walk(root string, fn WalkFunc) error
+	Glob(pattern string) ([]string, error)
+	Stat(path string) (*FileInfo, error)
+	Lstat(path string) (*FileInfo, error)
 	GetAvailableMemory() int
-	DeleteFile(path string) error 
+	DeleteFile(path string, opts ...PathOption) error
+	Link(existing string, newPath string) error
+	Symlink(target string, linkPath string) error
+	Readlink(path string) (string, error)
+	SetXattr(path string, name string, value []byte) error
+	GetXattr(path string, name string) ([]byte, error)
+	ListXattr(path string) ([]string, error)
+	RemoveXattr(path string, name string) error
+	SetMaxSymlinkDepth(depth int) error
+	SetMaxInodes(max int) error
+	Watch(path string, recursive bool) (*Watcher, error)
+	SetDirQuota(path string, limit Quota) error
+	SetUserQuota(uid int, limit Quota) error
+	Quotas() []QuotaUsage
+	Rename(oldPath string, newPath string) error
+	RemoveDir(path string) error
+	RemoveAll(path string) (int, error)
+	Save(w io.Writer) error
+	SaveTree(w io.Writer) error
+	Checkpoint(image io.Writer, journal io.Writer) error
+	Defragment(ctx context.Context, progress func(disk.DefragmentProgress)) error
+	Resize(size int) error
+	Snapshot(name string) error
+	ListSnapshots() []string
+	MountSnapshot(name string) (FileSystem, error)
+	DiffSnapshots(from string, to string) ([]Change, error)
+	DeleteSnapshot(name string) error
+	Chmod(path string, mode fs.FileMode) error
+	Chown(path string, uid int, gid int) error
+	WithContext(ctx context.Context) FileSystem
 }
 
 var (
@@ -33,44 +94,95 @@ var (
 	ErrFileDoesNotExist       = errors.New("the file does not exists")
 	ErrFileCouldNotBeWritten  = errors.New("not enough emmoey to write to files")
 	ErrUnkonwnError           = errors.New("???")
+	ErrHandleClosed           = errors.New("the file handle is closed")
+	ErrInvalidOffset          = errors.New("the offset is negative")
+	ErrInvalidWhence          = errors.New("the seek whence is invalid")
+	ErrIsDirectory            = errors.New("the path is a directory")
+	ErrNotDirectory           = errors.New("the path is not a directory")
+	ErrDirNotEmpty            = errors.New("the directory is not empty")
+	ErrMoveIntoItself         = errors.New("a directory cannot be moved into itself")
 )
 
 type item interface {
 	isFile() bool
 	name() string
+	getPermissions() permissions
+	setPermissions(permissions)
+	getIno() uint64
 }
 
 func NewFileSystem(disk disk.Disk) FileSystem {
-	root := &directory{
-		dirName:  "root",
-		contents: map[string]item{},
-	}
-	return &fileSystem{root: root, disk: disk}
+	root := newDirectory("root")
+	root.ino = rootIno
+	fileSys := &fileSystem{root: root, disk: disk, snapshots: map[string]*snapshot{}}
+	fileSys.inodes.index(root, rootIno+1, 0)
+	return fileSys
 }
 
 // CreateDir creates a directory in the nested tree structure.
 // Will create the parent directories if they do not already exist.
 func (f *fileSystem) CreateDir(path string) error {
-	structure, err := parseDirStruture(path)
+	return f.createDirAs(Superuser, path)
+}
+
+func (f *fileSystem) createDirAs(caller Caller, path string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	structure, err := f.resolvePath(caller, path, false)
 	if err != nil {
 		return err
 	}
+	if len(structure) == 0 {
+		return ErrDirrAlreadyExist
+	}
+	var parent item = f.root
+	missing := 0
+	for i := 1; i <= len(structure); i++ {
+		if fsItem, err := f.root.(*directory).lookup(structure[:i]); err == nil {
+			parent = fsItem
+			continue
+		}
+		missing++
+		if err := f.checkParent(caller, structure[:i]); err != nil {
+			return err
+		}
+	}
+	var charge *quotaCharge
+	if missing > 0 {
+		if charge, err = f.reserveQuota(parent, caller.UID, 0, missing); err != nil {
+			return err
+		}
+	}
+	created := 0
+	defer func() { charge.settle(0, created) }()
+	return f.logged(record{op: opCreateDir, path: path, caller: caller}, func() error {
+		return f.createDir(structure, caller.owner(), &created)
+	})
+}
+
+// createDir creates the directories of structure, adding how many of them it created to created
+func (f *fileSystem) createDir(structure []string, owner permissions, created *int) error {
 	if len(structure) > 1 {
 		for i := 1; i < len(structure); i++ {
-			baseDir, err := f.root.(*directory).findParentDir(structure[:i])
-			if err != nil {
-				return err
-			}
-			if _, exist := baseDir.(*directory).contents[structure[i-1]]; !exist {
-				err = f.root.(*directory).createDir(structure[:i])
-				if err != nil {
-					return fmt.Errorf("issue creating parent directory: /%s - %w", strings.Join(structure[:i], "/"), err)
+			//creating and checking happen under the same lock, so a parent created concurrently is not an error
+			err := f.root.(*directory).createDir(structure[:i], owner, &f.inodes, &f.quotas)
+			if err == nil {
+				*created++
+				f.notify(Event{Path: "/" + strings.Join(structure[:i], "/"), Kind: EventCreate})
+			} else if !errors.Is(err, ErrDirrAlreadyExist) {
+				if errors.Is(err, ErrPathDoesNotExists) {
+					return err
 				}
+				return fmt.Errorf("issue creating parent directory: /%s - %w", strings.Join(structure[:i], "/"), err)
 			}
 		}
 	}
-	return f.root.(*directory).createDir(structure)
-
+	if err := f.root.(*directory).createDir(structure, owner, &f.inodes, &f.quotas); err != nil {
+		return err
+	}
+	*created++
+	f.notify(Event{Path: "/" + strings.Join(structure, "/"), Kind: EventCreate})
+	return nil
 }
 
 // GetAvaialbleMemory returns the available space in bytes
@@ -78,89 +190,515 @@ func (f *fileSystem) GetAvailableMemory() int {
 	return f.disk.GetAvailableMemory()
 }
 
-// WriteFile truncates the file and writes the data to the file
+// WriteFile truncates the file and writes the data to the file.
+// The data is written to new blocks before the old ones are released, so a failed write leaves the previous contents intact
 func (f *fileSystem) WriteFile(fileHandle File, data []byte) error {
+	return f.writeFileAs(Superuser, fileHandle, data)
+}
 
-	//Truncate File
-	if fileHandle.getManifest() != nil {
-		f.disk.Delete(fileHandle.getManifest())
-	}
-	fileManifest, err := f.disk.Write(data)
+func (f *fileSystem) writeFileAs(caller Caller, fileHandle File, data []byte) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	charge, err := f.reserveQuota(fileHandle, fileHandle.getPermissions().uid, fileGrowth(fileHandle, 0, len(data)), 0)
 	if err != nil {
-		if errors.Is(err, disk.ErrInsufficentMemoryError) {
-			return ErrFileCouldNotBeWritten
-		} else {
-			return ErrUnkonwnError
+		return err
+	}
+	fileHandle.getLock().Lock()
+	defer fileHandle.getLock().Unlock()
+	size := fileHandle.getSize()
+	defer func() { charge.settle(fileHandle.getSize()-size, 0) }()
+	if fileHandle.isUnlinked() {
+		return ErrFileDoesNotExist
+	}
+	if err := caller.check(fileHandle.getPermissions(), permWrite); err != nil {
+		return err
+	}
+
+	return f.logged(record{op: opWriteFile, path: fileHandle.getPath(), data: data, caller: caller}, func() error {
+		fileManifest, err := f.disk.Write(data)
+		if err != nil {
+			if errors.Is(err, disk.ErrInsufficentMemoryError) {
+				return ErrFileCouldNotBeWritten
+			} else {
+				return ErrUnkonwnError
+			}
+		}
+		//Truncate File
+		if fileHandle.getManifest() != nil {
+			f.disk.Delete(fileHandle.getManifest())
 		}
+		fileHandle.setManifest(fileManifest)
+		fileHandle.updateModifiedTs(time.Now())
+		f.notify(Event{Path: fileHandle.getPath(), Kind: EventWrite})
+		return nil
+	})
+}
+
+// AppendFile adds the data to the end of the file without rewriting its existing blocks
+func (f *fileSystem) AppendFile(fileHandle File, data []byte) error {
+	return f.appendFileAs(Superuser, fileHandle, data)
+}
+
+func (f *fileSystem) appendFileAs(caller Caller, fileHandle File, data []byte) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	charge, err := f.reserveQuota(fileHandle, fileHandle.getPermissions().uid, len(data), 0)
+	if err != nil {
+		return err
 	}
-	fileHandle.setManifest(fileManifest)
-	fileHandle.updateAccessTs(time.Now())
-	return nil
+	fileHandle.getLock().Lock()
+	defer fileHandle.getLock().Unlock()
+	size := fileHandle.getSize()
+	defer func() { charge.settle(fileHandle.getSize()-size, 0) }()
+	if fileHandle.isUnlinked() {
+		return ErrFileDoesNotExist
+	}
+	if err := caller.check(fileHandle.getPermissions(), permWrite); err != nil {
+		return err
+	}
+	if fileHandle.getManifest() == nil {
+		fileHandle.setManifest(disk.NewBlockRecord())
+	}
+	return f.logged(record{op: opAppendFile, path: fileHandle.getPath(), data: data, caller: caller}, func() error {
+		err := f.disk.Append(fileHandle.getManifest(), data)
+		if err != nil {
+			if errors.Is(err, disk.ErrInsufficentMemoryError) {
+				return ErrFileCouldNotBeWritten
+			} else {
+				return ErrUnkonwnError
+			}
+		}
+		fileHandle.updateModifiedTs(time.Now())
+		f.notify(Event{Path: fileHandle.getPath(), Kind: EventWrite})
+		return nil
+	})
 }
 
 // ReadFile reads the data stored in the file
 func (f *fileSystem) ReadFile(fileHandle File) ([]byte, error) {
+	return f.readFileAs(Superuser, fileHandle)
+}
+
+func (f *fileSystem) readFileAs(caller Caller, fileHandle File) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	//the access timestamp is updated as well, so reads of one file are serialized
+	fileHandle.getLock().Lock()
+	defer fileHandle.getLock().Unlock()
+	if err := caller.check(fileHandle.getPermissions(), permRead); err != nil {
+		return nil, err
+	}
 
 	data, err := f.disk.Read(fileHandle.getManifest())
 	if err != nil {
 		return nil, err
 	}
-	fileHandle.updateAccessTs(time.Now())
+	//a snapshot is frozen, its timestamps included
+	if !f.readOnly {
+		fileHandle.updateAccessTs(time.Now())
+	}
 	return data, nil
 }
 
 // CreateFile creates a file in the nested tree structure,it does not create all parent paths of the final path
 func (f *fileSystem) CreateFile(path string) error {
-	structure, err := parseDirStruture(path)
+	return f.createFileAs(Superuser, path)
+}
+
+func (f *fileSystem) createFileAs(caller Caller, path string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	structure, err := f.resolvePath(caller, path, false)
 	if err != nil {
 		return err
 	}
-	return f.root.(*directory).createFile(structure)
+	if len(structure) == 0 {
+		return ErrDirrAlreadyExist
+	}
+	if err := f.checkParent(caller, structure); err != nil {
+		return err
+	}
+	var charge *quotaCharge
+	if parent, err := f.root.(*directory).findParentDir(structure); err == nil {
+		if charge, err = f.reserveQuota(parent, caller.UID, 0, 1); err != nil {
+			return err
+		}
+	}
+	created := 0
+	defer func() { charge.settle(0, created) }()
+	return f.logged(record{op: opCreateFile, path: path, caller: caller}, func() error {
+		if err := f.root.(*directory).createFile(structure, caller.owner(), &f.inodes, &f.quotas); err != nil {
+			return err
+		}
+		created = 1
+		f.notify(Event{Path: "/" + strings.Join(structure, "/"), Kind: EventCreate})
+		return nil
+	})
 
 }
 
 // OpenFile Searches for a file in the directory structure, and returns a file pointer to enable reads and writes
+// The caller must be allowed to either read or write it, each read and write is checked again
 func (f *fileSystem) OpenFile(path string) (File, error) {
-	structure, err := parseDirStruture(path)
+	return f.openFileAs(Superuser, path)
+}
+
+func (f *fileSystem) openFileAs(caller Caller, path string) (File, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	structure, err := f.resolvePath(caller, path, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(structure) == 0 {
+		return nil, ErrFileDoesNotExist
+	}
+	fileHandle, err := f.root.(*directory).openFile(structure)
 	if err != nil {
 		return nil, err
 	}
-	return f.root.(*directory).openFile(structure)
+	if !caller.allowed(fileHandle.getPermissions(), permRead) && !caller.allowed(fileHandle.getPermissions(), permWrite) {
+		return nil, ErrPermissionDenied
+	}
+	return fileHandle, nil
+}
+
+// OpenHandle opens a file for streaming reads and writes, the returned handle starts at offset 0
+func (f *fileSystem) OpenHandle(path string) (*Handle, error) {
+	return f.openHandleAs(Superuser, path)
+}
 
+func (f *fileSystem) openHandleAs(caller Caller, path string) (*Handle, error) {
+	fileHandle, err := f.openFileAs(caller, path)
+	if err != nil {
+		return nil, err
+	}
+	return newHandle(f, fileHandle, caller), nil
 }
 
-// ListDir lists filesystem dir contents
+// ListDir lists filesystem dir contents sorted by name, see ReadDir for their types and for paging through them
 func (f *fileSystem) ListDir(path string) ([]string, error) {
-	//add junk last path to levrage exisiting functionality that finds parent dir
+	return f.listDirAs(Superuser, path)
+}
+
+func (f *fileSystem) listDirAs(caller Caller, path string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	var structure []string
-	var err error
 	if path != "/" {
-		path = fmt.Sprint(path, "/doesnotexist")
-
-		structure, err = parseDirStruture(path)
-
+		var err error
+		structure, err = f.resolvePath(caller, path, true)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		structure = make([]string, 1)
-		structure[0] = "junk"
 	}
+	dir, err := f.root.(*directory).lookup(structure)
+	if err == nil {
+		if dir.isFile() {
+			return nil, ErrPathDoesNotExists
+		}
+		if err := caller.check(dir.getPermissions(), permRead); err != nil {
+			return nil, err
+		}
+	} else if errors.Is(err, ErrPermissionDenied) {
+		return nil, err
+	}
+	//add junk last path to levrage exisiting functionality that finds parent dir
+	structure = append(structure, "junk")
 
-	return f.root.(*directory).listDir(structure)
+	//a snapshot is frozen, its timestamps included
+	accessedAt := time.Now()
+	if f.readOnly {
+		accessedAt = time.Time{}
+	}
+	return f.root.(*directory).listDir(structure, accessedAt)
 
 }
 
 // DeleteFile Searches for a file in the directory structure, and deletes it,returning memory back to the disk
-func (f *fileSystem) DeleteFile(path string) error {
-	structure, err := parseDirStruture(path)
+// A symlink at the end of path is followed and its target deleted, unless NoFollow is given to delete the symlink itself
+func (f *fileSystem) DeleteFile(path string, opts ...PathOption) error {
+	return f.deleteFileAs(Superuser, path, follows(opts))
+}
+
+func (f *fileSystem) deleteFileAs(caller Caller, path string, follow bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	structure, err := f.resolvePath(caller, path, follow)
 	if err != nil {
 		return err
 	}
-	fl, err := f.root.(*directory).deleteFile(structure)
+	if len(structure) == 0 {
+		return ErrFileDoesNotExist
+	}
+	if err := f.checkParent(caller, structure); err != nil {
+		return err
+	}
+	noFollow := 0
+	if !follow {
+		noFollow = 1
+	}
+	return f.logged(record{op: opDeleteFile, path: path, offset: noFollow, caller: caller}, func() error {
+		fsItem, err := f.root.(*directory).deleteFile(structure, &f.quotas)
+		if err != nil {
+			return err
+		}
+		if fl, ok := fsItem.(File); ok {
+			f.unlink(fl)
+		} else {
+			f.quotas.removed(fsItem, 0)
+			f.inodes.release(fsItem)
+		}
+		f.notify(Event{Path: "/" + strings.Join(structure, "/"), Kind: EventDelete})
+		return nil
+	})
+}
+
+// RemoveDir removes the directory at path, it fails with ErrDirNotEmpty unless the directory is empty
+func (f *fileSystem) RemoveDir(path string) error {
+	return f.removeDirAs(Superuser, path)
+}
+
+func (f *fileSystem) removeDirAs(caller Caller, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	structure, err := f.resolvePath(caller, path, false)
 	if err != nil {
 		return err
 	}
-	f.disk.Delete(fl.getManifest())
+	if len(structure) == 0 {
+		return ErrDirNotEmpty
+	}
+	if err := f.checkParent(caller, structure); err != nil {
+		return err
+	}
+	return f.logged(record{op: opRemoveDir, path: path, caller: caller}, func() error {
+		removed, err := f.root.(*directory).removeDir(structure, &f.quotas)
+		if err != nil {
+			return err
+		}
+		f.dropXattrs(removed)
+		f.dropQuota(removed)
+		f.quotas.removed(removed, 0)
+		f.inodes.release(removed)
+		f.notify(Event{Path: "/" + strings.Join(structure, "/"), Kind: EventDelete})
+		return nil
+	})
+}
+
+// RemoveAll removes path and everything below it, returning the blocks of every removed file to the disk.
+// It reports how many bytes of the disk were freed, blocks still shared with a snapshot stay in use.
+// Like os.RemoveAll a path that does not exist is not an error
+// The caller must be allowed to empty every directory it removes
+func (f *fileSystem) RemoveAll(path string) (int, error) {
+	return f.removeAllAs(Superuser, path)
+}
+
+func (f *fileSystem) removeAllAs(caller Caller, path string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	structure, err := f.resolvePath(caller, path, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(structure) == 0 {
+		return 0, ErrDirNotEmpty
+	}
+	if err := f.checkParent(caller, structure); err != nil {
+		return 0, err
+	}
+	if fsItem, err := f.root.(*directory).lookup(structure); err == nil && !fsItem.isFile() {
+		if err := checkRemovable(caller, fsItem.(*directory)); err != nil {
+			return 0, err
+		}
+	}
+	freed := 0
+	err = f.logged(record{op: opRemoveAll, path: path, caller: caller}, func() error {
+		fsItem, err := f.root.(*directory).remove(structure, &f.quotas)
+		if err != nil {
+			return nil
+		}
+		available := f.disk.GetAvailableMemory()
+		f.unlinkAll(fsItem)
+		freed = f.disk.GetAvailableMemory() - available
+		if f.watching() {
+			f.notifyTree(EventDelete, "/"+strings.Join(structure, "/"), fsItem)
+		}
+		return nil
+	})
+	return freed, err
+}
+
+// unlinkAll unlinks every file below fsItem, fsItem included, and releases the inodes of the others
+func (f *fileSystem) unlinkAll(fsItem item) {
+	switch fsItem := fsItem.(type) {
+	case *file:
+		f.unlink(fsItem)
+	case *symlink:
+		f.quotas.removed(fsItem, 0)
+		f.inodes.release(fsItem)
+	case *directory:
+		f.dropXattrs(fsItem)
+		f.dropQuota(fsItem)
+		f.quotas.removed(fsItem, 0)
+		f.inodes.release(fsItem)
+		for _, child := range fsItem.contents {
+			f.unlinkAll(child)
+		}
+	}
+}
+
+// unlink drops a link of a file whose directory entry was removed, once the last link is gone the file
+// is marked deleted, its blocks return to the disk and its inode is released
+func (f *fileSystem) unlink(fl File) {
+	fl.getLock().Lock()
+	if fl.dropLink() > 0 {
+		fl.getLock().Unlock()
+		//the removed entry may be the path the journal refers to the file by
+		path := f.findPath(fl.(*file))
+		fl.getLock().Lock()
+		fl.setPath(path)
+		fl.getLock().Unlock()
+		return
+	}
+	defer fl.getLock().Unlock()
+	fl.setUnlinked()
+	f.quotas.removed(fl, fl.getSize())
+	if fl.getManifest() != nil {
+		f.disk.Delete(fl.getManifest())
+		fl.setManifest(nil)
+	}
+	f.dropXattrs(fl)
+	f.inodes.release(fl)
+}
+
+// Rename moves the file or directory at oldPath to newPath, a directory is moved with its whole subtree
+// and no data block is touched. As with rename(2) a file already at newPath is replaced, a directory
+// already at newPath is only replaced by a directory and only when it is empty.
+// Nothing else runs while renaming, moves across directories would otherwise race with lookups
+func (f *fileSystem) Rename(oldPath string, newPath string) error {
+	return f.renameAs(Superuser, oldPath, newPath)
+}
+
+func (f *fileSystem) renameAs(caller Caller, oldPath string, newPath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldLevels, err := f.resolvePath(caller, oldPath, false)
+	if err != nil {
+		return err
+	}
+	newLevels, err := f.resolvePath(caller, newPath, false)
+	if err != nil {
+		return err
+	}
+	if len(oldLevels) == 0 || len(newLevels) == 0 {
+		return ErrMoveIntoItself
+	}
+	if err := f.checkParent(caller, oldLevels); err != nil {
+		return err
+	}
+	if err := f.checkParent(caller, newLevels); err != nil {
+		return err
+	}
+	return f.logged(record{op: opRename, path: oldPath, data: []byte(newPath), caller: caller}, func() error {
+		if err := f.rename(oldLevels, newLevels); err != nil {
+			return err
+		}
+		f.notify(Event{Path: "/" + strings.Join(newLevels, "/"), OldPath: "/" + strings.Join(oldLevels, "/"), Kind: EventRename})
+		return nil
+	})
+}
+
+func (f *fileSystem) rename(oldLevels []string, newLevels []string) error {
+	root := f.root.(*directory)
+	source, err := root.lookup(oldLevels)
+	if err != nil {
+		return err
+	}
+	newParent, err := root.findParentDir(newLevels)
+	if err != nil {
+		return err
+	}
+	if !source.isFile() && isDescendant(oldLevels, newLevels) {
+		return ErrMoveIntoItself
+	}
+	oldParent, _ := root.findParentDir(oldLevels)
+	oldDir, newDir := oldParent.(*directory), newParent.(*directory)
+	newName := newLevels[len(newLevels)-1]
+	target, replacing := newDir.contents[newName]
+	if replacing {
+		switch {
+		case target == source:
+			return nil
+		case source.isFile() && !target.isFile():
+			return ErrIsDirectory
+		case !source.isFile() && target.isFile():
+			return ErrNotDirectory
+		case !target.isFile() && len(target.(*directory).contents) > 0:
+			return ErrDirNotEmpty
+		}
+	}
+	moved := subtree(source)
+	if oldDir != newDir {
+		var replaced *tally
+		if replacing {
+			replaced = subtree(target)
+		}
+		if err := f.checkMove(oldDir, newDir, moved, replaced); err != nil {
+			return err
+		}
+	}
+	if replacing {
+		f.quotas.unlinked(newDir, target, itemSize(target))
+		switch {
+		case isSymlink(target):
+			//a replaced symlink holds no blocks
+			f.quotas.removed(target, 0)
+			f.inodes.release(target)
+		case target.isFile():
+			f.unlink(target.(File))
+		default:
+			f.dropXattrs(target.(*directory))
+			f.dropQuota(target.(*directory))
+			f.quotas.removed(target, 0)
+			f.inodes.release(target)
+		}
+	}
+	if oldDir != newDir {
+		f.quotas.moved(oldDir, newDir, moved)
+	}
+	now := time.Now()
+	oldDir.removeEntry(oldLevels[len(oldLevels)-1])
+	oldDir.updateModifiedTs(now)
+	newDir.addEntry(newName, source)
+	newDir.updateModifiedTs(now)
+	newPath := "/" + strings.Join(newLevels, "/")
+	switch moved := source.(type) {
+	case *file:
+		moved.mu.Lock()
+		moved.fileName = newName
+		moved.path = newPath
+		moved.lastChanged = now
+		moved.mu.Unlock()
+	case *symlink:
+		moved.linkName = newName
+	case *directory:
+		moved.dirName = newName
+		moved.lastChanged = now
+		moved.setPaths(newPath)
+	}
 	return nil
 }
+
+// isDescendant reports whether levels lies strictly below ancestor
+func isDescendant(ancestor []string, levels []string) bool {
+	if len(levels) <= len(ancestor) {
+		return false
+	}
+	for i := range ancestor {
+		if ancestor[i] != levels[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,12 @@
 package filesystem
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/Saf1u/smpfs/disk"
@@ -769,3 +775,438 @@ func TestDeleteFile(t *testing.T) {
 
 	}
 }
+
+func TestRename(t *testing.T) {
+	setupFs := func(t *testing.T) FileSystem {
+		d, _ := disk.NewDisk(200, 10)
+		fileSys := NewFileSystem(d)
+		assert.Nil(t, fileSys.CreateDir("/home/docs/drafts"))
+		assert.Nil(t, fileSys.CreateDir("/tmp/empty"))
+		assert.Nil(t, fileSys.CreateDir("/tmp/full"))
+		for path, data := range map[string]string{
+			"/home/a.txt":             "file a",
+			"/home/b.txt":             "file b, replaced",
+			"/home/docs/drafts/d.txt": "draft",
+			"/tmp/full/keep.txt":      "keep",
+		} {
+			assert.Nil(t, fileSys.CreateFile(path))
+			fl, _ := fileSys.OpenFile(path)
+			assert.Nil(t, fileSys.WriteFile(fl, []byte(data)))
+		}
+		return fileSys
+	}
+	tests := []struct {
+		name          string
+		oldPath       string
+		newPath       string
+		expectedError error
+		expectedFiles map[string]string
+		freedMemory   int
+	}{
+		{name: "renaming a file in place",
+			oldPath:       "/home/a.txt",
+			newPath:       "/home/c.txt",
+			expectedFiles: map[string]string{"/home/c.txt": "file a"},
+		},
+		{name: "moving a file across directories",
+			oldPath:       "/home/a.txt",
+			newPath:       "/tmp/empty/a.txt",
+			expectedFiles: map[string]string{"/tmp/empty/a.txt": "file a"},
+		},
+		{name: "replacing an existing file frees its blocks",
+			oldPath:       "/home/a.txt",
+			newPath:       "/home/b.txt",
+			expectedFiles: map[string]string{"/home/b.txt": "file a"},
+			freedMemory:   20,
+		},
+		{name: "moving a directory with its subtree",
+			oldPath:       "/home/docs",
+			newPath:       "/tmp/docs",
+			expectedFiles: map[string]string{"/tmp/docs/drafts/d.txt": "draft"},
+		},
+		{name: "replacing an empty directory",
+			oldPath:       "/home/docs",
+			newPath:       "/tmp/empty",
+			expectedFiles: map[string]string{"/tmp/empty/drafts/d.txt": "draft"},
+		},
+		{name: "renaming onto itself",
+			oldPath:       "/home/a.txt",
+			newPath:       "/home/a.txt",
+			expectedFiles: map[string]string{"/home/a.txt": "file a"},
+		},
+		{name: "refusing to replace a non empty directory",
+			oldPath:       "/home/docs",
+			newPath:       "/tmp/full",
+			expectedError: ErrDirNotEmpty,
+		},
+		{name: "refusing to move a directory into itself",
+			oldPath:       "/home",
+			newPath:       "/home/docs/home",
+			expectedError: ErrMoveIntoItself,
+		},
+		{name: "refusing to replace a directory with a file",
+			oldPath:       "/home/a.txt",
+			newPath:       "/tmp/empty",
+			expectedError: ErrIsDirectory,
+		},
+		{name: "refusing to replace a file with a directory",
+			oldPath:       "/tmp/empty",
+			newPath:       "/home/a.txt",
+			expectedError: ErrNotDirectory,
+		},
+		{name: "renaming a missing path",
+			oldPath:       "/home/missing.txt",
+			newPath:       "/home/c.txt",
+			expectedError: ErrPathDoesNotExists,
+		},
+		{name: "moving into a missing directory",
+			oldPath:       "/home/a.txt",
+			newPath:       "/missing/a.txt",
+			expectedError: ErrPathDoesNotExists,
+		},
+		{name: "renaming a malformed path",
+			oldPath:       "/home/a.txt",
+			newPath:       "home",
+			expectedError: ErrMalformedPathStructure,
+		},
+	}
+	for _, testcase := range tests {
+		fileSys := setupFs(t)
+		free := fileSys.GetAvailableMemory()
+		before := dumpState(t, fileSys)
+		err := fileSys.Rename(testcase.oldPath, testcase.newPath)
+		assert.Equal(t, testcase.expectedError, err, testcase.name)
+		if err != nil {
+			assert.Equal(t, before, dumpState(t, fileSys), testcase.name)
+			continue
+		}
+		assert.Equal(t, free+testcase.freedMemory, fileSys.GetAvailableMemory(), testcase.name)
+		if testcase.oldPath != testcase.newPath {
+			_, err = fileSys.(*fileSystem).root.(*directory).lookup(strings.Split(testcase.oldPath, "/")[1:])
+			assert.Equal(t, ErrPathDoesNotExists, err, testcase.name)
+		}
+		for path, data := range testcase.expectedFiles {
+			fl, err := fileSys.OpenFile(path)
+			assert.Nil(t, err, testcase.name)
+			contents, _ := fileSys.ReadFile(fl)
+			assert.Equal(t, data, string(contents), testcase.name)
+			assert.Equal(t, path, fl.getPath(), testcase.name)
+		}
+	}
+}
+
+func TestRenameJournal(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := setupJournaled(t, d)
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+	assert.Nil(t, fileSys.Rename("/home", "/archive"))
+	//the journal refers to a moved file by its new path
+	fl, _ := fileSys.OpenFile("/archive/notes.txt")
+	assert.Nil(t, fileSys.AppendFile(fl, []byte(", moved")))
+
+	recovered, err := Load(bytes.NewReader(image.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes())))
+	assert.Equal(t, dumpState(t, fileSys), dumpState(t, recovered))
+}
+
+func TestRemoveDir(t *testing.T) {
+	d, _ := disk.NewDisk(100, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/home/empty"))
+	assert.Nil(t, fileSys.CreateFile("/home/a.txt"))
+	assert.Equal(t, ErrDirNotEmpty, fileSys.RemoveDir("/home"))
+	assert.Equal(t, ErrNotDirectory, fileSys.RemoveDir("/home/a.txt"))
+	assert.Equal(t, ErrPathDoesNotExists, fileSys.RemoveDir("/home/missing"))
+	assert.Equal(t, ErrPathDoesNotExists, fileSys.RemoveDir("/missing/empty"))
+	assert.Equal(t, ErrMalformedPathStructure, fileSys.RemoveDir("/"))
+	assert.Nil(t, fileSys.RemoveDir("/home/empty"))
+	contents, _ := fileSys.ListDir("/home")
+	assert.Equal(t, []string{"a.txt"}, contents)
+}
+
+func TestRemoveAll(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/home/docs/drafts"))
+	for path, size := range map[string]int{"/home/a.txt": 25, "/home/docs/b.txt": 10, "/home/docs/drafts/c.txt": 5} {
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, make([]byte, size)))
+	}
+	handle, _ := fileSys.OpenHandle("/home/docs/b.txt")
+
+	freed, err := fileSys.RemoveAll("/home/docs")
+	assert.Nil(t, err)
+	assert.Equal(t, 20, freed)
+	_, err = handle.Write([]byte("x"))
+	assert.Equal(t, ErrFileDoesNotExist, err)
+	contents, _ := fileSys.ListDir("/home")
+	assert.Equal(t, []string{"a.txt"}, contents)
+
+	freed, err = fileSys.RemoveAll("/home/missing")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, freed)
+
+	//blocks shared with a snapshot are not freed
+	assert.Nil(t, fileSys.Snapshot("before"))
+	freed, err = fileSys.RemoveAll("/home")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, freed)
+	assert.Nil(t, fileSys.DeleteSnapshot("before"))
+	assert.Equal(t, 200, fileSys.GetAvailableMemory())
+}
+
+func TestStat(t *testing.T) {
+	d, _ := disk.NewDisk(100, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/home/docs"))
+	assert.Nil(t, fileSys.CreateFile("/home/a.txt"))
+	created, err := fileSys.Stat("/home/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, &FileInfo{Name: "a.txt", Path: "/home/a.txt", Ino: 4, Links: 1, Mode: 0644, CreatedAt: created.CreatedAt, ModifiedAt: created.CreatedAt,
+		AccessedAt: created.CreatedAt, ChangedAt: created.CreatedAt}, created)
+
+	fl, _ := fileSys.OpenFile("/home/a.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, make([]byte, 25)))
+	written, _ := fileSys.Stat("/home/a.txt")
+	assert.Equal(t, 25, written.Size)
+	assert.Equal(t, 3, written.Blocks)
+	assert.True(t, written.ModifiedAt.After(created.ModifiedAt))
+	assert.Equal(t, written.ModifiedAt, written.ChangedAt)
+	assert.Equal(t, created.AccessedAt, written.AccessedAt)
+
+	_, _ = fileSys.ReadFile(fl)
+	read, _ := fileSys.Stat("/home/a.txt")
+	assert.True(t, read.AccessedAt.After(written.AccessedAt))
+	assert.Equal(t, written.ModifiedAt, read.ModifiedAt)
+
+	assert.Nil(t, fileSys.Rename("/home/a.txt", "/home/b.txt"))
+	renamed, _ := fileSys.Stat("/home/b.txt")
+	assert.Equal(t, "b.txt", renamed.Name)
+	assert.True(t, renamed.ChangedAt.After(read.ChangedAt))
+	assert.Equal(t, read.ModifiedAt, renamed.ModifiedAt)
+
+	home, err := fileSys.Stat("/home")
+	assert.Nil(t, err)
+	assert.True(t, home.IsDir)
+	assert.Equal(t, 2, home.Entries)
+	assert.Equal(t, 0, home.Size)
+	assert.False(t, home.ModifiedAt.Before(renamed.ChangedAt))
+	root, err := fileSys.Stat("/")
+	assert.Nil(t, err)
+	assert.Equal(t, "/", root.Name)
+	assert.Equal(t, 1, root.Entries)
+
+	_, err = fileSys.Stat("/home/missing.txt")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+	_, err = fileSys.Stat("home")
+	assert.Equal(t, ErrMalformedPathStructure, err)
+}
+
+func TestHandle(t *testing.T) {
+	disk, _ := disk.NewDisk(100, 10)
+	fs := NewFileSystem(disk)
+	if err := fs.CreateFile("/log.txt"); err != nil {
+		t.Fatal(err)
+	}
+	handle, err := fs.OpenHandle("/log.txt")
+	assert.Nil(t, err)
+
+	n, err := handle.Write([]byte("first line\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, n)
+	_, err = handle.Write([]byte("second line\n"))
+	assert.Nil(t, err)
+
+	_, err = handle.WriteAt([]byte("FIRST"), 0)
+	assert.Nil(t, err)
+
+	offset, err := handle.Seek(-5, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(18), offset)
+	tail, err := io.ReadAll(handle)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("line\n"), tail)
+
+	_, err = handle.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(handle)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("FIRST line\nsecond line\n"), data)
+
+	_, err = handle.Seek(-1, io.SeekStart)
+	assert.Equal(t, ErrInvalidOffset, err)
+
+	_, err = handle.WriteAt(make([]byte, 101), 0)
+	assert.Equal(t, ErrFileCouldNotBeWritten, err)
+
+	assert.Nil(t, handle.Close())
+	_, err = handle.Read(make([]byte, 1))
+	assert.Equal(t, ErrHandleClosed, err)
+
+	fl, _ := fs.OpenFile("/log.txt")
+	data, err = fs.ReadFile(fl)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("FIRST line\nsecond line\n"), data)
+}
+
+func TestAppendFile(t *testing.T) {
+	disk, _ := disk.NewDisk(100, 10)
+	fs := NewFileSystem(disk)
+	if err := fs.CreateFile("/log.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fl, _ := fs.OpenFile("/log.txt")
+	for _, line := range []string{"first line\n", "second\n", "third line\n"} {
+		assert.Nil(t, fs.AppendFile(fl, []byte(line)))
+	}
+	data, err := fs.ReadFile(fl)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first line\nsecond\nthird line\n"), data)
+	assert.Equal(t, 70, fs.GetAvailableMemory())
+
+	assert.Equal(t, ErrFileCouldNotBeWritten, fs.AppendFile(fl, make([]byte, 72)))
+	data, _ = fs.ReadFile(fl)
+	assert.Equal(t, []byte("first line\nsecond\nthird line\n"), data)
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	disk, _ := disk.NewDisk(10000, 10)
+	fs := NewFileSystem(disk)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			//every worker races to create the same parent directories
+			dir := fmt.Sprintf("/home/shared/worker%d", worker)
+			if err := fs.CreateDir(dir); err != nil {
+				t.Error(err)
+				return
+			}
+			data := []byte(fmt.Sprintf("data written by worker %d", worker))
+			for i := 0; i < 50; i++ {
+				path := fmt.Sprintf("%s/file%d.txt", dir, i%5)
+				err := fs.CreateFile(path)
+				if err != nil && err != ErrFileAlreadyExist {
+					t.Error(err)
+					return
+				}
+				fl, err := fs.OpenFile(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				assert.Nil(t, fs.WriteFile(fl, data))
+				assert.Nil(t, fs.AppendFile(fl, data))
+				read, err := fs.ReadFile(fl)
+				assert.Nil(t, err)
+				assert.Equal(t, append(append([]byte{}, data...), data...), read)
+				_, err = fs.ListDir("/home/shared")
+				assert.Nil(t, err)
+				assert.Nil(t, fs.DeleteFile(path))
+			}
+		}(worker)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		iofs := NewIOFS(fs)
+		for i := 0; i < 50; i++ {
+			_, _ = iofs.ReadDir("home/shared")
+		}
+	}()
+	wg.Wait()
+
+	items, err := fs.ListDir("/home/shared")
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(items))
+	assert.Equal(t, 10000, fs.GetAvailableMemory())
+}
+
+func TestSaveLoad(t *testing.T) {
+	disk, _ := disk.NewDisk(200, 10)
+	original := NewFileSystem(disk)
+	assert.Nil(t, original.CreateDir("/home/usr/path"))
+	assert.Nil(t, original.CreateDir("/tmp"))
+	files := map[string]string{
+		"/home/usr/path/file1.txt": "random data that will pressist hopefully",
+		"/home/usr/path/file2.txt": "",
+		"/home/readme.md":          "readme",
+	}
+	for path, data := range files {
+		assert.Nil(t, original.CreateFile(path))
+		fl, _ := original.OpenFile(path)
+		assert.Nil(t, original.WriteFile(fl, []byte(data)))
+	}
+
+	var image bytes.Buffer
+	assert.Nil(t, original.Save(&image))
+	saved := append([]byte{}, image.Bytes()...)
+
+	loaded, err := Load(&image)
+	assert.Nil(t, err)
+	for path, data := range files {
+		fl, err := loaded.OpenFile(path)
+		assert.Nil(t, err)
+		read, err := loaded.ReadFile(fl)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(data), read)
+	}
+	items, err := loaded.ListDir("/")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"home", "tmp"}, items)
+	assert.Equal(t, original.GetAvailableMemory(), loaded.GetAvailableMemory())
+
+	var resaved bytes.Buffer
+	reloaded, _ := Load(bytes.NewReader(saved))
+	assert.Nil(t, reloaded.Save(&resaved))
+	assert.Equal(t, saved, resaved.Bytes())
+
+	tests := []struct {
+		name        string
+		image       []byte
+		expectedErr error
+	}{
+		{name: "bad magic", image: []byte("definitely not an image"), expectedErr: ErrInvalidImage},
+		{name: "unknown version", image: append([]byte(imageMagic), 99, 0, 0, 0), expectedErr: ErrUnsupportedImageVersion},
+		{name: "truncated tree", image: saved[:len(saved)-3], expectedErr: ErrInvalidImage},
+	}
+	for _, testcase := range tests {
+		_, err := Load(bytes.NewReader(testcase.image))
+		assert.Equal(t, testcase.expectedErr, err, testcase.name)
+	}
+}
+
+func TestMountFileDisk(t *testing.T) {
+	dir := t.TempDir()
+	fileDisk, err := disk.NewFileDisk(filepath.Join(dir, "disk.img"), 100, 10)
+	assert.Nil(t, err)
+	original := NewFileSystem(fileDisk)
+	assert.Nil(t, original.CreateDir("/home/usr"))
+	assert.Nil(t, original.CreateFile("/home/usr/notes.txt"))
+	fl, _ := original.OpenFile("/home/usr/notes.txt")
+	assert.Nil(t, original.WriteFile(fl, []byte("notes kept across restarts")))
+
+	var tree bytes.Buffer
+	assert.Nil(t, original.SaveTree(&tree))
+	assert.Nil(t, fileDisk.Close())
+
+	reopened, err := disk.OpenFileDisk(filepath.Join(dir, "disk.img"))
+	assert.Nil(t, err)
+	defer reopened.Close()
+	mounted, err := Mount(reopened, &tree)
+	assert.Nil(t, err)
+	fl, err = mounted.OpenFile("/home/usr/notes.txt")
+	assert.Nil(t, err)
+	data, err := mounted.ReadFile(fl)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("notes kept across restarts"), data)
+	assert.Equal(t, original.GetAvailableMemory(), 70)
+	assert.Equal(t, 70, mounted.GetAvailableMemory())
+
+	_, err = Mount(reopened, bytes.NewReader([]byte(imageMagic)))
+	assert.Equal(t, ErrInvalidImage, err)
+}
@@ -0,0 +1,151 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// Handle is an open file with a cursor, reads and writes go directly against the blocks
+// of the file without materializing its whole contents.
+// A Handle is not meant to be shared between goroutines, open one handle per goroutine instead
+// Reads and writes are checked against the permissions of the caller the handle was opened by
+type Handle struct {
+	fs     *fileSystem
+	file   File
+	caller Caller
+	offset int64
+	closed bool
+}
+
+var (
+	_ io.ReadWriteSeeker = (*Handle)(nil)
+	_ io.ReaderAt        = (*Handle)(nil)
+	_ io.WriterAt        = (*Handle)(nil)
+	_ io.Closer          = (*Handle)(nil)
+)
+
+func newHandle(f *fileSystem, fileHandle File, caller Caller) *Handle {
+	return &Handle{fs: f, file: fileHandle, caller: caller}
+}
+
+// Read reads up to len(p) bytes from the current offset and advances it
+func (h *Handle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at offset off, it does not move the cursor
+func (h *Handle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, ErrHandleClosed
+	}
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	h.fs.mu.RLock()
+	defer h.fs.mu.RUnlock()
+	h.file.getLock().Lock()
+	defer h.file.getLock().Unlock()
+	if err := h.caller.check(h.file.getPermissions(), permRead); err != nil {
+		return 0, err
+	}
+	if h.file.getManifest() == nil {
+		return 0, io.EOF
+	}
+	n, err := h.fs.disk.ReadAt(h.file.getManifest(), p, int(off))
+	if !h.fs.readOnly {
+		h.file.updateAccessTs(time.Now())
+	}
+	return n, err
+}
+
+// Write writes p at the current offset and advances it, growing the file when needed
+func (h *Handle) Write(p []byte) (int, error) {
+	n, err := h.WriteAt(p, h.offset)
+	h.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes p starting at offset off, it does not move the cursor.
+// Writing past the end of the file grows it and zero fills any gap
+func (h *Handle) WriteAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, ErrHandleClosed
+	}
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	h.fs.mu.RLock()
+	defer h.fs.mu.RUnlock()
+	charge, err := h.fs.reserveQuota(h.file, h.file.getPermissions().uid, fileGrowth(h.file, int(off), len(p)), 0)
+	if err != nil {
+		return 0, err
+	}
+	h.file.getLock().Lock()
+	defer h.file.getLock().Unlock()
+	size := h.file.getSize()
+	defer func() { charge.settle(h.file.getSize()-size, 0) }()
+	if h.file.isUnlinked() {
+		return 0, ErrFileDoesNotExist
+	}
+	if err := h.caller.check(h.file.getPermissions(), permWrite); err != nil {
+		return 0, err
+	}
+	if h.file.getManifest() == nil {
+		h.file.setManifest(disk.NewBlockRecord())
+	}
+	n := 0
+	err = h.fs.logged(record{op: opWriteAt, path: h.file.getPath(), offset: int(off), data: p, caller: h.caller}, func() error {
+		var err error
+		n, err = h.fs.disk.WriteAt(h.file.getManifest(), p, int(off))
+		if err != nil {
+			if errors.Is(err, disk.ErrInsufficentMemoryError) {
+				return ErrFileCouldNotBeWritten
+			}
+			return ErrUnkonwnError
+		}
+		h.file.updateModifiedTs(time.Now())
+		h.fs.notify(Event{Path: h.file.getPath(), Kind: EventWrite})
+		return nil
+	})
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write, following the io.Seeker contract
+func (h *Handle) Seek(offset int64, whence int) (int64, error) {
+	if h.closed {
+		return 0, ErrHandleClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		h.file.getLock().RLock()
+		offset += int64(h.file.getSize())
+		h.file.getLock().RUnlock()
+	default:
+		return 0, ErrInvalidWhence
+	}
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+// Close releases the handle, any further call on it returns ErrHandleClosed
+func (h *Handle) Close() error {
+	if h.closed {
+		return ErrHandleClosed
+	}
+	h.closed = true
+	return nil
+}
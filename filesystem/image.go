@@ -0,0 +1,556 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// image layout, integers are little endian int64 unless noted:
+//
+//	magic [4]byte "SMPF" | version uint32 | disk image | root directory | snapshots | quotas | inodes
+//
+// a tree image, for disks persisting their own blocks, leaves out the disk:
+//
+//	magic [4]byte "SMPT" | version uint32 | root directory | snapshots | quotas | inodes
+//
+// snapshots, added in version 2, are their count followed by the snapshots sorted by name, each one
+// being its name, creation time and root directory. Version 1 images have no snapshots and still load.
+// Before version 3 directories have no timestamps and files only their creation and modification times,
+// before version 4 items have no permissions and are owned by the superuser with the default modes,
+// before version 5 there are no links, before version 6 there are no symlinks, before version 7 there
+// are no extended attributes, before version 8 there are no quotas and before version 9 there are no inode
+// numbers, items are numbered in the order they are read instead
+//
+// quotas are the count of directory quotas followed by each one's directory path and limits sorted by
+// path, then the count of user quotas followed by each one's uid and limits sorted by uid. Limits are the
+// byte limit followed by the inode limit. inodes are the number the next item gets and the inode limit
+//
+// a directory is its timestamps and entry count followed by its entries sorted by name, an entry is a
+// kind byte and its name, followed by the nested directory or by the file timestamps and block manifest.
+// Files are numbered in the order they are written across the whole image, a file linked under several
+// names is written in full at its first entry and every other entry is a link kind followed by its number.
+// A symlink entry is followed by its target, its creation time and its permissions.
+// Timestamps are the creation, modification, access and change times and are followed by the
+// permission bits, uid and gid, then for files and directories by the block manifest of their extended
+// attributes, empty without any, and last by the inode number, which a symlink has after its
+// permissions. Strings and byte slices are length prefixed
+const (
+	imageMagic   = "SMPF"
+	treeMagic    = "SMPT"
+	imageVersion = uint32(9)
+
+	kindFile    = byte(0)
+	kindDir     = byte(1)
+	kindLink    = byte(2)
+	kindSymlink = byte(3)
+)
+
+var (
+	ErrInvalidImage            = errors.New("the data is not a valid filesystem image")
+	ErrUnsupportedImageVersion = errors.New("the filesystem image version is not supported")
+)
+
+// Save writes the disk and the whole directory tree to w, no other operation can run while saving
+func (f *fileSystem) Save(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.save(w)
+}
+
+func (f *fileSystem) save(w io.Writer) error {
+	enc := &encoder{w: w}
+	enc.writeHeader(imageMagic)
+	if enc.err != nil {
+		return enc.err
+	}
+	if err := f.disk.Save(w); err != nil {
+		return err
+	}
+	enc.writeDir(f.root.(*directory))
+	enc.writeSnapshots(f.snapshots)
+	f.writeQuotas(enc)
+	f.writeInodes(enc)
+	return enc.err
+}
+
+// SaveTree writes the directory tree to w without the disk, it is meant for disks that
+// persist their own blocks such as disk.FileDisk
+func (f *fileSystem) SaveTree(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.saveTree(w)
+}
+
+func (f *fileSystem) saveTree(w io.Writer) error {
+	enc := &encoder{w: w}
+	enc.writeHeader(treeMagic)
+	enc.writeDir(f.root.(*directory))
+	enc.writeSnapshots(f.snapshots)
+	f.writeQuotas(enc)
+	f.writeInodes(enc)
+	return enc.err
+}
+
+// Load reads a filesystem written by Save, saving the loaded filesystem again produces the same bytes
+func Load(r io.Reader) (FileSystem, error) {
+	dec := &decoder{r: r}
+	version := dec.readHeader(imageMagic)
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	loadedDisk, err := disk.LoadDisk(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.readFileSystem(loadedDisk, version)
+}
+
+// Mount reads a directory tree written by SaveTree on top of a disk holding its blocks
+func Mount(disk disk.Disk, r io.Reader) (FileSystem, error) {
+	dec := &decoder{r: r}
+	version := dec.readHeader(treeMagic)
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return dec.readFileSystem(disk, version)
+}
+
+func (enc *encoder) writeHeader(magic string) {
+	enc.write([]byte(magic))
+	enc.write(imageVersion)
+}
+
+func (dec *decoder) readHeader(expectedMagic string) uint32 {
+	magic := make([]byte, len(expectedMagic))
+	dec.read(magic)
+	var version uint32
+	dec.read(&version)
+	if dec.err != nil {
+		return 0
+	}
+	dec.version = version
+	if string(magic) != expectedMagic {
+		dec.err = ErrInvalidImage
+	} else if version == 0 || version > imageVersion {
+		dec.err = ErrUnsupportedImageVersion
+	}
+	return version
+}
+
+func (dec *decoder) readFileSystem(disk disk.Disk, version uint32) (FileSystem, error) {
+	root := newDirectory("root")
+	dec.readDir(root, "")
+	snapshots := map[string]*snapshot{}
+	if version >= 2 {
+		snapshots = dec.readSnapshots()
+	}
+	fileSys := &fileSystem{root: root, disk: disk, snapshots: snapshots}
+	if version >= 8 {
+		dec.readQuotas(fileSys)
+	}
+	next, max := dec.ino+1, 0
+	if version >= 9 {
+		next, max = uint64(dec.readInt()), dec.readInt()
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	manifests := dec.collectManifests()
+	if err := disk.Verify(manifests); err != nil {
+		return nil, ErrInvalidImage
+	}
+	fileSys.inodes.index(root, next, max)
+	fileSys.indexQuotas()
+	//the disk only knows which blocks are in use, which of them are shared comes from the trees
+	disk.RebuildReferences(manifests)
+	return fileSys, nil
+}
+
+func (f *fileSystem) writeQuotas(enc *encoder) {
+	paths := make(map[string]Quota, len(f.dirQuotas))
+	for dir, limit := range f.dirQuotas {
+		paths[f.dirPath(dir)] = limit
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	enc.writeInt(len(sorted))
+	for _, path := range sorted {
+		enc.writeString(path)
+		enc.writeQuota(paths[path])
+	}
+	uids := make([]int, 0, len(f.userQuotas))
+	for uid := range f.userQuotas {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+	enc.writeInt(len(uids))
+	for _, uid := range uids {
+		enc.writeInt(uid)
+		enc.writeQuota(f.userQuotas[uid])
+	}
+}
+
+func (dec *decoder) readQuotas(f *fileSystem) {
+	count := dec.readInt()
+	for i := 0; i < count && dec.err == nil; i++ {
+		path := dec.readString()
+		limit := dec.readQuota()
+		if dec.err != nil {
+			return
+		}
+		fsItem, err := f.lookupAs(Superuser, path, false)
+		dir, ok := fsItem.(*directory)
+		if err != nil || !ok {
+			dec.err = ErrInvalidImage
+			return
+		}
+		if f.dirQuotas == nil {
+			f.dirQuotas = map[*directory]Quota{}
+		}
+		f.dirQuotas[dir] = limit
+	}
+	count = dec.readInt()
+	for i := 0; i < count && dec.err == nil; i++ {
+		uid := dec.readInt()
+		limit := dec.readQuota()
+		if f.userQuotas == nil {
+			f.userQuotas = map[int]Quota{}
+		}
+		f.userQuotas[uid] = limit
+	}
+}
+
+func (f *fileSystem) writeInodes(enc *encoder) {
+	f.inodes.mu.Lock()
+	defer f.inodes.mu.Unlock()
+	enc.writeInt(int(f.inodes.next))
+	enc.writeInt(f.inodes.max)
+}
+
+func (enc *encoder) writeSnapshots(snapshots map[string]*snapshot) {
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	enc.writeInt(len(names))
+	for _, name := range names {
+		enc.writeString(name)
+		enc.writeTime(snapshots[name].createdAt)
+		enc.writeDir(snapshots[name].root)
+	}
+}
+
+func (dec *decoder) readSnapshots() map[string]*snapshot {
+	snapshots := map[string]*snapshot{}
+	count := dec.readInt()
+	for i := 0; i < count && dec.err == nil; i++ {
+		snap := &snapshot{name: dec.readString(), root: newDirectory("root")}
+		snap.createdAt = dec.readTime()
+		dec.readDir(snap.root, "")
+		snapshots[snap.name] = snap
+	}
+	return snapshots
+}
+
+func (dec *decoder) collectManifests() []*disk.BlockRecord {
+	manifests := make([]*disk.BlockRecord, 0, len(dec.files)+len(dec.xattrs))
+	for _, fl := range dec.files {
+		manifests = append(manifests, fl.info)
+	}
+	return append(manifests, dec.xattrs...)
+}
+
+func (enc *encoder) writeDir(dir *directory) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	enc.writeTime(dir.createdAt)
+	enc.writeTime(dir.lastModified)
+	enc.writeTime(dir.accessedAt())
+	enc.writeTime(dir.lastChanged)
+	enc.writePermissions(dir.perm)
+	enc.writeManifest(dir.xattrs)
+	enc.writeInt(int(dir.ino))
+	names := make([]string, 0, len(dir.contents))
+	for name := range dir.contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	enc.writeInt(len(names))
+	for _, name := range names {
+		fsItem := dir.contents[name]
+		if link, ok := fsItem.(*symlink); ok {
+			enc.write(kindSymlink)
+			enc.writeString(name)
+			enc.writeString(link.target)
+			enc.writeTime(link.createdAt)
+			enc.writePermissions(link.perm)
+			enc.writeInt(int(link.ino))
+		} else if fsItem.isFile() {
+			fl := fsItem.(*file)
+			if number, written := enc.files[fl]; written {
+				enc.write(kindLink)
+				enc.writeString(name)
+				enc.writeInt(number)
+				continue
+			}
+			if enc.files == nil {
+				enc.files = map[*file]int{}
+			}
+			enc.files[fl] = len(enc.files)
+			enc.write(kindFile)
+			enc.writeString(name)
+			enc.writeFile(fl)
+		} else {
+			enc.write(kindDir)
+			enc.writeString(name)
+			enc.writeDir(fsItem.(*directory))
+		}
+	}
+}
+
+func (enc *encoder) writeFile(fl *file) {
+	fl.mu.RLock()
+	defer fl.mu.RUnlock()
+	enc.writeTime(fl.createdAt)
+	enc.writeTime(fl.lastModified)
+	enc.writeTime(fl.lastAccessed)
+	enc.writeTime(fl.lastChanged)
+	enc.writePermissions(fl.perm)
+	enc.writeManifest(fl.xattrs)
+	enc.writeInt(int(fl.ino))
+	enc.writeManifest(fl.info)
+}
+
+// writeManifest writes a block manifest, a nil manifest is written empty
+func (enc *encoder) writeManifest(manifest *disk.BlockRecord) {
+	if manifest == nil {
+		manifest = disk.NewBlockRecord()
+	}
+	data, err := manifest.MarshalBinary()
+	if err != nil && enc.err == nil {
+		enc.err = err
+	}
+	enc.writeBytes(data)
+}
+
+func (dec *decoder) readDir(dir *directory, dirPath string) {
+	if dec.version >= 3 {
+		dir.createdAt = dec.readTime()
+		dir.lastModified = dec.readTime()
+		dir.lastAccessed = dec.readTime()
+		dir.lastChanged = dec.readTime()
+	}
+	if dec.version >= 4 {
+		dir.perm = dec.readPermissions()
+	}
+	if dec.version >= 7 {
+		dir.xattrs = dec.readXattrs()
+	}
+	dir.ino = dec.readIno()
+	count := dec.readInt()
+	for i := 0; i < count && dec.err == nil; i++ {
+		var kind byte
+		dec.read(&kind)
+		name := dec.readString()
+		if dec.err != nil {
+			return
+		}
+		switch kind {
+		case kindFile:
+			fl := &file{fileName: name, path: dirPath + "/" + name, nlink: 1, info: disk.NewBlockRecord(), perm: permissions{mode: defaultFileMode}}
+			fl.createdAt = dec.readTime()
+			fl.lastModified = dec.readTime()
+			fl.lastAccessed, fl.lastChanged = fl.lastModified, fl.lastModified
+			if dec.version >= 3 {
+				fl.lastAccessed = dec.readTime()
+				fl.lastChanged = dec.readTime()
+			}
+			if dec.version >= 4 {
+				fl.perm = dec.readPermissions()
+			}
+			if dec.version >= 7 {
+				fl.xattrs = dec.readXattrs()
+			}
+			fl.ino = dec.readIno()
+			if data := dec.readBytes(); dec.err == nil && fl.info.UnmarshalBinary(data) != nil {
+				dec.err = ErrInvalidImage
+			}
+			dir.addEntry(name, fl)
+			dec.files = append(dec.files, fl)
+		case kindLink:
+			number := dec.readInt()
+			if dec.err != nil {
+				return
+			}
+			if dec.version < 5 || number < 0 || number >= len(dec.files) {
+				dec.err = ErrInvalidImage
+				return
+			}
+			dec.files[number].nlink++
+			dir.addEntry(name, dec.files[number])
+		case kindSymlink:
+			if dec.version < 6 {
+				dec.err = ErrInvalidImage
+				return
+			}
+			link := &symlink{linkName: name, target: dec.readString()}
+			link.createdAt = dec.readTime()
+			link.perm = dec.readPermissions()
+			link.ino = dec.readIno()
+			dir.addEntry(name, link)
+		case kindDir:
+			childDir := newDirectory(name)
+			dec.readDir(childDir, dirPath+"/"+name)
+			dir.addEntry(name, childDir)
+		default:
+			dec.err = ErrInvalidImage
+		}
+	}
+}
+
+// encoder writes little endian values to w, keeping the first error it runs into.
+// files numbers the files written so far
+type encoder struct {
+	w     io.Writer
+	err   error
+	files map[*file]int
+}
+
+func (enc *encoder) write(data interface{}) {
+	if enc.err != nil {
+		return
+	}
+	enc.err = binary.Write(enc.w, binary.LittleEndian, data)
+}
+
+func (enc *encoder) writeInt(value int) {
+	enc.write(int64(value))
+}
+
+func (enc *encoder) writeBytes(data []byte) {
+	enc.writeInt(len(data))
+	enc.write(data)
+}
+
+func (enc *encoder) writeString(value string) {
+	enc.writeBytes([]byte(value))
+}
+
+func (enc *encoder) writeTime(value time.Time) {
+	data, err := value.MarshalBinary()
+	if err != nil && enc.err == nil {
+		enc.err = err
+	}
+	enc.writeBytes(data)
+}
+
+func (enc *encoder) writePermissions(perm permissions) {
+	enc.write(uint32(perm.mode))
+	enc.writeInt(perm.uid)
+	enc.writeInt(perm.gid)
+}
+
+// decoder reads little endian values from r, keeping the first error it runs into.
+// version is the version of the image being read, set once its header is read, files are the files
+// read so far in the order they were numbered and xattrs the extended attribute records read so far.
+// ino is the last inode number given to an item of an image older than version 9
+type decoder struct {
+	r       io.Reader
+	err     error
+	version uint32
+	files   []*file
+	xattrs  []*disk.BlockRecord
+	ino     uint64
+}
+
+func (dec *decoder) read(data interface{}) {
+	if dec.err != nil {
+		return
+	}
+	dec.err = binary.Read(dec.r, binary.LittleEndian, data)
+	if errors.Is(dec.err, io.EOF) || errors.Is(dec.err, io.ErrUnexpectedEOF) {
+		dec.err = ErrInvalidImage
+	}
+}
+
+func (dec *decoder) readInt() int {
+	var value int64
+	dec.read(&value)
+	return int(value)
+}
+
+func (dec *decoder) readBytes() []byte {
+	length := dec.readInt()
+	if dec.err != nil {
+		return nil
+	}
+	if length < 0 {
+		dec.err = ErrInvalidImage
+		return nil
+	}
+	//copy instead of allocating length bytes upfront, a corrupted length only fails once the data runs out
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, dec.r, int64(length)); err != nil {
+		dec.err = ErrInvalidImage
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+func (dec *decoder) readString() string {
+	return string(dec.readBytes())
+}
+
+func (dec *decoder) readTime() time.Time {
+	var value time.Time
+	data := dec.readBytes()
+	if dec.err == nil && value.UnmarshalBinary(data) != nil {
+		dec.err = ErrInvalidImage
+	}
+	return value
+}
+
+// readXattrs reads the extended attributes manifest of an item, nil when it has none
+func (dec *decoder) readXattrs() *disk.BlockRecord {
+	data := dec.readBytes()
+	if dec.err != nil {
+		return nil
+	}
+	manifest := disk.NewBlockRecord()
+	if manifest.UnmarshalBinary(data) != nil {
+		dec.err = ErrInvalidImage
+		return nil
+	}
+	if manifest.BlockCount() == 0 {
+		return nil
+	}
+	dec.xattrs = append(dec.xattrs, manifest)
+	return manifest
+}
+
+// readIno reads the inode number of an item, images older than version 9 have none and the item
+// gets the next number
+func (dec *decoder) readIno() uint64 {
+	if dec.version >= 9 {
+		return uint64(dec.readInt())
+	}
+	dec.ino++
+	return dec.ino
+}
+
+func (dec *decoder) readPermissions() permissions {
+	var mode uint32
+	dec.read(&mode)
+	return permissions{mode: fs.FileMode(mode).Perm(), uid: dec.readInt(), gid: dec.readInt()}
+}
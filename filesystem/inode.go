@@ -0,0 +1,137 @@
+package filesystem
+
+import (
+	"errors"
+	"sync"
+)
+
+// Every file, directory and symlink carries an inode number, given when it is created and kept through
+// renames, links, snapshots and images. Numbers are never reused, the root directory is always rootIno.
+// The inode table maps the numbers of the items in the live tree to them, it is what OpenByID looks up
+// and what the inode limit counts
+const rootIno = uint64(1)
+
+var (
+	ErrInodeDoesNotExist = errors.New("the inode does not exist")
+	ErrNoInodes          = errors.New("no inodes left on the filesystem")
+	ErrInvalidMaxInodes  = errors.New("the inode limit cannot be negative or below the inodes in use")
+)
+
+// inodeTable guards its fields with mu, it is taken last, under the lock of any directory or file.
+// next is the number the next item gets and max the limit on the items in use, zero being no limit.
+// The zero table is empty and numbers items from rootIno+1
+type inodeTable struct {
+	mu    sync.Mutex
+	items map[uint64]item
+	next  uint64
+	max   int
+}
+
+// index fills the table with every item below root, root included, before the filesystem is shared
+func (table *inodeTable) index(root *directory, next uint64, max int) {
+	table.items, table.next, table.max = map[uint64]item{}, next, max
+	table.addDir(root)
+}
+
+func (table *inodeTable) addDir(dir *directory) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	table.items[dir.ino] = dir
+	for _, fsItem := range dir.contents {
+		if child, ok := fsItem.(*directory); ok {
+			table.addDir(child)
+			continue
+		}
+		table.items[fsItem.getIno()] = fsItem
+	}
+}
+
+// allocate numbers fsItem and adds it to the table, it fails with ErrNoInodes once the limit is reached
+func (table *inodeTable) allocate(fsItem item) (uint64, error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if table.max > 0 && len(table.items) >= table.max {
+		return 0, ErrNoInodes
+	}
+	if table.items == nil {
+		table.items = map[uint64]item{}
+	}
+	if table.next <= rootIno {
+		table.next = rootIno + 1
+	}
+	ino := table.next
+	table.next++
+	table.items[ino] = fsItem
+	return ino, nil
+}
+
+// release drops an item removed from the tree
+func (table *inodeTable) release(fsItem item) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if table.items[fsItem.getIno()] == fsItem {
+		delete(table.items, fsItem.getIno())
+	}
+}
+
+func (table *inodeTable) get(ino uint64) (item, bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	fsItem, exist := table.items[ino]
+	return fsItem, exist
+}
+
+// SetMaxInodes limits how many files, directories and symlinks the filesystem holds, the root directory
+// included. Creating an item past the limit fails with ErrNoInodes, a zero limit is no limit
+func (f *fileSystem) SetMaxInodes(max int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inodes.mu.Lock()
+	inUse := len(f.inodes.items)
+	f.inodes.mu.Unlock()
+	if max < 0 || (max > 0 && max < inUse) {
+		return ErrInvalidMaxInodes
+	}
+	return f.logged(record{op: opSetMaxInodes, offset: max}, func() error {
+		f.inodes.mu.Lock()
+		defer f.inodes.mu.Unlock()
+		f.inodes.max = max
+		return nil
+	})
+}
+
+// OpenByID opens the file numbered ino wherever it is in the tree, the returned handle keeps referring to
+// the file through renames. Directories and symlinks cannot be opened. As with OpenFile the caller must be
+// allowed to search the directories leading to the file, along the path it is known by when it has
+// several names, and to either read or write it
+func (f *fileSystem) OpenByID(ino uint64) (*Handle, error) {
+	return f.openByIDAs(Superuser, ino)
+}
+
+func (f *fileSystem) openByIDAs(caller Caller, ino uint64) (*Handle, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, exist := f.inodes.get(ino)
+	if !exist {
+		return nil, ErrInodeDoesNotExist
+	}
+	if !fsItem.isFile() {
+		return nil, ErrIsDirectory
+	}
+	fileHandle, ok := fsItem.(File)
+	if !ok {
+		return nil, ErrFileDoesNotExist
+	}
+	if !caller.isSuperuser() {
+		fileHandle.getLock().RLock()
+		levels := targetLevels(fileHandle.getPath())
+		fileHandle.getLock().RUnlock()
+		if err := f.root.(*directory).search(levels, caller); err != nil {
+			return nil, err
+		}
+		if !caller.allowed(fileHandle.getPermissions(), permRead) && !caller.allowed(fileHandle.getPermissions(), permWrite) {
+			return nil, ErrPermissionDenied
+		}
+	}
+	return newHandle(f, fileHandle, caller), nil
+}
@@ -0,0 +1,173 @@
+package filesystem
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var inodeTree = map[string]string{
+	"/home/docs/a.txt": "document a",
+	"/home/link":       "-> docs/a.txt",
+}
+
+func inoOf(t *testing.T, fileSys FileSystem, path string) uint64 {
+	info, err := fileSys.Lstat(path)
+	assert.Nil(t, err, path)
+	if err != nil {
+		return 0
+	}
+	return info.Ino
+}
+
+func TestInodeNumbers(t *testing.T) {
+	fileSys := newTree(t, 200, inodeTree)
+	assert.Equal(t, rootIno, inoOf(t, fileSys, "/"))
+	seen := map[uint64]string{}
+	for _, path := range []string{"/", "/home", "/home/docs", "/home/docs/a.txt", "/home/link"} {
+		ino := inoOf(t, fileSys, path)
+		assert.NotContains(t, seen, ino, path)
+		seen[ino] = path
+	}
+
+	//links share the number of their file, renames keep it and removed numbers are not given again
+	ino := inoOf(t, fileSys, "/home/docs/a.txt")
+	assert.Nil(t, fileSys.Link("/home/docs/a.txt", "/home/b.txt"))
+	assert.Equal(t, ino, inoOf(t, fileSys, "/home/b.txt"))
+	assert.Nil(t, fileSys.Rename("/home/docs", "/home/moved"))
+	assert.Equal(t, ino, inoOf(t, fileSys, "/home/moved/a.txt"))
+	assert.Nil(t, fileSys.DeleteFile("/home/link", NoFollow))
+	assert.Nil(t, fileSys.CreateFile("/home/link"))
+	assert.NotContains(t, seen, inoOf(t, fileSys, "/home/link"))
+}
+
+func TestOpenByID(t *testing.T) {
+	fileSys := newTree(t, 200, inodeTree)
+	ino := inoOf(t, fileSys, "/home/docs/a.txt")
+	handle, err := fileSys.OpenByID(ino)
+	assert.Nil(t, err)
+	assert.Nil(t, fileSys.Rename("/home/docs/a.txt", "/home/renamed.txt"))
+	assert.Nil(t, fileSys.Rename("/home/docs", "/docs"))
+	_, err = handle.WriteAt([]byte("D"), 0)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(handle)
+	assert.Equal(t, "Document a", string(data))
+	fl, _ := fileSys.OpenFile("/home/renamed.txt")
+	data, _ = fileSys.ReadFile(fl)
+	assert.Equal(t, "Document a", string(data))
+
+	_, err = fileSys.OpenByID(inoOf(t, fileSys, "/docs"))
+	assert.Equal(t, ErrIsDirectory, err)
+	_, err = fileSys.OpenByID(inoOf(t, fileSys, "/home/link"))
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	//a file is found by its number as long as one of its links is left
+	assert.Nil(t, fileSys.Link("/home/renamed.txt", "/docs/a.txt"))
+	assert.Nil(t, fileSys.DeleteFile("/home/renamed.txt"))
+	_, err = fileSys.OpenByID(ino)
+	assert.Nil(t, err)
+	_, err = fileSys.RemoveAll("/docs")
+	assert.Nil(t, err)
+	_, err = fileSys.OpenByID(ino)
+	assert.Equal(t, ErrInodeDoesNotExist, err)
+	_, err = handle.Write([]byte("x"))
+	assert.Equal(t, ErrFileDoesNotExist, err)
+}
+
+func TestOpenByIDPermissions(t *testing.T) {
+	fileSys := newTree(t, 200, nil)
+	setupPermissions(t, fileSys)
+	private, shared := inoOf(t, fileSys, "/home/alice/private.txt"), inoOf(t, fileSys, "/home/alice/shared.txt")
+	_, err := as(fileSys, alice).OpenByID(private)
+	assert.Nil(t, err)
+	_, err = as(fileSys, bob).OpenByID(private)
+	assert.Equal(t, ErrPermissionDenied, err)
+
+	//the handle runs as its caller, bob may read the group readable file but not write it
+	handle, err := as(fileSys, bob).OpenByID(shared)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(handle)
+	assert.Equal(t, "alice wrote this", string(data))
+	_, err = handle.WriteAt([]byte("bob"), 0)
+	assert.Equal(t, ErrPermissionDenied, err)
+
+	//the directories leading to the file must be searchable
+	assert.Nil(t, fileSys.Chmod("/home/alice", 0700))
+	_, err = as(fileSys, bob).OpenByID(shared)
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = as(fileSys, alice).OpenByID(shared)
+	assert.Nil(t, err)
+}
+
+func TestMaxInodes(t *testing.T) {
+	fileSys := newTree(t, 200, inodeTree)
+	//the root, home, docs, a.txt and the symlink are in use
+	assert.Equal(t, ErrInvalidMaxInodes, fileSys.SetMaxInodes(4))
+	assert.Equal(t, ErrInvalidMaxInodes, fileSys.SetMaxInodes(-1))
+	assert.Equal(t, ErrPermissionDenied, as(fileSys, alice).SetMaxInodes(10))
+	assert.Nil(t, fileSys.SetMaxInodes(7))
+	assert.Nil(t, fileSys.CreateFile("/home/b.txt"))
+	assert.Nil(t, fileSys.Link("/home/b.txt", "/home/c.txt"))
+	assert.Nil(t, fileSys.CreateDir("/tmp"))
+	assert.Equal(t, ErrNoInodes, fileSys.CreateFile("/home/d.txt"))
+	assert.Equal(t, ErrNoInodes, fileSys.CreateDir("/var"))
+	assert.Equal(t, ErrNoInodes, fileSys.Symlink("/home", "/var"))
+	_, err := fileSys.Lstat("/var")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+
+	//deleting a file frees its inode once its last link is gone
+	assert.Nil(t, fileSys.DeleteFile("/home/b.txt"))
+	assert.Equal(t, ErrNoInodes, fileSys.CreateFile("/home/d.txt"))
+	assert.Nil(t, fileSys.DeleteFile("/home/c.txt"))
+	assert.Nil(t, fileSys.CreateFile("/home/d.txt"))
+	_, err = fileSys.RemoveAll("/home")
+	assert.Nil(t, err)
+	assert.Nil(t, fileSys.CreateDir("/a/b/c/d"))
+	assert.Equal(t, ErrNoInodes, fileSys.CreateDir("/a/b/c/d/e/f"))
+
+	assert.Nil(t, fileSys.SetMaxInodes(0))
+	assert.Nil(t, fileSys.CreateDir("/a/b/c/d/e/f"))
+}
+
+func TestInodeSnapshot(t *testing.T) {
+	fileSys := newTree(t, 200, inodeTree)
+	ino := inoOf(t, fileSys, "/home/docs/a.txt")
+	assert.Nil(t, fileSys.Snapshot("before"))
+	assert.Nil(t, fileSys.DeleteFile("/home/docs/a.txt"))
+	_, err := fileSys.OpenByID(ino)
+	assert.Equal(t, ErrInodeDoesNotExist, err)
+
+	view, _ := fileSys.MountSnapshot("before")
+	assert.Equal(t, ino, inoOf(t, view, "/home/docs/a.txt"))
+	handle, err := view.OpenByID(ino)
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(handle)
+	assert.Equal(t, "document a", string(data))
+}
+
+func TestInodeSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, inodeTree)
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.CreateFile("/home/b.txt"))
+		assert.Nil(t, fileSys.DeleteFile("/home/link", NoFollow))
+		assert.Nil(t, fileSys.Snapshot("tagged"))
+		assert.Nil(t, fileSys.Rename("/home/docs", "/docs"))
+		assert.Nil(t, fileSys.SetMaxInodes(5))
+	}, func(restored FileSystem) {
+		for _, path := range []string{"/", "/home", "/docs", "/docs/a.txt", "/home/b.txt"} {
+			assert.Equal(t, inoOf(t, fileSys, path), inoOf(t, restored, path), path)
+		}
+		handle, err := restored.OpenByID(inoOf(t, fileSys, "/docs/a.txt"))
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(handle)
+		assert.Equal(t, "document a", string(data))
+		view, _ := restored.MountSnapshot("tagged")
+		assert.Equal(t, inoOf(t, fileSys, "/docs/a.txt"), inoOf(t, view, "/home/docs/a.txt"))
+		assert.Equal(t, ErrNoInodes, restored.CreateFile("/c.txt"))
+		//numbers given before the checkpoint or the save are not given again
+		assert.Nil(t, restored.SetMaxInodes(0))
+		assert.Nil(t, restored.CreateFile("/c.txt"))
+		assert.Equal(t, fileSys.(*fileSystem).inodes.next, inoOf(t, restored, "/c.txt"))
+	})
+}
@@ -0,0 +1,233 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// IOFS adapts a FileSystem to the io/fs interfaces so it can be handed to anything
+// in the standard library that accepts an fs.FS (http.FS, template.ParseFS, fs.WalkDir...).
+// It only goes through the FileSystem it wraps, so an IOFS over a FileSystem returned by
+// WithContext checks the permissions of its caller
+type IOFS struct {
+	fs FileSystem
+}
+
+var (
+	_ fs.FS         = (*IOFS)(nil)
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+)
+
+func NewIOFS(fileSys FileSystem) *IOFS {
+	return &IOFS{fs: fileSys}
+}
+
+// Open opens the named file or directory, names follow the io/fs conventions: slash separated,
+// unrooted and "." for the root directory
+func (iofs *IOFS) Open(name string) (fs.File, error) {
+	info, err := iofs.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := iofs.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return &ioFile{Reader: bytes.NewReader(data), info: info}, nil
+	}
+	entries, err := iofs.readDir("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &ioDir{path: name, info: info, entries: entries}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by filename
+func (iofs *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return iofs.readDir("readdir", name)
+}
+
+// ReadFile reads the named file and returns its contents
+func (iofs *IOFS) ReadFile(name string) ([]byte, error) {
+	path, err := fsPath("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	fileHandle, err := iofs.fs.OpenFile(path)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	data, err := iofs.fs.ReadFile(fileHandle)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return data, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory
+func (iofs *IOFS) Stat(name string) (fs.FileInfo, error) {
+	return iofs.stat("stat", name)
+}
+
+func (iofs *IOFS) stat(op string, name string) (*fileInfo, error) {
+	path, err := fsPath(op, name)
+	if err != nil {
+		return nil, err
+	}
+	//io/fs has no symlinks, they are followed
+	info, err := iofs.fs.Stat(path)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return newFileInfo(info, name[strings.LastIndex(name, "/")+1:]), nil
+}
+
+func (iofs *IOFS) readDir(op string, name string) ([]fs.DirEntry, error) {
+	path, err := fsPath(op, name)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := iofs.fs.ReadDir(path, ReadDirOptions{})
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		entryPath := "/" + entry.Name
+		if path != "/" {
+			entryPath = path + entryPath
+		}
+		dirEntries = append(dirEntries, &ioDirEntry{fs: iofs.fs, path: entryPath, entry: entry})
+	}
+	return dirEntries, nil
+}
+
+// fsPath turns an io/fs name into a path of the FileSystem
+func fsPath(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "/", nil
+	}
+	return "/" + name, nil
+}
+
+// pathError reports err the io/fs way, with the io/fs errors standing for the FileSystem ones
+func pathError(op string, name string, err error) error {
+	switch {
+	case errors.Is(err, ErrPermissionDenied):
+		err = fs.ErrPermission
+	case errors.Is(err, ErrPathDoesNotExists), errors.Is(err, ErrFileDoesNotExist):
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func newFileInfo(info *FileInfo, name string) *fileInfo {
+	return &fileInfo{name: name, size: int64(info.Size), mode: info.Mode, modTime: info.ModifiedAt}
+}
+
+func (info *fileInfo) Name() string {
+	return info.name
+}
+func (info *fileInfo) Size() int64 {
+	return info.size
+}
+func (info *fileInfo) Mode() fs.FileMode {
+	return info.mode
+}
+func (info *fileInfo) ModTime() time.Time {
+	return info.modTime
+}
+func (info *fileInfo) IsDir() bool {
+	return info.mode.IsDir()
+}
+func (info *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// ioDirEntry is an entry of a directory as it was when the directory was read, Info stats it lazily
+type ioDirEntry struct {
+	fs    FileSystem
+	path  string
+	entry DirEntry
+}
+
+func (entry *ioDirEntry) Name() string {
+	return entry.entry.Name
+}
+func (entry *ioDirEntry) IsDir() bool {
+	return entry.entry.IsDir()
+}
+func (entry *ioDirEntry) Type() fs.FileMode {
+	return entry.entry.Type
+}
+func (entry *ioDirEntry) Info() (fs.FileInfo, error) {
+	info, err := entry.fs.Lstat(entry.path)
+	if err != nil {
+		return nil, pathError("stat", entry.path[1:], err)
+	}
+	return newFileInfo(info, entry.entry.Name), nil
+}
+
+// ioFile serves the contents of a file as they were when it was opened
+type ioFile struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (fl *ioFile) Stat() (fs.FileInfo, error) {
+	return fl.info, nil
+}
+func (fl *ioFile) Close() error {
+	return nil
+}
+
+type ioDir struct {
+	path    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (dir *ioDir) Stat() (fs.FileInfo, error) {
+	return dir.info, nil
+}
+func (dir *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.path, Err: ErrIsDirectory}
+}
+func (dir *ioDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next count entries of the directory, following the fs.ReadDirFile contract
+func (dir *ioDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := dir.entries[dir.offset:]
+	if count <= 0 {
+		dir.offset = len(dir.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	dir.offset += count
+	return remaining[:count], nil
+}
@@ -0,0 +1,90 @@
+package filesystem
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupIOFS(t *testing.T) *IOFS {
+	disk, _ := disk.NewDisk(1000, 10)
+	fileSystem := NewFileSystem(disk)
+	if err := fileSystem.CreateDir("/home/usr/path"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileSystem.CreateDir("/home/empty"); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"/home/usr/path/file1.txt": "random data that will pressist hopefully",
+		"/home/usr/path/file2.txt": "",
+		"/home/readme.md":          "a file spanning a few blocks of the disk",
+	} {
+		if err := fileSystem.CreateFile(name); err != nil {
+			t.Fatal(err)
+		}
+		fl, err := fileSystem.OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileSystem.WriteFile(fl, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewIOFS(fileSystem)
+}
+
+func TestIOFS(t *testing.T) {
+	iofs := setupIOFS(t)
+	err := fstest.TestFS(iofs, "home/usr/path/file1.txt", "home/usr/path/file2.txt", "home/readme.md", "home/empty")
+	assert.Nil(t, err)
+}
+
+func TestIOFSErrors(t *testing.T) {
+	iofs := setupIOFS(t)
+	tests := []struct {
+		name        string
+		path        string
+		expectedErr error
+	}{
+		{name: "invalid path", path: "/home", expectedErr: fs.ErrInvalid},
+		{name: "missing file", path: "home/missing.txt", expectedErr: fs.ErrNotExist},
+		{name: "file used as a directory", path: "home/readme.md/file", expectedErr: fs.ErrNotExist},
+	}
+	for _, testcase := range tests {
+		_, err := iofs.Open(testcase.path)
+		assert.ErrorIs(t, err, testcase.expectedErr, testcase.name)
+	}
+
+	data, err := fs.ReadFile(iofs, "home/readme.md")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a file spanning a few blocks of the disk"), data)
+
+	info, err := fs.Stat(iofs, "home/usr")
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, "usr", info.Name())
+}
+
+// wrappedFileSystem is a FileSystem implemented outside of the package
+type wrappedFileSystem struct {
+	FileSystem
+}
+
+func TestIOFSImplementations(t *testing.T) {
+	fileSys := setupIOFS(t).fs
+	assert.Nil(t, fileSys.Snapshot("before"))
+	snapshot, err := fileSys.MountSnapshot("before")
+	assert.Nil(t, err)
+	for name, impl := range map[string]FileSystem{
+		"wrapped":     wrappedFileSystem{fileSys},
+		"caller view": as(fileSys, alice),
+		"snapshot":    snapshot,
+	} {
+		err := fstest.TestFS(NewIOFS(impl), "home/usr/path/file1.txt", "home/usr/path/file2.txt", "home/readme.md", "home/empty")
+		assert.Nil(t, err, name)
+	}
+}
@@ -0,0 +1,277 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// The journal is a write-ahead log of the mutations applied since the last checkpoint. A record is
+// appended, and synced when the writer supports it, before the mutation touches the tree or the disk,
+// so after a crash replaying the complete records on top of the checkpoint redoes every mutation that
+// may have started while a torn record at the tail belongs to a mutation that never started.
+//
+// record layout, integers are little endian:
+//
+//	payload length uint32 | crc32 of payload uint32 | payload
+//
+// the payload is the op byte followed by the path and, for writes, the offset and the data, then the
+// uid and gid given by a chown and last the uid, gid and groups of the caller the mutation ran as.
+// A rename or a link stores the new path as its data, a symlink its target, a chmod the mode as its offset
+// and a delete that does not follow a symlink 1 as its offset. Setting an extended attribute stores its name
+// followed by its value as data and the length of the name as offset, removing one stores the name as data.
+// A quota stores its limits as data, a user quota its uid as uid, and an inode limit and the size of a
+// resized disk are stored as offset
+const (
+	opCreateDir = byte(iota + 1)
+	opCreateFile
+	opWriteFile
+	opAppendFile
+	opWriteAt
+	opDeleteFile
+	opSnapshot
+	opDeleteSnapshot
+	opRename
+	opRemoveDir
+	opRemoveAll
+	opChmod
+	opChown
+	opLink
+	opSymlink
+	opSetXattr
+	opRemoveXattr
+	opSetDirQuota
+	opSetUserQuota
+	opSetMaxInodes
+	opResize
+)
+
+const recordHeaderSize = 8
+
+var ErrJournalClosed = errors.New("the journal could not be written, the filesystem is read only until the next checkpoint")
+
+type record struct {
+	op     byte
+	path   string
+	offset int
+	data   []byte
+	uid    int
+	gid    int
+	caller Caller
+}
+
+// journal serializes the mutations of a journaled filesystem so that the order of the records
+// is the order the mutations were applied in
+type journal struct {
+	mu     sync.Mutex
+	w      io.Writer
+	broken bool
+}
+
+func newJournal(w io.Writer) *journal {
+	return &journal{w: w}
+}
+
+func (j *journal) append(rec record) error {
+	if j.broken {
+		return ErrJournalClosed
+	}
+	var payload bytes.Buffer
+	enc := &encoder{w: &payload}
+	enc.write(rec.op)
+	enc.writeString(rec.path)
+	enc.writeInt(rec.offset)
+	enc.writeBytes(rec.data)
+	enc.writeInt(rec.uid)
+	enc.writeInt(rec.gid)
+	enc.writeInt(rec.caller.UID)
+	enc.writeInt(rec.caller.GID)
+	enc.writeInt(len(rec.caller.Groups))
+	for _, group := range rec.caller.Groups {
+		enc.writeInt(group)
+	}
+	if enc.err != nil {
+		return enc.err
+	}
+	frame := make([]byte, recordHeaderSize, recordHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(frame, uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+	if _, err := j.w.Write(frame); err != nil {
+		//a partially written record would be followed by garbage, stop logging altogether
+		j.broken = true
+		return err
+	}
+	if syncer, ok := j.w.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			j.broken = true
+			return err
+		}
+	}
+	return nil
+}
+
+// logged records rec in the journal then runs apply, without a journal it only runs apply.
+// Callers hold f.mu shared, which keeps Checkpoint from swapping the journal underneath them
+func (f *fileSystem) logged(rec record, apply func() error) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if f.journal == nil {
+		return apply()
+	}
+	f.journal.mu.Lock()
+	defer f.journal.mu.Unlock()
+	if err := f.journal.append(rec); err != nil {
+		return err
+	}
+	return apply()
+}
+
+func NewJournaledFileSystem(disk disk.Disk, journal io.Writer) FileSystem {
+	fileSys := NewFileSystem(disk).(*fileSystem)
+	fileSys.journal = newJournal(journal)
+	return fileSys
+}
+
+// Checkpoint saves the filesystem to image and starts logging to journal, records written to the previous
+// journal are covered by the image and it can be discarded once Checkpoint returns.
+// A disk.FileDisk keeps its own blocks, so only the tree is saved (as SaveTree does) and the disk is synced,
+// any other disk is saved whole (as Save does)
+func (f *fileSystem) Checkpoint(image io.Writer, journal io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if fileDisk, ok := f.disk.(disk.FileDisk); ok {
+		if err := f.saveTree(image); err != nil {
+			return err
+		}
+		if err := fileDisk.Sync(); err != nil {
+			return err
+		}
+	} else if err := f.save(image); err != nil {
+		return err
+	}
+	f.journal = newJournal(journal)
+	return nil
+}
+
+// Replay redoes the records of a journal on a filesystem restored from the matching checkpoint with Load
+// or Mount. Replay stops at the first torn or corrupted record, which marks where the crash happened.
+// Mutations that failed when they were first applied fail again and are skipped
+func Replay(fileSys FileSystem, journal io.Reader) error {
+	for {
+		header := make([]byte, recordHeaderSize)
+		if _, err := io.ReadFull(journal, header); err != nil {
+			return ignoreTornRecord(err)
+		}
+		var buffer bytes.Buffer
+		if _, err := io.CopyN(&buffer, journal, int64(binary.LittleEndian.Uint32(header))); err != nil {
+			return ignoreTornRecord(err)
+		}
+		payload := buffer.Bytes()
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return nil
+		}
+		dec := &decoder{r: bytes.NewReader(payload)}
+		var rec record
+		dec.read(&rec.op)
+		rec.path = dec.readString()
+		rec.offset = dec.readInt()
+		rec.data = dec.readBytes()
+		rec.uid = dec.readInt()
+		rec.gid = dec.readInt()
+		rec.caller.UID = dec.readInt()
+		rec.caller.GID = dec.readInt()
+		groups := dec.readInt()
+		for i := 0; i < groups && dec.err == nil; i++ {
+			rec.caller.Groups = append(rec.caller.Groups, dec.readInt())
+		}
+		if dec.err != nil {
+			return nil
+		}
+		_ = redo(fileSys.(*fileSystem), rec)
+	}
+}
+
+func ignoreTornRecord(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// redo runs the mutation of rec as the caller it first ran as, the tree being the same the permission
+// checks come out the same
+func redo(f *fileSystem, rec record) error {
+	switch rec.op {
+	case opCreateDir:
+		return f.createDirAs(rec.caller, rec.path)
+	case opCreateFile:
+		return f.createFileAs(rec.caller, rec.path)
+	case opDeleteFile:
+		return f.deleteFileAs(rec.caller, rec.path, rec.offset == 0)
+	case opSnapshot:
+		return f.Snapshot(rec.path)
+	case opDeleteSnapshot:
+		return f.DeleteSnapshot(rec.path)
+	case opRename:
+		return f.renameAs(rec.caller, rec.path, string(rec.data))
+	case opRemoveDir:
+		return f.removeDirAs(rec.caller, rec.path)
+	case opRemoveAll:
+		_, err := f.removeAllAs(rec.caller, rec.path)
+		return err
+	case opLink:
+		return f.linkAs(rec.caller, rec.path, string(rec.data))
+	case opSymlink:
+		return f.symlinkAs(rec.caller, string(rec.data), rec.path)
+	case opSetXattr:
+		if rec.offset < 0 || rec.offset > len(rec.data) {
+			return ErrInvalidImage
+		}
+		return f.setXattrAs(rec.caller, rec.path, string(rec.data[:rec.offset]), rec.data[rec.offset:])
+	case opRemoveXattr:
+		return f.removeXattrAs(rec.caller, rec.path, string(rec.data))
+	case opSetDirQuota, opSetUserQuota:
+		limit, err := decodeQuota(rec.data)
+		if err != nil {
+			return err
+		}
+		if rec.op == opSetDirQuota {
+			return f.SetDirQuota(rec.path, limit)
+		}
+		return f.SetUserQuota(rec.uid, limit)
+	case opSetMaxInodes:
+		return f.SetMaxInodes(rec.offset)
+	case opResize:
+		return f.Resize(rec.offset)
+	case opChmod:
+		return f.chmodAs(rec.caller, rec.path, fs.FileMode(rec.offset))
+	case opChown:
+		return f.chownAs(rec.caller, rec.path, rec.uid, rec.gid)
+	}
+	fileHandle, err := f.OpenFile(rec.path)
+	if err != nil {
+		return err
+	}
+	switch rec.op {
+	case opWriteFile:
+		return f.writeFileAs(rec.caller, fileHandle, rec.data)
+	case opAppendFile:
+		return f.appendFileAs(rec.caller, fileHandle, rec.data)
+	case opWriteAt:
+		handle := newHandle(f, fileHandle, rec.caller)
+		_, err := handle.WriteAt(rec.data, int64(rec.offset))
+		return err
+	}
+	return ErrInvalidImage
+}
@@ -0,0 +1,316 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+// dumpState captures every directory, file contents and the free memory of a filesystem
+func dumpState(t *testing.T, fileSys FileSystem) map[string]string {
+	state := map[string]string{}
+	err := fs.WalkDir(NewIOFS(fileSys), ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			state[path] = "<dir>"
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			state[path] = "<symlink>"
+			return nil
+		}
+		data, err := fs.ReadFile(NewIOFS(fileSys), path)
+		state[path] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state["<free>"] = strconv.Itoa(fileSys.GetAvailableMemory())
+	return state
+}
+
+// newTree returns a filesystem on a disk of size bytes holding tree, whose paths are created in order
+// along with their parents. A path ending with a slash is a directory, a value starting with "-> " is a
+// symlink to the rest of it and any other value is the contents of a file
+func newTree(t *testing.T, size int, tree map[string]string) FileSystem {
+	d, _ := disk.NewDisk(size, 10)
+	fileSys := NewFileSystem(d)
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, itemPath := range paths {
+		value := tree[itemPath]
+		if strings.HasSuffix(itemPath, "/") {
+			assert.Nil(t, fileSys.CreateDir(strings.TrimSuffix(itemPath, "/")), itemPath)
+			continue
+		}
+		if parent := path.Dir(itemPath); parent != "/" {
+			if err := fileSys.CreateDir(parent); err != ErrDirrAlreadyExist {
+				assert.Nil(t, err, parent)
+			}
+		}
+		if strings.HasPrefix(value, "-> ") {
+			assert.Nil(t, fileSys.Symlink(strings.TrimPrefix(value, "-> "), itemPath), itemPath)
+			continue
+		}
+		assert.Nil(t, fileSys.CreateFile(itemPath), itemPath)
+		if value != "" {
+			fl, _ := fileSys.OpenFile(itemPath)
+			assert.Nil(t, fileSys.WriteFile(fl, []byte(value)), itemPath)
+		}
+	}
+	return fileSys
+}
+
+// checkRoundTrip checkpoints fileSys and changes it, then checks the tree recovered by replaying the journal
+// and the one loaded from a save of the live tree against it. check may change restored, each restored tree
+// is checked once
+func checkRoundTrip(t *testing.T, fileSys FileSystem, change func(), check func(restored FileSystem)) {
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+	change()
+
+	recovered, err := Load(bytes.NewReader(image.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes())))
+	var saved, resaved bytes.Buffer
+	assert.Nil(t, fileSys.Save(&saved))
+	loaded, err := Load(bytes.NewReader(saved.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, loaded.Save(&resaved))
+	assert.Equal(t, saved.Bytes(), resaved.Bytes())
+	state := dumpState(t, fileSys)
+	for _, restored := range []FileSystem{recovered, loaded} {
+		assert.Equal(t, state, dumpState(t, restored))
+		check(restored)
+	}
+}
+
+var journalWorkload = []struct {
+	name string
+	run  func(fileSys FileSystem) error
+}{
+	{name: "create dir", run: func(fileSys FileSystem) error {
+		return fileSys.CreateDir("/var/log")
+	}},
+	{name: "create file", run: func(fileSys FileSystem) error {
+		return fileSys.CreateFile("/var/log/app.log")
+	}},
+	{name: "write file", run: func(fileSys FileSystem) error {
+		fl, _ := fileSys.OpenFile("/var/log/app.log")
+		return fileSys.WriteFile(fl, []byte("first entry\n"))
+	}},
+	{name: "append file", run: func(fileSys FileSystem) error {
+		fl, _ := fileSys.OpenFile("/var/log/app.log")
+		return fileSys.AppendFile(fl, []byte("second entry\n"))
+	}},
+	{name: "write at", run: func(fileSys FileSystem) error {
+		handle, _ := fileSys.OpenHandle("/home/notes.txt")
+		_, err := handle.WriteAt([]byte("NOTES"), 0)
+		return err
+	}},
+	{name: "failing write keeps the old contents", run: func(fileSys FileSystem) error {
+		fl, _ := fileSys.OpenFile("/home/notes.txt")
+		return fileSys.WriteFile(fl, make([]byte, 1000))
+	}},
+	{name: "rewrite file", run: func(fileSys FileSystem) error {
+		fl, _ := fileSys.OpenFile("/home/notes.txt")
+		return fileSys.WriteFile(fl, []byte("rewritten notes"))
+	}},
+	{name: "delete file", run: func(fileSys FileSystem) error {
+		return fileSys.DeleteFile("/home/old.txt")
+	}},
+	{name: "create another file", run: func(fileSys FileSystem) error {
+		return fileSys.CreateFile("/home/new.txt")
+	}},
+	{name: "reuse freed blocks", run: func(fileSys FileSystem) error {
+		fl, _ := fileSys.OpenFile("/home/new.txt")
+		return fileSys.WriteFile(fl, []byte("written over the blocks of old.txt"))
+	}},
+}
+
+func setupJournaled(t *testing.T, d disk.Disk) FileSystem {
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/home"))
+	for path, data := range map[string]string{"/home/notes.txt": "notes before the checkpoint", "/home/old.txt": "old file"} {
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, []byte(data)))
+	}
+	return fileSys
+}
+
+func TestJournalCrashAtEveryByte(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := setupJournaled(t, d)
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+
+	states := []map[string]string{dumpState(t, fileSys)}
+	boundaries := []int{0}
+	for _, op := range journalWorkload {
+		err := op.run(fileSys)
+		if op.name == "failing write keeps the old contents" {
+			assert.Equal(t, ErrFileCouldNotBeWritten, err)
+		} else {
+			assert.Nil(t, err, op.name)
+		}
+		states = append(states, dumpState(t, fileSys))
+		boundaries = append(boundaries, journal.Len())
+	}
+	assert.Equal(t, "NOTES before the checkpoint", states[6]["home/notes.txt"])
+
+	applied := 0
+	for cut := 0; cut <= journal.Len(); cut++ {
+		for applied+1 < len(boundaries) && boundaries[applied+1] <= cut {
+			applied++
+		}
+		recovered, err := Load(bytes.NewReader(image.Bytes()))
+		assert.Nil(t, err)
+		assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes()[:cut])))
+		assert.Equal(t, states[applied], dumpState(t, recovered), "crash after %d journal bytes", cut)
+	}
+}
+
+func TestJournalCrashWithFileDisk(t *testing.T) {
+	dir := t.TempDir()
+	diskPath := filepath.Join(dir, "disk.img")
+	d, err := disk.NewFileDisk(diskPath, 200, 10)
+	assert.Nil(t, err)
+	fileSys := setupJournaled(t, d)
+	var tree, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&tree, &journal))
+
+	//the disk file as it is after each mutation, a crash during the next one never touched it
+	diskImages := [][]byte{}
+	states := []map[string]string{dumpState(t, fileSys)}
+	boundaries := []int{0}
+	for _, op := range journalWorkload {
+		data, err := os.ReadFile(diskPath)
+		assert.Nil(t, err)
+		diskImages = append(diskImages, data)
+		_ = op.run(fileSys)
+		states = append(states, dumpState(t, fileSys))
+		boundaries = append(boundaries, journal.Len())
+	}
+	data, _ := os.ReadFile(diskPath)
+	diskImages = append(diskImages, data)
+	assert.Nil(t, d.Close())
+
+	for applied := range boundaries {
+		//with every record up to the cut complete, the last logged mutation may or may not have reached the disk
+		crashes := []struct {
+			cut       int
+			diskImage []byte
+		}{{boundaries[applied], diskImages[applied]}}
+		if applied > 0 {
+			crashes = append(crashes, struct {
+				cut       int
+				diskImage []byte
+			}{boundaries[applied], diskImages[applied-1]})
+		}
+		//a torn record belongs to a mutation that never started
+		if applied+1 < len(boundaries) {
+			crashes = append(crashes, struct {
+				cut       int
+				diskImage []byte
+			}{boundaries[applied] + recordHeaderSize + 1, diskImages[applied]})
+		}
+		for _, crash := range crashes {
+			crashPath := filepath.Join(dir, "crash.img")
+			assert.Nil(t, os.WriteFile(crashPath, crash.diskImage, 0644))
+			reopened, err := disk.OpenFileDisk(crashPath)
+			assert.Nil(t, err)
+			recovered, err := Mount(reopened, bytes.NewReader(tree.Bytes()))
+			assert.Nil(t, err)
+			assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes()[:crash.cut])))
+			assert.Equal(t, states[applied], dumpState(t, recovered), "crash after %d journal bytes", crash.cut)
+			assert.Nil(t, reopened.Close())
+			assert.Nil(t, os.Remove(crashPath))
+		}
+	}
+}
+
+func TestJournalResize(t *testing.T) {
+	d, _ := disk.NewDisk(100, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateFile("/small.txt"))
+	fl, _ := fileSys.OpenFile("/small.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, bytes.Repeat([]byte("s"), 30)))
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+
+	workload := []func() error{
+		func() error { return fileSys.Resize(300) },
+		func() error { return fileSys.CreateFile("/large.txt") },
+		func() error {
+			fl, _ := fileSys.OpenFile("/large.txt")
+			return fileSys.WriteFile(fl, bytes.Repeat([]byte("l"), 200))
+		},
+		func() error { return fileSys.Resize(230) },
+	}
+	states := []map[string]string{dumpState(t, fileSys)}
+	boundaries := []int{0}
+	for _, op := range workload {
+		assert.Nil(t, op())
+		states = append(states, dumpState(t, fileSys))
+		boundaries = append(boundaries, journal.Len())
+	}
+	//a resize the files do not fit in is logged, fails again on replay and leaves the disk as it is
+	assert.NotNil(t, fileSys.Resize(100))
+	assert.Equal(t, "0", states[len(states)-1]["<free>"])
+
+	applied := 0
+	for cut := 0; cut <= journal.Len(); cut++ {
+		for applied+1 < len(boundaries) && boundaries[applied+1] <= cut {
+			applied++
+		}
+		recovered, err := Load(bytes.NewReader(image.Bytes()))
+		assert.Nil(t, err)
+		assert.Nil(t, Replay(recovered, bytes.NewReader(journal.Bytes()[:cut])))
+		assert.Equal(t, states[applied], dumpState(t, recovered), "crash after %d journal bytes", cut)
+	}
+}
+
+type failingWriter struct {
+	budget int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.budget {
+		n := w.budget
+		w.budget = 0
+		return n, errors.New("device full")
+	}
+	w.budget -= len(p)
+	return len(p), nil
+}
+
+func TestJournalWriteFailure(t *testing.T) {
+	d, _ := disk.NewDisk(100, 10)
+	fileSys := NewJournaledFileSystem(d, &failingWriter{budget: 80})
+	assert.Nil(t, fileSys.CreateDir("/home"))
+	assert.NotNil(t, fileSys.CreateFile("/home/never-logged.txt"))
+	assert.Equal(t, ErrJournalClosed, fileSys.CreateDir("/tmp"))
+	_, err := fileSys.OpenFile("/home/never-logged.txt")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+
+	var image, journal bytes.Buffer
+	assert.Nil(t, fileSys.Checkpoint(&image, &journal))
+	assert.Nil(t, fileSys.CreateDir("/tmp"))
+}
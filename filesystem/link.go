@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"sort"
+	"strings"
+)
+
+// Link creates newPath as another name of the file at existing, both names refer to the same file
+// and its blocks are only released once every name is deleted. Directories cannot be linked, a symlink at
+// existing is followed and its target linked
+func (f *fileSystem) Link(existing string, newPath string) error {
+	return f.linkAs(Superuser, existing, newPath)
+}
+
+func (f *fileSystem) linkAs(caller Caller, existing string, newPath string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	oldLevels, err := f.resolvePath(caller, existing, true)
+	if err != nil {
+		return err
+	}
+	newLevels, err := f.resolvePath(caller, newPath, false)
+	if err != nil {
+		return err
+	}
+	if len(newLevels) == 0 {
+		return ErrDirrAlreadyExist
+	}
+	root := f.root.(*directory)
+	if err := f.checkParent(caller, newLevels); err != nil {
+		return err
+	}
+	var charge *quotaCharge
+	if source, err := root.lookup(oldLevels); err == nil {
+		fl, isFile := source.(*file)
+		if parent, err := root.findParentDir(newLevels); err == nil && isFile {
+			if charge, err = f.reserveLink(parent.(*directory), fl); err != nil {
+				return err
+			}
+		}
+	}
+	defer charge.settle(0, 0)
+	return f.logged(record{op: opLink, path: existing, data: []byte(newPath), caller: caller}, func() error {
+		source, err := root.lookup(oldLevels)
+		if err != nil {
+			return err
+		}
+		fl, ok := source.(*file)
+		if !ok {
+			return ErrIsDirectory
+		}
+		if err := root.link(newLevels, fl, &f.quotas); err != nil {
+			return err
+		}
+		f.notify(Event{Path: "/" + strings.Join(newLevels, "/"), Kind: EventCreate})
+		return nil
+	})
+}
+
+// findPath returns the path of a directory entry referring to fl, searching the whole tree
+func (f *fileSystem) findPath(fl *file) string {
+	path, _ := findPath(f.root.(*directory), "", fl)
+	return path
+}
+
+func findPath(dir *directory, dirPath string, target item) (string, bool) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	names := make([]string, 0, len(dir.contents))
+	for name := range dir.contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fsItem := dir.contents[name]
+		if fsItem == target {
+			return dirPath + "/" + name, true
+		}
+		if !fsItem.isFile() {
+			if path, found := findPath(fsItem.(*directory), dirPath+"/"+name, target); found {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package filesystem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var linkTree = map[string]string{
+	"/home/a.txt": "linked contents",
+	"/home/docs/": "",
+}
+
+func TestLink(t *testing.T) {
+	fileSys := newTree(t, 200, linkTree)
+	assert.Nil(t, fileSys.Link("/home/a.txt", "/home/docs/b.txt"))
+	free := fileSys.GetAvailableMemory()
+	info, _ := fileSys.Stat("/home/docs/b.txt")
+	assert.Equal(t, 2, info.Links)
+	//each link is known by its own name
+	assert.Equal(t, "b.txt", info.Name)
+	info, _ = fileSys.Stat("/home/a.txt")
+	assert.Equal(t, "a.txt", info.Name)
+
+	//both names refer to the same file
+	fl, _ := fileSys.OpenFile("/home/docs/b.txt")
+	assert.Nil(t, fileSys.AppendFile(fl, []byte(", appended")))
+	fl, _ = fileSys.OpenFile("/home/a.txt")
+	data, _ := fileSys.ReadFile(fl)
+	assert.Equal(t, "linked contents, appended", string(data))
+	free = fileSys.GetAvailableMemory()
+
+	assert.Equal(t, ErrFileAlreadyExist, fileSys.Link("/home/a.txt", "/home/docs/b.txt"))
+	assert.Equal(t, ErrDirrAlreadyExist, fileSys.Link("/home/a.txt", "/home/docs"))
+	assert.Equal(t, ErrIsDirectory, fileSys.Link("/home/docs", "/home/c"))
+	assert.Equal(t, ErrPathDoesNotExists, fileSys.Link("/home/missing.txt", "/home/c.txt"))
+	assert.Equal(t, ErrPathDoesNotExists, fileSys.Link("/home/a.txt", "/missing/c.txt"))
+
+	//the blocks are only released with the last link
+	assert.Nil(t, fileSys.DeleteFile("/home/a.txt"))
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+	info, _ = fileSys.Stat("/home/docs/b.txt")
+	assert.Equal(t, 1, info.Links)
+	assert.Equal(t, "/home/docs/b.txt", fl.getPath())
+	assert.Nil(t, fileSys.AppendFile(fl, []byte("!")))
+	assert.Nil(t, fileSys.DeleteFile("/home/docs/b.txt"))
+	assert.Equal(t, 200, fileSys.GetAvailableMemory())
+	assert.Equal(t, ErrFileDoesNotExist, fileSys.AppendFile(fl, []byte("!")))
+}
+
+func TestLinkRemoveAllRename(t *testing.T) {
+	fileSys := newTree(t, 200, linkTree)
+	assert.Nil(t, fileSys.Link("/home/a.txt", "/home/docs/b.txt"))
+	free := fileSys.GetAvailableMemory()
+	freed, err := fileSys.RemoveAll("/home/docs")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, freed)
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+
+	//renaming onto another link of the same file does nothing
+	assert.Nil(t, fileSys.Link("/home/a.txt", "/home/c.txt"))
+	assert.Nil(t, fileSys.Rename("/home/a.txt", "/home/c.txt"))
+	info, _ := fileSys.Stat("/home/a.txt")
+	assert.Equal(t, 2, info.Links)
+
+	//replacing a link drops it
+	assert.Nil(t, fileSys.CreateFile("/home/d.txt"))
+	assert.Nil(t, fileSys.Rename("/home/d.txt", "/home/c.txt"))
+	info, _ = fileSys.Stat("/home/a.txt")
+	assert.Equal(t, 1, info.Links)
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+}
+
+func TestLinkSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, linkTree)
+	assert.Nil(t, fileSys.Link("/home/a.txt", "/home/docs/b.txt"))
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.Link("/home/a.txt", "/home/c.txt"))
+		assert.Nil(t, fileSys.Snapshot("linked"))
+		assert.Nil(t, fileSys.DeleteFile("/home/a.txt"))
+	}, func(restored FileSystem) {
+		info, _ := restored.Stat("/home/c.txt")
+		assert.Equal(t, 2, info.Links)
+		//the snapshot keeps the three names of a single file
+		view, _ := restored.MountSnapshot("linked")
+		info, _ = view.Stat("/home/a.txt")
+		assert.Equal(t, 3, info.Links)
+		fl, _ := restored.OpenFile("/home/c.txt")
+		assert.Nil(t, restored.AppendFile(fl, []byte(", only fileSys")))
+		other, _ := restored.OpenFile("/home/docs/b.txt")
+		data, _ := restored.ReadFile(other)
+		assert.Equal(t, "linked contents, only fileSys", string(data))
+		fl, _ = view.OpenFile("/home/docs/b.txt")
+		data, _ = view.ReadFile(fl)
+		assert.Equal(t, "linked contents", string(data))
+		assert.Nil(t, restored.DeleteSnapshot("linked"))
+		assert.Nil(t, restored.DeleteFile("/home/c.txt"))
+		assert.Nil(t, restored.DeleteFile("/home/docs/b.txt"))
+		assert.Equal(t, 200, restored.GetAvailableMemory())
+	})
+}
@@ -0,0 +1,408 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// Caller is the identity operations run as, UID 0 is the superuser and passes every check
+type Caller struct {
+	UID    int
+	GID    int
+	Groups []int
+}
+
+var (
+	// Superuser is the caller a FileSystem runs as unless it is bound to another one with WithContext
+	Superuser = Caller{}
+	// Nobody is the caller used for contexts carrying no caller
+	Nobody = Caller{UID: 65534, GID: 65534}
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// the modes new files and directories are created with
+const (
+	defaultFileMode = fs.FileMode(0644)
+	defaultDirMode  = fs.FileMode(0755)
+)
+
+// the permission bits checked for an operation, shifted to the owner, group or other class of the item
+const (
+	permRead    = fs.FileMode(4)
+	permWrite   = fs.FileMode(2)
+	permExecute = fs.FileMode(1)
+)
+
+// permissions are the mode bits and owners of a file or directory. They only change while the
+// filesystem lock is held exclusively, so any operation holding it shared can read them without
+// taking the lock of the item
+type permissions struct {
+	mode fs.FileMode
+	uid  int
+	gid  int
+}
+
+type callerKey struct{}
+
+// ContextWithCaller returns a copy of ctx carrying caller, see FileSystem.WithContext
+func ContextWithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller carried by ctx
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+func (caller Caller) isSuperuser() bool {
+	return caller.UID == 0
+}
+
+func (caller Caller) inGroup(gid int) bool {
+	if caller.GID == gid {
+		return true
+	}
+	for _, group := range caller.Groups {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether caller holds every bit of want on an item with perm
+func (caller Caller) allowed(perm permissions, want fs.FileMode) bool {
+	if caller.isSuperuser() {
+		return true
+	}
+	granted := perm.mode
+	if caller.UID == perm.uid {
+		granted = perm.mode >> 6
+	} else if caller.inGroup(perm.gid) {
+		granted = perm.mode >> 3
+	}
+	return granted&want == want
+}
+
+func (caller Caller) check(perm permissions, want fs.FileMode) error {
+	if !caller.allowed(perm, want) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// checkParent checks caller may search down to the last level and add or remove entries in its directory.
+// A path that does not exist is left for the operation itself to report
+func (f *fileSystem) checkParent(caller Caller, levels []string) error {
+	if caller.isSuperuser() {
+		return nil
+	}
+	root := f.root.(*directory)
+	if err := root.search(levels, caller); err != nil {
+		return err
+	}
+	parent, err := root.findParentDir(levels)
+	if err != nil {
+		return nil
+	}
+	return caller.check(parent.(*directory).perm, permWrite|permExecute)
+}
+
+// checkRemovable checks caller may empty dir and every directory below it
+func checkRemovable(caller Caller, dir *directory) error {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	if len(dir.contents) == 0 {
+		return nil
+	}
+	if err := caller.check(dir.perm, permWrite|permExecute); err != nil {
+		return err
+	}
+	for _, fsItem := range dir.contents {
+		if fsItem.isFile() {
+			continue
+		}
+		if err := checkRemovable(caller, fsItem.(*directory)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chmod sets the permission bits of path, only its owner and the superuser may change them
+func (f *fileSystem) Chmod(path string, mode fs.FileMode) error {
+	return f.chmodAs(Superuser, path, mode)
+}
+
+func (f *fileSystem) chmodAs(caller Caller, path string, mode fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fsItem, err := f.lookupAs(caller, path, true)
+	if err != nil {
+		return err
+	}
+	perm := fsItem.getPermissions()
+	if !caller.isSuperuser() && caller.UID != perm.uid {
+		return ErrPermissionDenied
+	}
+	//the path is resolved before the new mode may stop the caller from searching it
+	eventPath := f.canonicalPath(caller, path, true)
+	return f.logged(record{op: opChmod, path: path, offset: int(mode.Perm()), caller: caller}, func() error {
+		perm.mode = mode.Perm()
+		fsItem.setPermissions(perm)
+		f.notify(Event{Path: eventPath, Kind: EventChmod})
+		return nil
+	})
+}
+
+// Chown sets the owner and group of path, a negative uid or gid leaves it unchanged. The superuser may set
+// both, the owner may only hand the item to one of its own groups
+func (f *fileSystem) Chown(path string, uid int, gid int) error {
+	return f.chownAs(Superuser, path, uid, gid)
+}
+
+func (f *fileSystem) chownAs(caller Caller, path string, uid int, gid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fsItem, err := f.lookupAs(caller, path, true)
+	if err != nil {
+		return err
+	}
+	perm := fsItem.getPermissions()
+	if uid < 0 {
+		uid = perm.uid
+	}
+	if gid < 0 {
+		gid = perm.gid
+	}
+	if !caller.isSuperuser() && (caller.UID != perm.uid || uid != perm.uid || !caller.inGroup(gid)) {
+		return ErrPermissionDenied
+	}
+	eventPath := f.canonicalPath(caller, path, true)
+	return f.logged(record{op: opChown, path: path, uid: uid, gid: gid, caller: caller}, func() error {
+		f.quotas.chowned(perm.uid, uid, itemSize(fsItem))
+		perm.uid, perm.gid = uid, gid
+		fsItem.setPermissions(perm)
+		f.notify(Event{Path: eventPath, Kind: EventChmod})
+		return nil
+	})
+}
+
+// lookupAs returns the item at path, "/" being the root directory, once caller was allowed to search its way to it.
+// A symlink at the end of path is followed when follow is set
+func (f *fileSystem) lookupAs(caller Caller, path string, follow bool) (item, error) {
+	var structure []string
+	if path != "/" {
+		var err error
+		structure, err = f.resolvePath(caller, path, follow)
+		if err != nil {
+			return nil, err
+		}
+	}
+	root := f.root.(*directory)
+	if err := root.search(structure, caller); err != nil {
+		return nil, err
+	}
+	return root.lookup(structure)
+}
+
+// WithContext returns a FileSystem running every operation as the caller carried by ctx, or as Nobody
+// when ctx carries none. Only the superuser can switch to another caller, for anyone else the
+// returned FileSystem keeps running as the current caller
+func (f *fileSystem) WithContext(ctx context.Context) FileSystem {
+	caller, ok := CallerFromContext(ctx)
+	if !ok {
+		caller = Nobody
+	}
+	if caller.isSuperuser() {
+		return f
+	}
+	return &callerFileSystem{fileSystem: f, caller: caller}
+}
+
+// callerFileSystem is the view returned by WithContext, operations on the tree are checked against
+// the permissions of caller and everything else but reading the free memory and the snapshot names
+// is left to the superuser
+type callerFileSystem struct {
+	*fileSystem
+	caller Caller
+}
+
+func (view *callerFileSystem) WithContext(ctx context.Context) FileSystem {
+	return view
+}
+
+func (view *callerFileSystem) CreateDir(path string) error {
+	return view.fileSystem.createDirAs(view.caller, path)
+}
+
+func (view *callerFileSystem) WriteFile(fileHandle File, data []byte) error {
+	return view.fileSystem.writeFileAs(view.caller, fileHandle, data)
+}
+
+func (view *callerFileSystem) AppendFile(fileHandle File, data []byte) error {
+	return view.fileSystem.appendFileAs(view.caller, fileHandle, data)
+}
+
+func (view *callerFileSystem) ReadFile(fileHandle File) ([]byte, error) {
+	return view.fileSystem.readFileAs(view.caller, fileHandle)
+}
+
+func (view *callerFileSystem) CreateFile(path string) error {
+	return view.fileSystem.createFileAs(view.caller, path)
+}
+
+func (view *callerFileSystem) OpenFile(path string) (File, error) {
+	return view.fileSystem.openFileAs(view.caller, path)
+}
+
+func (view *callerFileSystem) OpenHandle(path string) (*Handle, error) {
+	return view.fileSystem.openHandleAs(view.caller, path)
+}
+
+func (view *callerFileSystem) OpenByID(ino uint64) (*Handle, error) {
+	return view.fileSystem.openByIDAs(view.caller, ino)
+}
+
+func (view *callerFileSystem) ListDir(path string) ([]string, error) {
+	return view.fileSystem.listDirAs(view.caller, path)
+}
+
+func (view *callerFileSystem) ReadDir(path string, opts ReadDirOptions) ([]DirEntry, string, error) {
+	return view.fileSystem.readDirAs(view.caller, path, opts)
+}
+
+func (view *callerFileSystem) Walk(root string, fn WalkFunc) error {
+	return view.fileSystem.walkAs(view.caller, root, fn)
+}
+
+func (view *callerFileSystem) Glob(pattern string) ([]string, error) {
+	return view.fileSystem.globAs(view.caller, pattern)
+}
+
+func (view *callerFileSystem) Stat(path string) (*FileInfo, error) {
+	return view.fileSystem.statAs(view.caller, path, true)
+}
+
+func (view *callerFileSystem) Lstat(path string) (*FileInfo, error) {
+	return view.fileSystem.statAs(view.caller, path, false)
+}
+
+func (view *callerFileSystem) DeleteFile(path string, opts ...PathOption) error {
+	return view.fileSystem.deleteFileAs(view.caller, path, follows(opts))
+}
+
+func (view *callerFileSystem) Link(existing string, newPath string) error {
+	return view.fileSystem.linkAs(view.caller, existing, newPath)
+}
+
+func (view *callerFileSystem) Symlink(target string, linkPath string) error {
+	return view.fileSystem.symlinkAs(view.caller, target, linkPath)
+}
+
+func (view *callerFileSystem) Readlink(path string) (string, error) {
+	return view.fileSystem.readlinkAs(view.caller, path)
+}
+
+func (view *callerFileSystem) Rename(oldPath string, newPath string) error {
+	return view.fileSystem.renameAs(view.caller, oldPath, newPath)
+}
+
+func (view *callerFileSystem) RemoveDir(path string) error {
+	return view.fileSystem.removeDirAs(view.caller, path)
+}
+
+func (view *callerFileSystem) RemoveAll(path string) (int, error) {
+	return view.fileSystem.removeAllAs(view.caller, path)
+}
+
+func (view *callerFileSystem) Chmod(path string, mode fs.FileMode) error {
+	return view.fileSystem.chmodAs(view.caller, path, mode)
+}
+
+func (view *callerFileSystem) Chown(path string, uid int, gid int) error {
+	return view.fileSystem.chownAs(view.caller, path, uid, gid)
+}
+
+func (view *callerFileSystem) Save(w io.Writer) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) SaveTree(w io.Writer) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) Checkpoint(image io.Writer, journal io.Writer) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) Defragment(ctx context.Context, progress func(disk.DefragmentProgress)) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) Resize(size int) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) Watch(path string, recursive bool) (*Watcher, error) {
+	return view.fileSystem.watchAs(view.caller, path, recursive)
+}
+
+func (view *callerFileSystem) SetXattr(path string, name string, value []byte) error {
+	return view.fileSystem.setXattrAs(view.caller, path, name, value)
+}
+
+func (view *callerFileSystem) GetXattr(path string, name string) ([]byte, error) {
+	return view.fileSystem.getXattrAs(view.caller, path, name)
+}
+
+func (view *callerFileSystem) ListXattr(path string) ([]string, error) {
+	return view.fileSystem.listXattrAs(view.caller, path)
+}
+
+func (view *callerFileSystem) RemoveXattr(path string, name string) error {
+	return view.fileSystem.removeXattrAs(view.caller, path, name)
+}
+
+func (view *callerFileSystem) SetDirQuota(path string, limit Quota) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) SetUserQuota(uid int, limit Quota) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) SetMaxSymlinkDepth(depth int) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) SetMaxInodes(max int) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) Snapshot(name string) error {
+	return ErrPermissionDenied
+}
+
+func (view *callerFileSystem) MountSnapshot(name string) (FileSystem, error) {
+	return nil, ErrPermissionDenied
+}
+
+func (view *callerFileSystem) DiffSnapshots(from string, to string) ([]Change, error) {
+	return nil, ErrPermissionDenied
+}
+
+func (view *callerFileSystem) DeleteSnapshot(name string) error {
+	return ErrPermissionDenied
+}
+
+// owner returns the permissions carrying the owners of the items caller creates
+func (caller Caller) owner() permissions {
+	return permissions{uid: caller.UID, gid: caller.GID}
+}
@@ -0,0 +1,153 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	alice = Caller{UID: 1000, GID: 1000}
+	bob   = Caller{UID: 1001, GID: 1001, Groups: []int{1000}}
+	eve   = Caller{UID: 1002, GID: 1002}
+)
+
+func as(fileSys FileSystem, caller Caller) FileSystem {
+	return fileSys.WithContext(ContextWithCaller(context.Background(), caller))
+}
+
+// setupPermissions gives alice a home directory holding a private and a group readable file
+func setupPermissions(t *testing.T, fileSys FileSystem) {
+	assert.Nil(t, fileSys.CreateDir("/home/alice"))
+	assert.Nil(t, fileSys.Chown("/home/alice", alice.UID, alice.GID))
+	aliceFs := as(fileSys, alice)
+	for path, mode := range map[string]fs.FileMode{"/home/alice/private.txt": 0600, "/home/alice/shared.txt": 0640} {
+		assert.Nil(t, aliceFs.CreateFile(path))
+		fl, err := aliceFs.OpenFile(path)
+		assert.Nil(t, err)
+		assert.Nil(t, aliceFs.WriteFile(fl, []byte("alice wrote this")))
+		assert.Nil(t, aliceFs.Chmod(path, mode))
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	aliceFs, bobFs, eveFs := as(fileSys, alice), as(fileSys, bob), as(fileSys, eve)
+
+	info, err := fileSys.Stat("/home/alice/shared.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0640), info.Mode)
+	assert.Equal(t, alice.UID, info.UID)
+	assert.Equal(t, alice.GID, info.GID)
+
+	//the owner reads and writes, the group reads, others get nothing
+	fl, err := bobFs.OpenFile("/home/alice/shared.txt")
+	assert.Nil(t, err)
+	data, err := bobFs.ReadFile(fl)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice wrote this", string(data))
+	assert.Equal(t, ErrPermissionDenied, bobFs.WriteFile(fl, []byte("bob")))
+	assert.Equal(t, ErrPermissionDenied, bobFs.AppendFile(fl, []byte("bob")))
+	_, err = bobFs.OpenFile("/home/alice/private.txt")
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = eveFs.OpenFile("/home/alice/shared.txt")
+	assert.Equal(t, ErrPermissionDenied, err)
+	fl, _ = fileSys.OpenFile("/home/alice/private.txt")
+	_, err = eveFs.ReadFile(fl)
+	assert.Equal(t, ErrPermissionDenied, err)
+
+	//creating and deleting need write access to the directory
+	assert.Equal(t, ErrPermissionDenied, bobFs.CreateFile("/home/alice/bob.txt"))
+	assert.Equal(t, ErrPermissionDenied, bobFs.DeleteFile("/home/alice/shared.txt"))
+	assert.Equal(t, ErrPermissionDenied, bobFs.CreateDir("/home/bob"))
+	assert.Equal(t, ErrPermissionDenied, bobFs.Rename("/home/alice/shared.txt", "/tmp.txt"))
+	_, err = bobFs.RemoveAll("/home/alice")
+	assert.Equal(t, ErrPermissionDenied, err)
+	assert.Nil(t, aliceFs.CreateDir("/home/alice/docs/drafts"))
+	info, _ = fileSys.Stat("/home/alice/docs/drafts")
+	assert.Equal(t, alice.UID, info.UID)
+
+	//listing needs read access, walking through a directory needs execute access
+	entries, err := eveFs.ListDir("/home/alice")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Nil(t, aliceFs.Chmod("/home/alice", 0710))
+	_, err = eveFs.ListDir("/home/alice")
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = eveFs.Stat("/home/alice/shared.txt")
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = bobFs.ListDir("/home/alice")
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = bobFs.Stat("/home/alice/shared.txt")
+	assert.Nil(t, err)
+
+	//only the owner changes the mode, and it can only hand the item to one of its groups
+	assert.Equal(t, ErrPermissionDenied, bobFs.Chmod("/home/alice/shared.txt", 0666))
+	assert.Equal(t, ErrPermissionDenied, aliceFs.Chown("/home/alice/shared.txt", bob.UID, -1))
+	assert.Equal(t, ErrPermissionDenied, aliceFs.Chown("/home/alice/shared.txt", -1, bob.GID))
+	assert.Equal(t, ErrPermissionDenied, bobFs.Chown("/home/alice/shared.txt", -1, bob.GID))
+	assert.Nil(t, aliceFs.Chown("/home/alice/shared.txt", -1, alice.GID))
+	assert.Nil(t, fileSys.Chown("/home/alice/shared.txt", bob.UID, bob.GID))
+	fl, _ = bobFs.OpenFile("/home/alice/shared.txt")
+	assert.Nil(t, bobFs.WriteFile(fl, []byte("bob owns it now")))
+
+	//handles check every read and write
+	handle, err := aliceFs.OpenHandle("/home/alice/private.txt")
+	assert.Nil(t, err)
+	assert.Nil(t, aliceFs.Chmod("/home/alice/private.txt", 0400))
+	_, err = handle.Write([]byte("x"))
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = handle.Read(make([]byte, 5))
+	assert.Nil(t, err)
+
+	//everything but the tree is left to the superuser
+	assert.Equal(t, ErrPermissionDenied, aliceFs.Snapshot("mine"))
+	assert.Equal(t, ErrPermissionDenied, aliceFs.Save(&bytes.Buffer{}))
+	assert.Equal(t, eveFs, eveFs.WithContext(ContextWithCaller(context.Background(), Superuser)))
+	assert.Equal(t, fileSys, fileSys.WithContext(ContextWithCaller(context.Background(), Superuser)))
+	nobodyFs := fileSys.WithContext(context.Background())
+	assert.Equal(t, ErrPermissionDenied, nobodyFs.CreateFile("/nobody.txt"))
+}
+
+func TestPermissionsIOFS(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	info, err := fs.Stat(NewIOFS(fileSys), "home/alice/private.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode())
+
+	bobIOFS := NewIOFS(as(fileSys, bob))
+	data, err := fs.ReadFile(bobIOFS, "home/alice/shared.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice wrote this", string(data))
+	_, err = fs.ReadFile(bobIOFS, "home/alice/private.txt")
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+	assert.Nil(t, fileSys.Chmod("/home/alice", 0700))
+	_, err = fs.ReadDir(bobIOFS, "home/alice")
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+}
+
+func TestPermissionsSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, nil)
+	checkRoundTrip(t, fileSys, func() {
+		setupPermissions(t, fileSys)
+		//a denied mutation is never logged
+		fl, _ := fileSys.OpenFile("/home/alice/shared.txt")
+		assert.Equal(t, ErrPermissionDenied, as(fileSys, bob).WriteFile(fl, []byte("bob")))
+	}, func(restored FileSystem) {
+		for _, path := range []string{"/home/alice", "/home/alice/private.txt", "/home/alice/shared.txt"} {
+			want, _ := fileSys.Stat(path)
+			got, err := restored.Stat(path)
+			assert.Nil(t, err)
+			assert.Equal(t, []interface{}{want.Mode, want.UID, want.GID}, []interface{}{got.Mode, got.UID, got.GID}, path)
+		}
+	})
+}
@@ -0,0 +1,589 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Quotas are only set while the filesystem lock is held exclusively. Usage is kept in running counters,
+// added up when a quota is set or a tree is loaded and updated by every operation changing it. An operation
+// growing a quota first reserves its growth, so that two of them cannot both take the last of a limit,
+// and settles it once applied. A file linked under several names is charged once.
+// Creating files, directories and symlinks, writing to files and linking or renaming into a directory
+// quota are checked
+var (
+	ErrQuotaExceeded = errors.New("the quota is exceeded")
+	ErrInvalidQuota  = errors.New("the quota limits cannot be negative")
+)
+
+// Quota limits the bytes stored in files and the number of inodes (files, directories and symlinks),
+// either below a directory or owned by a user. A zero limit is no limit
+type Quota struct {
+	MaxBytes  int
+	MaxInodes int
+}
+
+// QuotaUsage reports what a quota is charged with against its limit, Path is set for a directory quota
+// and UID for a user quota
+type QuotaUsage struct {
+	Path   string
+	UID    int
+	Limit  Quota
+	Bytes  int
+	Inodes int
+}
+
+// SetDirQuota limits what the directory at path and everything below it may hold, the directory itself
+// is not charged. A zero Quota removes the limit. The quota stays with the directory when it is renamed
+func (f *fileSystem) SetDirQuota(path string, limit Quota) error {
+	if limit.MaxBytes < 0 || limit.MaxInodes < 0 {
+		return ErrInvalidQuota
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fsItem, err := f.lookupAs(Superuser, path, true)
+	if err != nil {
+		return err
+	}
+	dir, ok := fsItem.(*directory)
+	if !ok {
+		return ErrNotDirectory
+	}
+	return f.logged(record{op: opSetDirQuota, path: path, data: encodeQuota(limit)}, func() error {
+		if limit == (Quota{}) {
+			f.dropQuota(dir)
+			return nil
+		}
+		if f.dirQuotas == nil {
+			f.dirQuotas = map[*directory]Quota{}
+		}
+		if _, exist := f.dirQuotas[dir]; !exist {
+			f.quotas.setDir(dir, dirUsage(dir))
+		}
+		f.dirQuotas[dir] = limit
+		return nil
+	})
+}
+
+// SetUserQuota limits what the items owned by uid may hold across the tree, a zero Quota removes the limit
+func (f *fileSystem) SetUserQuota(uid int, limit Quota) error {
+	if limit.MaxBytes < 0 || limit.MaxInodes < 0 {
+		return ErrInvalidQuota
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logged(record{op: opSetUserQuota, uid: uid, data: encodeQuota(limit)}, func() error {
+		if limit == (Quota{}) {
+			delete(f.userQuotas, uid)
+			f.quotas.setUser(uid, nil)
+			return nil
+		}
+		if f.userQuotas == nil {
+			f.userQuotas = map[int]Quota{}
+		}
+		if _, exist := f.userQuotas[uid]; !exist {
+			f.quotas.setUser(uid, userUsage(f.root.(*directory), uid))
+		}
+		f.userQuotas[uid] = limit
+		return nil
+	})
+}
+
+// Quotas reports the usage of every quota, directory quotas sorted by path first then user quotas sorted by uid
+func (f *fileSystem) Quotas() []QuotaUsage {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	usages := make([]QuotaUsage, 0, len(f.dirQuotas)+len(f.userQuotas))
+	paths := make(map[*directory]string, len(f.dirQuotas))
+	for dir := range f.dirQuotas {
+		paths[dir] = f.dirPath(dir)
+	}
+	uids := make([]int, 0, len(f.userQuotas))
+	for uid := range f.userQuotas {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+
+	f.quotas.mu.Lock()
+	defer f.quotas.mu.Unlock()
+	for dir, limit := range f.dirQuotas {
+		usage := f.quotas.dirs[dir]
+		usages = append(usages, QuotaUsage{Path: paths[dir], Limit: limit, Bytes: usage.bytes, Inodes: usage.inodes})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Path < usages[j].Path
+	})
+	for _, uid := range uids {
+		usage := f.quotas.users[uid]
+		usages = append(usages, QuotaUsage{UID: uid, Limit: f.userQuotas[uid], Bytes: usage.bytes, Inodes: usage.inodes})
+	}
+	return usages
+}
+
+// indexQuotas adds up the usage of every quota of a tree just read, before the filesystem is shared
+func (f *fileSystem) indexQuotas() {
+	for dir := range f.dirQuotas {
+		f.quotas.setDir(dir, dirUsage(dir))
+	}
+	for uid := range f.userQuotas {
+		f.quotas.setUser(uid, userUsage(f.root.(*directory), uid))
+	}
+}
+
+// reserveQuota checks every quota charged for at, a file being written or a directory items are created
+// in, and for uid, the owner of the bytes and inodes the operation grows, and charges them with the growth.
+// The returned charge, nil without any quota, must be settled once the operation is applied.
+// Callers hold f.mu shared and no lock of any item
+func (f *fileSystem) reserveQuota(at item, uid int, grownBytes int, grownInodes int) (*quotaCharge, error) {
+	if len(f.dirQuotas) == 0 && len(f.userQuotas) == 0 {
+		return nil, nil
+	}
+	table := &f.quotas
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	charge := &quotaCharge{table: table, at: at, uid: uid, bytes: grownBytes, inodes: grownInodes}
+	for dir, limit := range f.dirQuotas {
+		usage := table.dirs[dir]
+		if !usage.holds(at) {
+			continue
+		}
+		if limit.exceeded(usage, grownBytes, grownInodes) {
+			return nil, ErrQuotaExceeded
+		}
+		charge.usages = append(charge.usages, usage)
+	}
+	if limit, exist := f.userQuotas[uid]; exist {
+		usage := table.users[uid]
+		if limit.exceeded(usage, grownBytes, grownInodes) {
+			return nil, ErrQuotaExceeded
+		}
+		charge.usages = append(charge.usages, usage)
+	}
+	for _, usage := range charge.usages {
+		usage.bytes += grownBytes
+		usage.inodes += grownInodes
+	}
+	return charge, nil
+}
+
+// reserveLink checks the directory quotas holding parent against a new entry in it for fl, and charges
+// those the entry grows with the size of fl. The returned charge, nil without any directory quota, is
+// settled with nothing once the link is applied, linking charges the quotas itself.
+// Callers hold f.mu shared and no lock of any item
+func (f *fileSystem) reserveLink(parent *directory, fl *file) (*quotaCharge, error) {
+	if len(f.dirQuotas) == 0 {
+		return nil, nil
+	}
+	size := itemSize(fl)
+	added := &tally{links: map[*file]int{fl: 1}, sizes: map[*file]int{fl: size}}
+	table := &f.quotas
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	charge := &quotaCharge{table: table, uid: -1, bytes: size, inodes: 1}
+	for dir, limit := range f.dirQuotas {
+		usage := table.dirs[dir]
+		if !usage.dirs[parent] {
+			continue
+		}
+		if _, grownInodes := usage.growth(added, nil); grownInodes == 0 {
+			continue
+		}
+		if limit.exceeded(usage, size, 1) {
+			return nil, ErrQuotaExceeded
+		}
+		charge.usages = append(charge.usages, usage)
+	}
+	for _, usage := range charge.usages {
+		usage.bytes += size
+		usage.inodes++
+	}
+	return charge, nil
+}
+
+// checkMove checks the directory quotas holding to but not from against the items counted by moved entering
+// them in place of those counted by replaced, nil when nothing is replaced. User quotas are left alone, the
+// items keep their owner. Callers hold f.mu exclusively, so no growth is reserved meanwhile
+func (f *fileSystem) checkMove(from *directory, to *directory, moved *tally, replaced *tally) error {
+	table := &f.quotas
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for dir, limit := range f.dirQuotas {
+		usage := table.dirs[dir]
+		if usage.dirs[from] || !usage.dirs[to] {
+			continue
+		}
+		if grownBytes, grownInodes := usage.growth(moved, replaced); limit.exceeded(usage, grownBytes, grownInodes) {
+			return ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// exceeded reports whether growing usage goes over a limit, an operation that does not grow what a limit
+// counts passes even when the quota is already over it
+func (limit Quota) exceeded(usage *quotaUsage, grownBytes int, grownInodes int) bool {
+	return (limit.MaxBytes > 0 && grownBytes > 0 && usage.bytes+grownBytes > limit.MaxBytes) ||
+		(limit.MaxInodes > 0 && grownInodes > 0 && usage.inodes+grownInodes > limit.MaxInodes)
+}
+
+// fileGrowth returns the bytes a write of size bytes at off grows fl by, the write settles what it really grew
+func fileGrowth(fl File, off int, size int) int {
+	fl.getLock().RLock()
+	defer fl.getLock().RUnlock()
+	if grown := off + size - fl.getSize(); grown > 0 {
+		return grown
+	}
+	return 0
+}
+
+// quotaCharge is the growth an operation reserved from the quotas it was charged for
+type quotaCharge struct {
+	table  *quotaTable
+	at     item
+	uid    int
+	usages []*quotaUsage
+	bytes  int
+	inodes int
+}
+
+// settle replaces the reserved growth with the bytes and inodes the operation really grew, zero when it
+// failed, charged to the quotas at and uid count for now. Writers settle under the lock of the file
+func (charge *quotaCharge) settle(bytes int, inodes int) {
+	if charge == nil {
+		return
+	}
+	table := charge.table
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, usage := range charge.usages {
+		usage.bytes -= charge.bytes
+		usage.inodes -= charge.inodes
+	}
+	for _, usage := range table.dirs {
+		if usage.holds(charge.at) {
+			usage.bytes += bytes
+			usage.inodes += inodes
+		}
+	}
+	if usage, exist := table.users[charge.uid]; exist {
+		usage.bytes += bytes
+		usage.inodes += inodes
+	}
+}
+
+// quotaTable keeps the usage of every directory quota and every user quota up to date as the tree
+// changes, so that checking a quota walks nothing. It guards its fields with mu, taken last like the
+// lock of the inode table, under the lock of any directory or file and never across a disk operation.
+// Usages are only added and dropped while the filesystem lock is held exclusively
+type quotaTable struct {
+	mu    sync.Mutex
+	dirs  map[*directory]*quotaUsage
+	users map[int]*quotaUsage
+}
+
+// quotaUsage is what a quota is charged with, the growth reserved by the operations in flight included.
+// A directory quota also knows the directories below it, its own included, and how many entries below
+// it refer to each file, so that a file linked under several names is charged once
+type quotaUsage struct {
+	bytes  int
+	inodes int
+	dirs   map[*directory]bool
+	files  map[*file]int
+}
+
+// holds reports whether a directory quota is charged for at, a file below it or a directory it contains
+func (usage *quotaUsage) holds(at item) bool {
+	switch at := at.(type) {
+	case *file:
+		return usage.files[at] > 0
+	case *directory:
+		return usage.dirs[at]
+	}
+	return false
+}
+
+// growth returns the bytes and inodes usage grows by when the items counted by added enter it in place of
+// those counted by replaced, nil when nothing is replaced. A file already charged only adds an entry
+func (usage *quotaUsage) growth(added *tally, replaced *tally) (int, int) {
+	links := make(map[*file]int, len(added.links))
+	for fl, n := range added.links {
+		links[fl] += n
+	}
+	grownBytes, grownInodes := 0, added.others
+	if replaced != nil {
+		for fl, n := range replaced.links {
+			links[fl] -= n
+		}
+		grownInodes -= replaced.others
+	}
+	for fl, n := range links {
+		before := usage.files[fl]
+		switch {
+		case before == 0 && n > 0:
+			grownBytes += added.sizes[fl]
+			grownInodes++
+		case before > 0 && before+n == 0:
+			grownBytes -= replaced.sizes[fl]
+			grownInodes--
+		}
+	}
+	return grownBytes, grownInodes
+}
+
+// add charges usage with the items counted by t, or refunds them when sign is negative
+func (usage *quotaUsage) add(t *tally, sign int) {
+	for dir := range t.dirs {
+		if sign > 0 {
+			usage.dirs[dir] = true
+		} else {
+			delete(usage.dirs, dir)
+		}
+	}
+	for fl, links := range t.links {
+		before := usage.files[fl]
+		usage.files[fl] += sign * links
+		if before == 0 || usage.files[fl] == 0 {
+			usage.bytes += sign * t.sizes[fl]
+			usage.inodes += sign
+		}
+		if usage.files[fl] == 0 {
+			delete(usage.files, fl)
+		}
+	}
+	usage.inodes += sign * t.others
+}
+
+func (table *quotaTable) setDir(dir *directory, usage *quotaUsage) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if usage == nil {
+		delete(table.dirs, dir)
+		return
+	}
+	if table.dirs == nil {
+		table.dirs = map[*directory]*quotaUsage{}
+	}
+	table.dirs[dir] = usage
+}
+
+func (table *quotaTable) setUser(uid int, usage *quotaUsage) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if usage == nil {
+		delete(table.users, uid)
+		return
+	}
+	if table.users == nil {
+		table.users = map[int]*quotaUsage{}
+	}
+	table.users[uid] = usage
+}
+
+// created adds an item created in parent to the directory quotas holding parent, the operation creating
+// it charges its inode when it settles. Callers hold the lock of parent
+func (table *quotaTable) created(parent *directory, fsItem item) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, usage := range table.dirs {
+		if !usage.dirs[parent] {
+			continue
+		}
+		switch fsItem := fsItem.(type) {
+		case *file:
+			usage.files[fsItem]++
+		case *directory:
+			usage.dirs[fsItem] = true
+		}
+	}
+}
+
+// linked charges the directory quotas holding parent with an entry for fl added to it, size being the
+// size of fl. Callers hold the locks of parent and fl
+func (table *quotaTable) linked(parent *directory, fl *file, size int) {
+	table.moved(nil, parent, &tally{links: map[*file]int{fl: 1}, sizes: map[*file]int{fl: size}})
+}
+
+// unlinked refunds the directory quotas holding parent for an entry removed from it, size being the size
+// of the file it referred to. Callers hold the lock of parent and the one of the file
+func (table *quotaTable) unlinked(parent *directory, fsItem item, size int) {
+	t := &tally{uid: -1}
+	switch fsItem := fsItem.(type) {
+	case *file:
+		t.links, t.sizes = map[*file]int{fsItem: 1}, map[*file]int{fsItem: size}
+	case *directory:
+		t.dirs, t.others = map[*directory]bool{fsItem: true}, 1
+	case *symlink:
+		t.others = 1
+	}
+	table.moved(parent, nil, t)
+}
+
+// moved moves the items counted by t from below from to below to, either being nil for items entering or
+// leaving the tree. The directory quotas holding only one of them are charged or refunded
+func (table *quotaTable) moved(from *directory, to *directory, t *tally) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, usage := range table.dirs {
+		switch wasIn, isIn := from != nil && usage.dirs[from], to != nil && usage.dirs[to]; {
+		case wasIn && !isIn:
+			usage.add(t, -1)
+		case isIn && !wasIn:
+			usage.add(t, 1)
+		}
+	}
+}
+
+// removed refunds the quota of the owner of an item gone from the tree for good, size being the bytes of
+// a file when its last link was dropped
+func (table *quotaTable) removed(fsItem item, size int) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if usage, exist := table.users[fsItem.getPermissions().uid]; exist {
+		usage.bytes -= size
+		usage.inodes--
+	}
+}
+
+// chowned moves an item of size bytes from the quota of its previous owner to the one of its new owner
+func (table *quotaTable) chowned(from int, to int, size int) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if usage, exist := table.users[from]; exist {
+		usage.bytes -= size
+		usage.inodes--
+	}
+	if usage, exist := table.users[to]; exist {
+		usage.bytes += size
+		usage.inodes++
+	}
+}
+
+// itemSize returns the bytes fsItem is charged with, the size of a file and nothing for anything else
+func itemSize(fsItem item) int {
+	fl, ok := fsItem.(*file)
+	if !ok {
+		return 0
+	}
+	fl.mu.RLock()
+	defer fl.mu.RUnlock()
+	return fl.info.Size()
+}
+
+// tally counts part of the tree: its directories, the entries referring to each file and the size of each
+// file, and the directories and symlinks in it as others. Only items owned by uid are counted, anyone's
+// when uid is negative
+type tally struct {
+	uid    int
+	dirs   map[*directory]bool
+	links  map[*file]int
+	sizes  map[*file]int
+	others int
+}
+
+func newTally(uid int) *tally {
+	return &tally{uid: uid, dirs: map[*directory]bool{}, links: map[*file]int{}, sizes: map[*file]int{}}
+}
+
+// dirUsage adds up what a directory quota on dir is charged with, dir itself is held but not counted
+func dirUsage(dir *directory) *quotaUsage {
+	t := newTally(-1)
+	t.dir(dir)
+	return t.usage()
+}
+
+// userUsage adds up what the items owned by uid below root hold
+func userUsage(root *directory, uid int) *quotaUsage {
+	t := newTally(uid)
+	t.dir(root)
+	return t.usage()
+}
+
+// subtree counts fsItem and everything below it
+func subtree(fsItem item) *tally {
+	t := newTally(-1)
+	t.add(fsItem)
+	return t
+}
+
+func (t *tally) usage() *quotaUsage {
+	usage := &quotaUsage{dirs: t.dirs, files: t.links, inodes: len(t.links) + t.others}
+	for _, size := range t.sizes {
+		usage.bytes += size
+	}
+	return usage
+}
+
+func (t *tally) add(fsItem item) {
+	switch fsItem := fsItem.(type) {
+	case *file:
+		if !t.owns(fsItem) {
+			return
+		}
+		if t.links[fsItem] == 0 {
+			t.sizes[fsItem] = itemSize(fsItem)
+		}
+		t.links[fsItem]++
+	case *directory:
+		if t.owns(fsItem) {
+			t.others++
+		}
+		t.dir(fsItem)
+	case *symlink:
+		if t.owns(fsItem) {
+			t.others++
+		}
+	}
+}
+
+func (t *tally) dir(dir *directory) {
+	t.dirs[dir] = true
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	for _, fsItem := range dir.contents {
+		t.add(fsItem)
+	}
+}
+
+func (t *tally) owns(fsItem item) bool {
+	return t.uid < 0 || fsItem.getPermissions().uid == t.uid
+}
+
+// dropQuota forgets the quota of a directory removed from the tree, callers hold f.mu exclusively
+func (f *fileSystem) dropQuota(dir *directory) {
+	delete(f.dirQuotas, dir)
+	f.quotas.setDir(dir, nil)
+}
+
+// dirPath returns the path of dir in the tree, "/" for the root directory
+func (f *fileSystem) dirPath(dir *directory) string {
+	root := f.root.(*directory)
+	if dir == root {
+		return "/"
+	}
+	path, _ := findPath(root, "", dir)
+	return path
+}
+
+func encodeQuota(limit Quota) []byte {
+	var buffer bytes.Buffer
+	enc := &encoder{w: &buffer}
+	enc.writeQuota(limit)
+	return buffer.Bytes()
+}
+
+func decodeQuota(data []byte) (Quota, error) {
+	dec := &decoder{r: bytes.NewReader(data)}
+	limit := dec.readQuota()
+	return limit, dec.err
+}
+
+func (enc *encoder) writeQuota(limit Quota) {
+	enc.writeInt(limit.MaxBytes)
+	enc.writeInt(limit.MaxInodes)
+}
+
+func (dec *decoder) readQuota() Quota {
+	return Quota{MaxBytes: dec.readInt(), MaxInodes: dec.readInt()}
+}
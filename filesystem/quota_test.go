@@ -0,0 +1,254 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var quotaTree = map[string]string{
+	"/home/docs/a.txt": "",
+	"/tmp/":            "",
+}
+
+func TestDirQuota(t *testing.T) {
+	fileSys := newTree(t, 200, quotaTree)
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{MaxBytes: 30, MaxInodes: 4}))
+	fl, _ := fileSys.OpenFile("/home/docs/a.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, []byte("twenty bytes of text")))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.AppendFile(fl, []byte(" and eleven")))
+	assert.Nil(t, fileSys.AppendFile(fl, []byte(" and ten!!")))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.WriteFile(fl, make([]byte, 31)))
+	//rewriting within the limit does not grow the usage
+	assert.Nil(t, fileSys.WriteFile(fl, make([]byte, 30)))
+	handle, _ := fileSys.OpenHandle("/home/docs/a.txt")
+	_, err := handle.WriteAt([]byte("x"), 29)
+	assert.Nil(t, err)
+	_, err = handle.WriteAt([]byte("x"), 30)
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	//docs and a.txt take two of the four inodes
+	assert.Nil(t, fileSys.CreateFile("/home/b.txt"))
+	assert.Nil(t, fileSys.Symlink("b.txt", "/home/docs/link"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.CreateFile("/home/docs/c.txt"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.CreateDir("/home/more"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.Symlink("b.txt", "/home/other"))
+	_, err = fileSys.Stat("/home/docs/c.txt")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+
+	//items outside the directory are not charged
+	assert.Nil(t, fileSys.CreateDir("/tmp/a/b/c"))
+	assert.Nil(t, fileSys.CreateFile("/tmp/a/b/c/big.txt"))
+	big, _ := fileSys.OpenFile("/tmp/a/b/c/big.txt")
+	assert.Nil(t, fileSys.WriteFile(big, make([]byte, 100)))
+
+	assert.Equal(t, []QuotaUsage{
+		{Path: "/home", Limit: Quota{MaxBytes: 30, MaxInodes: 4}, Bytes: 30, Inodes: 4},
+	}, fileSys.Quotas())
+	assert.Nil(t, fileSys.DeleteFile("/home/b.txt"))
+	assert.Nil(t, fileSys.CreateFile("/home/docs/c.txt"))
+	assert.Equal(t, ErrInvalidQuota, fileSys.SetDirQuota("/home", Quota{MaxBytes: -1}))
+	assert.Equal(t, ErrNotDirectory, fileSys.SetDirQuota("/home/docs/a.txt", Quota{MaxBytes: 1}))
+
+	//a zero quota removes the limit
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{}))
+	assert.Empty(t, fileSys.Quotas())
+	assert.Nil(t, fileSys.CreateDir("/home/more"))
+}
+
+func TestDirQuotaNested(t *testing.T) {
+	fileSys := newTree(t, 200, quotaTree)
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{MaxBytes: 30, MaxInodes: 4}))
+	assert.Nil(t, fileSys.SetDirQuota("/home/docs", Quota{MaxBytes: 10}))
+	fl, _ := fileSys.OpenFile("/home/docs/a.txt")
+	assert.Equal(t, ErrQuotaExceeded, fileSys.WriteFile(fl, make([]byte, 11)))
+	assert.Nil(t, fileSys.WriteFile(fl, make([]byte, 10)))
+
+	//the quota moves with its directory and goes with it
+	assert.Nil(t, fileSys.Rename("/home/docs", "/tmp/docs"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.AppendFile(fl, []byte("x")))
+	assert.Equal(t, []QuotaUsage{
+		{Path: "/home", Limit: Quota{MaxBytes: 30, MaxInodes: 4}},
+		{Path: "/tmp/docs", Limit: Quota{MaxBytes: 10}, Bytes: 10, Inodes: 1},
+	}, fileSys.Quotas())
+	_, err := fileSys.RemoveAll("/tmp/docs")
+	assert.Nil(t, err)
+	assert.Len(t, fileSys.Quotas(), 1)
+}
+
+func TestDirQuotaRenameLink(t *testing.T) {
+	fileSys := newTree(t, 200, map[string]string{
+		"/home/docs/a.txt": "",
+		"/tmp/big.txt":     "twenty bytes of text",
+		"/tmp/huge.txt":    "thirty one bytes of text at most",
+		"/tmp/small.txt":   "five!",
+		"/tmp/ten.txt":     "ten bytes!",
+		"/tmp/sub/deeper/": "",
+	})
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{MaxBytes: 30, MaxInodes: 4}))
+
+	//moving or linking items into the directory is charged like creating them
+	assert.Equal(t, ErrQuotaExceeded, fileSys.Rename("/tmp/huge.txt", "/home/huge.txt"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.Link("/tmp/huge.txt", "/home/huge.txt"))
+	_, err := fileSys.Stat("/tmp/huge.txt")
+	assert.Nil(t, err)
+	assert.Nil(t, fileSys.Rename("/tmp/big.txt", "/home/big.txt"))
+	//a file already charged only gets another name
+	assert.Nil(t, fileSys.Link("/home/big.txt", "/home/docs/big.txt"))
+	assert.Nil(t, fileSys.Link("/tmp/small.txt", "/home/small.txt"))
+	assert.Equal(t, ErrQuotaExceeded, fileSys.Rename("/tmp/sub", "/home/sub"))
+
+	//a replaced item is refunded
+	assert.Equal(t, ErrQuotaExceeded, fileSys.Rename("/tmp/huge.txt", "/home/big.txt"))
+	assert.Nil(t, fileSys.Rename("/tmp/ten.txt", "/home/small.txt"))
+	assert.Equal(t, []QuotaUsage{
+		{Path: "/home", Limit: Quota{MaxBytes: 30, MaxInodes: 4}, Bytes: 30, Inodes: 4},
+	}, fileSys.Quotas())
+	assertQuotaCounters(t, fileSys.(*fileSystem), 0)
+}
+
+func TestUserQuota(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	assert.Nil(t, fileSys.SetUserQuota(alice.UID, Quota{MaxBytes: 40, MaxInodes: 4}))
+	aliceFs := as(fileSys, alice)
+
+	//alice owns her home directory and both files holding 16 bytes each
+	assert.Nil(t, aliceFs.CreateFile("/home/alice/notes.txt"))
+	assert.Equal(t, ErrQuotaExceeded, aliceFs.CreateFile("/home/alice/more.txt"))
+	fl, _ := aliceFs.OpenFile("/home/alice/notes.txt")
+	assert.Equal(t, ErrQuotaExceeded, aliceFs.WriteFile(fl, make([]byte, 9)))
+	assert.Nil(t, aliceFs.WriteFile(fl, make([]byte, 8)))
+
+	//the files stay charged to alice whoever writes them
+	assert.Nil(t, fileSys.Chmod("/home/alice/notes.txt", 0666))
+	assert.Equal(t, ErrQuotaExceeded, as(fileSys, bob).AppendFile(fl, []byte("x")))
+	assert.Nil(t, fileSys.CreateFile("/home/alice/root.txt"))
+
+	assert.Equal(t, []QuotaUsage{
+		{UID: alice.UID, Limit: Quota{MaxBytes: 40, MaxInodes: 4}, Bytes: 40, Inodes: 4},
+	}, fileSys.Quotas())
+	assert.Equal(t, ErrPermissionDenied, aliceFs.SetUserQuota(alice.UID, Quota{}))
+	assert.Equal(t, ErrPermissionDenied, aliceFs.SetDirQuota("/home/alice", Quota{}))
+	assert.Len(t, aliceFs.Quotas(), 1)
+}
+
+func TestQuotaCounters(t *testing.T) {
+	fileSys := newTree(t, 200, quotaTree)
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{MaxBytes: 30, MaxInodes: 4}))
+	assert.Nil(t, fileSys.SetDirQuota("/tmp", Quota{MaxBytes: 100}))
+	assert.Nil(t, fileSys.SetUserQuota(alice.UID, Quota{MaxBytes: 25}))
+	fl, _ := fileSys.OpenFile("/home/docs/a.txt")
+	steps := []func() error{
+		func() error { return fileSys.WriteFile(fl, []byte("twelve bytes")) },
+		func() error { return fileSys.Link("/home/docs/a.txt", "/tmp/a.txt") },
+		func() error { return fileSys.Link("/home/docs/a.txt", "/home/a.txt") },
+		func() error { return fileSys.Chown("/home/docs/a.txt", alice.UID, -1) },
+		func() error { return fileSys.Rename("/home/docs", "/tmp/docs") },
+		func() error { return fileSys.AppendFile(fl, []byte("and ten more")) },
+		func() error { return fileSys.DeleteFile("/home/a.txt") },
+		func() error { return fileSys.WriteFile(fl, []byte("shrunk")) },
+		func() error { return fileSys.CreateDir("/tmp/x/y") },
+		func() error { return fileSys.Symlink("/tmp/a.txt", "/tmp/x/y/link") },
+		func() error { return fileSys.CreateFile("/tmp/x/b.txt") },
+		func() error { return fileSys.Rename("/tmp/docs/a.txt", "/tmp/x/b.txt") },
+		func() error { return fileSys.Rename("/tmp/x", "/home/x") },
+		func() error { return fileSys.Chown("/home/x/y", alice.UID, -1) },
+		func() error {
+			_, err := fileSys.RemoveAll("/home/x")
+			return err
+		},
+		func() error { return fileSys.RemoveDir("/tmp/docs") },
+	}
+	for i, step := range steps {
+		assert.Nil(t, step(), "step %d", i)
+		assertQuotaCounters(t, fileSys.(*fileSystem), i)
+	}
+	//a write refused by a quota leaves its counters as they were
+	usages := fileSys.Quotas()
+	assert.Equal(t, ErrQuotaExceeded, fileSys.WriteFile(fl, make([]byte, 26)))
+	assert.Equal(t, usages, fileSys.Quotas())
+
+	var saved bytes.Buffer
+	assert.Nil(t, fileSys.Save(&saved))
+	loaded, err := Load(bytes.NewReader(saved.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, usages, loaded.Quotas())
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	d, _ := disk.NewDisk(5000, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.SetDirQuota("/", Quota{MaxBytes: 1000, MaxInodes: 40}))
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			//every worker races to create the same parent directories
+			dir := fmt.Sprintf("/home/shared/worker%d", worker)
+			if err := fileSys.CreateDir(dir); err != nil {
+				assert.Equal(t, ErrQuotaExceeded, err)
+				return
+			}
+			for i := 0; i < 20; i++ {
+				path := fmt.Sprintf("%s/file%d.txt", dir, i%4)
+				if err := fileSys.CreateFile(path); err != nil && err != ErrFileAlreadyExist && err != ErrQuotaExceeded {
+					t.Error(err)
+					return
+				}
+				fl, err := fileSys.OpenFile(path)
+				if err != nil {
+					continue
+				}
+				if err := fileSys.AppendFile(fl, make([]byte, 10)); err != nil {
+					assert.Equal(t, ErrQuotaExceeded, err)
+				}
+				if i%3 == 0 {
+					assert.Nil(t, fileSys.DeleteFile(path))
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	usage := fileSys.Quotas()[0]
+	assert.LessOrEqual(t, usage.Bytes, 1000)
+	assert.LessOrEqual(t, usage.Inodes, 40)
+	assertQuotaCounters(t, fileSys.(*fileSystem), 0)
+}
+
+// assertQuotaCounters checks the running usage of every quota against the usage added up from the tree
+func assertQuotaCounters(t *testing.T, f *fileSystem, step int) {
+	for dir := range f.dirQuotas {
+		usage, walked := f.quotas.dirs[dir], dirUsage(dir)
+		assert.Equal(t, [2]int{walked.bytes, walked.inodes}, [2]int{usage.bytes, usage.inodes}, "step %d: %s", step, f.dirPath(dir))
+		assert.Equal(t, walked.dirs, usage.dirs, "step %d: %s", step, f.dirPath(dir))
+		assert.Equal(t, walked.files, usage.files, "step %d: %s", step, f.dirPath(dir))
+	}
+	for uid := range f.userQuotas {
+		usage, walked := f.quotas.users[uid], userUsage(f.root.(*directory), uid)
+		assert.Equal(t, [2]int{walked.bytes, walked.inodes}, [2]int{usage.bytes, usage.inodes}, "step %d: uid %d", step, uid)
+	}
+}
+
+func TestQuotaSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, quotaTree)
+	assert.Nil(t, fileSys.SetDirQuota("/home", Quota{MaxBytes: 30, MaxInodes: 4}))
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.SetDirQuota("/home/docs", Quota{MaxInodes: 1}))
+		assert.Nil(t, fileSys.SetUserQuota(alice.UID, Quota{MaxBytes: 10}))
+		assert.Nil(t, fileSys.SetDirQuota("/home", Quota{}))
+	}, func(restored FileSystem) {
+		assert.Equal(t, []QuotaUsage{
+			{Path: "/home/docs", Limit: Quota{MaxInodes: 1}, Inodes: 1},
+			{UID: alice.UID, Limit: Quota{MaxBytes: 10}},
+		}, restored.Quotas())
+		assert.Equal(t, ErrQuotaExceeded, restored.CreateFile("/home/docs/b.txt"))
+		assert.Nil(t, restored.CreateFile("/home/b.txt"))
+	})
+}
@@ -0,0 +1,247 @@
+package filesystem
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("the directory cursor is invalid")
+
+// SortKey is the order ReadDir returns entries in, entries with the same key are ordered by name
+type SortKey int
+
+const (
+	SortByName SortKey = iota
+	SortBySize
+	SortByModified
+)
+
+// DirEntry describes an entry of a directory as it was when it was read
+type DirEntry struct {
+	Name string
+	Ino  uint64
+	// Type holds the type bits of the entry, fs.ModeDir for a directory, fs.ModeSymlink for a symlink
+	// and none for a file
+	Type fs.FileMode
+	// Size is the number of bytes stored in a file or the length of the target of a symlink
+	Size       int
+	ModifiedAt time.Time
+}
+
+func (entry DirEntry) IsDir() bool {
+	return entry.Type.IsDir()
+}
+
+// ReadDirOptions pages through a directory: Limit is the most entries returned, none meaning all of
+// them, and Cursor is the cursor returned with the previous page, empty for the first one. A page
+// is only continued with the SortBy and Reverse it was started with
+type ReadDirOptions struct {
+	SortBy  SortKey
+	Reverse bool
+	Cursor  string
+	Limit   int
+}
+
+// ReadDir returns the entries of the directory at path in the order asked for by opts along with the
+// cursor of the next page, empty once the last entry was returned. Cursors point between two entries
+// rather than at an offset, so entries added or removed since the previous page neither show up twice
+// nor push others out of the next one. The caller must be allowed to read the directory
+func (f *fileSystem) ReadDir(path string, opts ReadDirOptions) ([]DirEntry, string, error) {
+	return f.readDirAs(Superuser, path, opts)
+}
+
+func (f *fileSystem) readDirAs(caller Caller, path string, opts ReadDirOptions) ([]DirEntry, string, error) {
+	var after *DirEntry
+	if opts.Cursor != "" {
+		entry, err := parseCursor(opts.Cursor, opts.SortBy)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &entry
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, err := f.lookupAs(caller, path, true)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, ok := fsItem.(*directory)
+	if !ok {
+		return nil, "", ErrNotDirectory
+	}
+	if err := caller.check(dir.perm, permRead); err != nil {
+		return nil, "", err
+	}
+	//a snapshot is frozen, its timestamps included
+	if !f.readOnly {
+		dir.touch(time.Now())
+	}
+	less := func(a *DirEntry, b *DirEntry) bool {
+		if opts.Reverse {
+			a, b = b, a
+		}
+		if keyA, keyB := sortKey(a, opts.SortBy), sortKey(b, opts.SortBy); keyA != keyB {
+			return keyA < keyB
+		}
+		return a.Name < b.Name
+	}
+	var page []DirEntry
+	var more bool
+	if opts.SortBy == SortByName {
+		page, more = readNames(dir, after, opts.Reverse, opts.Limit)
+	} else {
+		page, more = topEntries(readEntries(dir), after, less, opts.Limit)
+	}
+	if !more {
+		return page, "", nil
+	}
+	return page, formatCursor(page[len(page)-1], opts.SortBy), nil
+}
+
+// readNames describes the first limit entries of dir following after in name order, every one of them
+// when limit is not positive. It seeks to after in the sorted names and only describes the entries it
+// returns, and reports whether more entries follow them
+func readNames(dir *directory, after *DirEntry, reverse bool, limit int) ([]DirEntry, bool) {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	names := dir.names
+	if after != nil {
+		i := sort.SearchStrings(names, after.Name)
+		if reverse {
+			names = names[:i]
+		} else {
+			if i < len(names) && names[i] == after.Name {
+				i++
+			}
+			names = names[i:]
+		}
+	}
+	count := len(names)
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	entries := make([]DirEntry, 0, count)
+	for i := 0; i < count; i++ {
+		name := names[i]
+		if reverse {
+			name = names[len(names)-1-i]
+		}
+		entries = append(entries, describeEntry(name, dir.contents[name]))
+	}
+	return entries, count < len(names)
+}
+
+// readEntries describes every entry of dir
+func readEntries(dir *directory) []DirEntry {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	entries := make([]DirEntry, 0, len(dir.contents))
+	for name, fsItem := range dir.contents {
+		entries = append(entries, describeEntry(name, fsItem))
+	}
+	return entries
+}
+
+func describeEntry(name string, fsItem item) DirEntry {
+	info := statItem(fsItem, name, "")
+	return DirEntry{Name: name, Ino: info.Ino, Type: info.Mode.Type(), Size: info.Size, ModifiedAt: info.ModifiedAt}
+}
+
+// topEntries returns the first limit entries following after in the order of less, every one of them
+// when limit is not positive, sorted. Only limit entries are kept at a time, in a heap topped by the
+// last of them, and whether more entries follow them is reported
+func topEntries(entries []DirEntry, after *DirEntry, less func(a *DirEntry, b *DirEntry) bool, limit int) ([]DirEntry, bool) {
+	top := &entryHeap{less: less}
+	more := false
+	for i := range entries {
+		if after != nil && !less(after, &entries[i]) {
+			continue
+		}
+		if limit <= 0 || len(top.entries) < limit {
+			top.entries = append(top.entries, entries[i])
+			if len(top.entries) == limit {
+				heap.Init(top)
+			}
+			continue
+		}
+		more = true
+		if less(&entries[i], &top.entries[0]) {
+			top.entries[0] = entries[i]
+			heap.Fix(top, 0)
+		}
+	}
+	sort.Slice(top.entries, func(i, j int) bool {
+		return less(&top.entries[i], &top.entries[j])
+	})
+	return top.entries, more
+}
+
+// entryHeap is a heap of entries whose top is the last one in the order of less
+type entryHeap struct {
+	entries []DirEntry
+	less    func(a *DirEntry, b *DirEntry) bool
+}
+
+func (h *entryHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *entryHeap) Less(i int, j int) bool {
+	return h.less(&h.entries[j], &h.entries[i])
+}
+
+func (h *entryHeap) Swap(i int, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(DirEntry))
+}
+
+func (h *entryHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+func sortKey(entry *DirEntry, sortBy SortKey) int64 {
+	switch sortBy {
+	case SortBySize:
+		return int64(entry.Size)
+	case SortByModified:
+		return entry.ModifiedAt.UnixNano()
+	}
+	return 0
+}
+
+// formatCursor returns the cursor following entry, it holds the sort key and the name of the entry.
+// Names never hold a slash, so the name is whatever follows the second one
+func formatCursor(entry DirEntry, sortBy SortKey) string {
+	return fmt.Sprintf("%d/%d/%s", sortBy, sortKey(&entry, sortBy), entry.Name)
+}
+
+// parseCursor returns an entry standing for the cursor, with the name and sort key of the entry it follows
+func parseCursor(cursor string, sortBy SortKey) (DirEntry, error) {
+	parts := strings.SplitN(cursor, "/", 3)
+	if len(parts) != 3 || parts[0] != strconv.Itoa(int(sortBy)) || parts[2] == "" {
+		return DirEntry{}, ErrInvalidCursor
+	}
+	key, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return DirEntry{}, ErrInvalidCursor
+	}
+	entry := DirEntry{Name: parts[2]}
+	switch sortBy {
+	case SortBySize:
+		entry.Size = int(key)
+	case SortByModified:
+		entry.ModifiedAt = time.Unix(0, key)
+	}
+	return entry, nil
+}
@@ -0,0 +1,186 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var readDirTree = map[string]string{
+	"/home/a.txt": string(make([]byte, 30)),
+	"/home/c.txt": string(make([]byte, 10)),
+	"/home/docs/": "",
+	"/home/e.txt": string(make([]byte, 10)),
+	"/home/link":  "-> docs",
+}
+
+func entryNames(entries []DirEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestReadDir(t *testing.T) {
+	fileSys := newTree(t, 200, readDirTree)
+	entries, cursor, err := fileSys.ReadDir("/home", ReadDirOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, cursor)
+	assert.Equal(t, []string{"a.txt", "c.txt", "docs", "e.txt", "link"}, entryNames(entries))
+	info, _ := fileSys.Stat("/home/a.txt")
+	assert.Equal(t, DirEntry{Name: "a.txt", Ino: info.Ino, Size: 30, ModifiedAt: info.ModifiedAt}, entries[0])
+	assert.True(t, entries[2].IsDir())
+	assert.Equal(t, fs.ModeDir, entries[2].Type)
+	assert.Equal(t, fs.ModeSymlink, entries[4].Type)
+	assert.Equal(t, len("docs"), entries[4].Size)
+
+	//ties on the key are ordered by name, Reverse reverses both
+	entries, _, _ = fileSys.ReadDir("/home", ReadDirOptions{SortBy: SortBySize})
+	assert.Equal(t, []string{"docs", "link", "c.txt", "e.txt", "a.txt"}, entryNames(entries))
+	entries, _, _ = fileSys.ReadDir("/home", ReadDirOptions{SortBy: SortBySize, Reverse: true})
+	assert.Equal(t, []string{"a.txt", "e.txt", "c.txt", "link", "docs"}, entryNames(entries))
+	time.Sleep(time.Millisecond)
+	fl, _ := fileSys.OpenFile("/home/c.txt")
+	assert.Nil(t, fileSys.AppendFile(fl, []byte("x")))
+	entries, _, _ = fileSys.ReadDir("/home", ReadDirOptions{SortBy: SortByModified, Reverse: true})
+	assert.Equal(t, "c.txt", entries[0].Name)
+
+	//directories are read through symlinks, ListDir is sorted as well
+	entries, _, err = fileSys.ReadDir("/home/link", ReadDirOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	names, _ := fileSys.ListDir("/home")
+	assert.Equal(t, []string{"a.txt", "c.txt", "docs", "e.txt", "link"}, names)
+
+	_, _, err = fileSys.ReadDir("/home/a.txt", ReadDirOptions{})
+	assert.Equal(t, ErrNotDirectory, err)
+	_, _, err = fileSys.ReadDir("/missing", ReadDirOptions{})
+	assert.Equal(t, ErrPathDoesNotExists, err)
+	assert.Nil(t, fileSys.Chmod("/home", 0711))
+	_, _, err = as(fileSys, alice).ReadDir("/home", ReadDirOptions{})
+	assert.Equal(t, ErrPermissionDenied, err)
+}
+
+func TestReadDirPages(t *testing.T) {
+	fileSys := newTree(t, 200, readDirTree)
+	entries, cursor, err := fileSys.ReadDir("/home", ReadDirOptions{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "c.txt"}, entryNames(entries))
+	assert.NotEmpty(t, cursor)
+
+	//entries added or removed behind the cursor do not move the next page
+	assert.Nil(t, fileSys.CreateFile("/home/b.txt"))
+	assert.Nil(t, fileSys.DeleteFile("/home/c.txt"))
+	assert.Nil(t, fileSys.CreateFile("/home/d.txt"))
+	entries, cursor, err = fileSys.ReadDir("/home", ReadDirOptions{Limit: 2, Cursor: cursor})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d.txt", "docs"}, entryNames(entries))
+	entries, cursor, _ = fileSys.ReadDir("/home", ReadDirOptions{Limit: 2, Cursor: cursor})
+	assert.Equal(t, []string{"e.txt", "link"}, entryNames(entries))
+	assert.Empty(t, cursor)
+
+	entries, cursor, _ = fileSys.ReadDir("/home", ReadDirOptions{SortBy: SortBySize, Reverse: true, Limit: 1})
+	assert.Equal(t, []string{"a.txt"}, entryNames(entries))
+	entries, _, _ = fileSys.ReadDir("/home", ReadDirOptions{SortBy: SortBySize, Reverse: true, Limit: 1, Cursor: cursor})
+	assert.Equal(t, []string{"e.txt"}, entryNames(entries))
+
+	for _, cursor := range []string{"garbage", "0/x/a.txt", "0/0/", cursor} {
+		_, _, err = fileSys.ReadDir("/home", ReadDirOptions{Cursor: cursor})
+		assert.Equal(t, ErrInvalidCursor, err, cursor)
+	}
+}
+
+func TestReadDirLarge(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	expected := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		assert.Nil(t, fileSys.CreateFile("/"+name))
+		expected = append(expected, name)
+	}
+	sort.Strings(expected)
+	names := make([]string, 0, len(expected))
+	cursor, pages := "", 0
+	for {
+		entries, next, err := fileSys.ReadDir("/", ReadDirOptions{Cursor: cursor, Limit: 64})
+		assert.Nil(t, err)
+		names = append(names, entryNames(entries)...)
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, expected, names)
+	assert.Equal(t, 16, pages)
+}
+
+func TestReadDirIndex(t *testing.T) {
+	d, _ := disk.NewDisk(2000, 10)
+	fileSys := NewFileSystem(d)
+	assert.Nil(t, fileSys.CreateDir("/dir/sub"))
+	for i := 0; i < 40; i++ {
+		path := fmt.Sprintf("/dir/%02d.txt", (i*7)%40)
+		assert.Nil(t, fileSys.CreateFile(path))
+		fl, _ := fileSys.OpenFile(path)
+		assert.Nil(t, fileSys.WriteFile(fl, make([]byte, i%5)))
+	}
+	//the sorted names follow every change of the entries
+	assert.Nil(t, fileSys.DeleteFile("/dir/05.txt"))
+	assert.Nil(t, fileSys.Rename("/dir/10.txt", "/dir/sub/10.txt"))
+	assert.Nil(t, fileSys.Rename("/dir/11.txt", "/dir/12.txt"))
+	assert.Nil(t, fileSys.Rename("/dir/sub/10.txt", "/dir/99.txt"))
+	assert.Nil(t, fileSys.Link("/dir/00.txt", "/dir/link"))
+	assert.Nil(t, fileSys.Symlink("00.txt", "/dir/a-symlink"))
+	assert.Nil(t, fileSys.RemoveDir("/dir/sub"))
+	assert.Nil(t, fileSys.Snapshot("snap"))
+	snapshot, _ := fileSys.MountSnapshot("snap")
+	var image bytes.Buffer
+	assert.Nil(t, fileSys.Save(&image))
+	loaded, _ := Load(&image)
+
+	expected, _ := fileSys.ListDir("/dir")
+	assert.Len(t, expected, 40)
+	for _, fileSys := range []FileSystem{fileSys, snapshot, loaded} {
+		for _, sortBy := range []SortKey{SortByName, SortBySize} {
+			for _, reverse := range []bool{false, true} {
+				all, _, err := fileSys.ReadDir("/dir", ReadDirOptions{SortBy: sortBy, Reverse: reverse})
+				assert.Nil(t, err)
+				names := entryNames(all)
+				assert.ElementsMatch(t, expected, names)
+				assert.True(t, sort.SliceIsSorted(all, func(i, j int) bool {
+					a, b := all[i], all[j]
+					if reverse {
+						a, b = b, a
+					}
+					if sortBy == SortBySize && a.Size != b.Size {
+						return a.Size < b.Size
+					}
+					return a.Name < b.Name
+				}))
+				for _, limit := range []int{1, 3, 7} {
+					paged, cursor := make([]string, 0, len(names)), ""
+					for {
+						entries, next, err := fileSys.ReadDir("/dir", ReadDirOptions{SortBy: sortBy, Reverse: reverse, Cursor: cursor, Limit: limit})
+						assert.Nil(t, err)
+						assert.LessOrEqual(t, len(entries), limit)
+						paged = append(paged, entryNames(entries)...)
+						if next == "" {
+							break
+						}
+						cursor = next
+					}
+					assert.Equal(t, names, paged, "sort %d reverse %v limit %d", sortBy, reverse, limit)
+				}
+			}
+		}
+	}
+}
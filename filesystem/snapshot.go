@@ -0,0 +1,262 @@
+package filesystem
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot freezes the directory tree as it was when it was taken. Only the tree is copied, files of
+// a snapshot share their blocks with the live tree through the disk reference counts and the disk copies
+// a shared block before the live tree writes to it
+type snapshot struct {
+	name      string
+	createdAt time.Time
+	root      *directory
+}
+
+type ChangeKind int
+
+const (
+	ChangeAdded ChangeKind = iota
+	ChangeRemoved
+	ChangeModified
+)
+
+// Change is a path that differs between two trees compared by DiffSnapshots
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+var (
+	ErrSnapshotAlreadyExist = errors.New("the snapshot already exists")
+	ErrSnapshotDoesNotExist = errors.New("the snapshot does not exists")
+	ErrInvalidSnapshotName  = errors.New("the snapshot name is invalid")
+	ErrReadOnly             = errors.New("the filesystem is read only")
+)
+
+// Snapshot freezes the current tree under name, no data is copied
+func (f *fileSystem) Snapshot(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name == "" || strings.Contains(name, "/") {
+		return ErrInvalidSnapshotName
+	}
+	return f.logged(record{op: opSnapshot, path: name}, func() error {
+		if _, exist := f.snapshots[name]; exist {
+			return ErrSnapshotAlreadyExist
+		}
+		if f.snapshots == nil {
+			f.snapshots = map[string]*snapshot{}
+		}
+		f.snapshots[name] = &snapshot{name: name, createdAt: time.Now(), root: f.copyDir(f.root.(*directory), map[*file]*file{})}
+		return nil
+	})
+}
+
+// ListSnapshots returns the names of the snapshots sorted lexically
+func (f *fileSystem) ListSnapshots() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.snapshots))
+	for name := range f.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MountSnapshot returns a read only FileSystem over the tree of the snapshot, every mutation on it
+// returns ErrReadOnly. Files seen through it read as empty once the snapshot is deleted
+func (f *fileSystem) MountSnapshot(name string) (FileSystem, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	snap, exist := f.snapshots[name]
+	if !exist {
+		return nil, ErrSnapshotDoesNotExist
+	}
+	view := &fileSystem{root: snap.root, disk: f.disk, readOnly: true, maxSymlinkDepth: f.maxSymlinkDepth}
+	view.inodes.index(snap.root, 0, 0)
+	return view, nil
+}
+
+// DeleteSnapshot drops the snapshot, blocks no longer referenced by any tree go back to the disk
+func (f *fileSystem) DeleteSnapshot(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logged(record{op: opDeleteSnapshot, path: name}, func() error {
+		snap, exist := f.snapshots[name]
+		if !exist {
+			return ErrSnapshotDoesNotExist
+		}
+		delete(f.snapshots, name)
+		f.releaseDir(snap.root)
+		return nil
+	})
+}
+
+// DiffSnapshots lists the paths that differ between two snapshots sorted by path, an empty name refers to
+// the live tree. Files are compared by the blocks they reference so their data is never read
+func (f *fileSystem) DiffSnapshots(from string, to string) ([]Change, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fromRoot, err := f.snapshotRoot(from)
+	if err != nil {
+		return nil, err
+	}
+	toRoot, err := f.snapshotRoot(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, 0)
+	if fromRoot != toRoot {
+		diffDirs("", fromRoot, toRoot, &changes)
+	}
+	return changes, nil
+}
+
+func (f *fileSystem) snapshotRoot(name string) (*directory, error) {
+	if name == "" {
+		return f.root.(*directory), nil
+	}
+	snap, exist := f.snapshots[name]
+	if !exist {
+		return nil, ErrSnapshotDoesNotExist
+	}
+	return snap.root, nil
+}
+
+// copyDir copies the tree below dir, copies maps the files already copied so that a file linked
+// under several names is still a single file in the copy. Copies keep the inode numbers of the originals
+func (f *fileSystem) copyDir(dir *directory, copies map[*file]*file) *directory {
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	dirCopy := &directory{ino: dir.ino, dirName: dir.dirName, contents: make(map[string]item, len(dir.contents)), createdAt: dir.createdAt,
+		lastModified: dir.lastModified, lastAccessed: dir.accessedAt(), lastChanged: dir.lastChanged, perm: dir.perm}
+	if dir.xattrs != nil {
+		dirCopy.xattrs = f.disk.Clone(dir.xattrs)
+	}
+	for _, name := range dir.names {
+		switch fsItem := dir.contents[name].(type) {
+		case *file:
+			if _, copied := copies[fsItem]; !copied {
+				copies[fsItem] = f.copyFile(fsItem)
+			}
+			dirCopy.addEntry(name, copies[fsItem])
+		case *symlink:
+			linkCopy := *fsItem
+			dirCopy.addEntry(name, &linkCopy)
+		case *directory:
+			dirCopy.addEntry(name, f.copyDir(fsItem, copies))
+		}
+	}
+	return dirCopy
+}
+
+func (f *fileSystem) copyFile(fl *file) *file {
+	fl.mu.RLock()
+	defer fl.mu.RUnlock()
+	fileCopy := &file{ino: fl.ino, fileName: fl.fileName, path: fl.path, nlink: fl.nlink, createdAt: fl.createdAt, lastModified: fl.lastModified,
+		lastAccessed: fl.lastAccessed, lastChanged: fl.lastChanged, perm: fl.perm}
+	if fl.info != nil {
+		fileCopy.info = f.disk.Clone(fl.info)
+	}
+	if fl.xattrs != nil {
+		fileCopy.xattrs = f.disk.Clone(fl.xattrs)
+	}
+	return fileCopy
+}
+
+func (f *fileSystem) releaseDir(dir *directory) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	f.dropXattrs(dir)
+	for _, fsItem := range dir.contents {
+		if !fsItem.isFile() {
+			f.releaseDir(fsItem.(*directory))
+			continue
+		}
+		fl, ok := fsItem.(*file)
+		if !ok {
+			continue
+		}
+		fl.mu.Lock()
+		fl.unlinked = true
+		if fl.info != nil {
+			f.disk.Delete(fl.info)
+			fl.info = nil
+		}
+		f.dropXattrs(fl)
+		fl.mu.Unlock()
+	}
+}
+
+func diffDirs(prefix string, from *directory, to *directory, changes *[]Change) {
+	from.mu.RLock()
+	defer from.mu.RUnlock()
+	to.mu.RLock()
+	defer to.mu.RUnlock()
+	names := make([]string, 0, len(from.contents)+len(to.contents))
+	for name := range from.contents {
+		names = append(names, name)
+	}
+	for name := range to.contents {
+		if _, exist := from.contents[name]; !exist {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := prefix + "/" + name
+		fromItem, inFrom := from.contents[name]
+		toItem, inTo := to.contents[name]
+		switch {
+		case !inTo:
+			addChanges(path, fromItem, ChangeRemoved, changes)
+		case !inFrom:
+			addChanges(path, toItem, ChangeAdded, changes)
+		case isSymlink(fromItem) && isSymlink(toItem):
+			if fromItem.(*symlink).target != toItem.(*symlink).target {
+				*changes = append(*changes, Change{Path: path, Kind: ChangeModified})
+			}
+		case fromItem.isFile() && toItem.isFile() && !isSymlink(fromItem) && !isSymlink(toItem):
+			if !sameContents(fromItem.(*file), toItem.(*file)) {
+				*changes = append(*changes, Change{Path: path, Kind: ChangeModified})
+			}
+		case !fromItem.isFile() && !toItem.isFile():
+			diffDirs(path, fromItem.(*directory), toItem.(*directory), changes)
+		default:
+			addChanges(path, fromItem, ChangeRemoved, changes)
+			addChanges(path, toItem, ChangeAdded, changes)
+		}
+	}
+}
+
+func sameContents(from *file, to *file) bool {
+	from.mu.RLock()
+	defer from.mu.RUnlock()
+	to.mu.RLock()
+	defer to.mu.RUnlock()
+	return from.info.Equal(to.info)
+}
+
+// addChanges reports path and, for a directory, everything below it
+func addChanges(path string, fsItem item, kind ChangeKind, changes *[]Change) {
+	*changes = append(*changes, Change{Path: path, Kind: kind})
+	if fsItem.isFile() {
+		return
+	}
+	dir := fsItem.(*directory)
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	names := make([]string, 0, len(dir.contents))
+	for name := range dir.contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addChanges(path+"/"+name, dir.contents[name], kind, changes)
+	}
+}
@@ -0,0 +1,104 @@
+package filesystem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var snapshotTree = map[string]string{
+	"/home/docs/a.txt": "document a",
+	"/home/notes.txt":  "notes before the snapshot",
+}
+
+func TestSnapshot(t *testing.T) {
+	fileSys := newTree(t, 200, snapshotTree)
+	free := fileSys.GetAvailableMemory()
+	assert.Nil(t, fileSys.Snapshot("before"))
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+	assert.Equal(t, ErrSnapshotAlreadyExist, fileSys.Snapshot("before"))
+	assert.Equal(t, ErrInvalidSnapshotName, fileSys.Snapshot("a/b"))
+	assert.Equal(t, ErrInvalidSnapshotName, fileSys.Snapshot(""))
+
+	//only the block written to is copied
+	handle, _ := fileSys.OpenHandle("/home/notes.txt")
+	_, err := handle.WriteAt([]byte("NOTES"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, free-10, fileSys.GetAvailableMemory())
+	assert.Nil(t, fileSys.DeleteFile("/home/docs/a.txt"))
+	assert.Nil(t, fileSys.CreateFile("/home/new.txt"))
+	assert.Nil(t, fileSys.Snapshot("after"))
+	assert.Equal(t, []string{"after", "before"}, fileSys.ListSnapshots())
+
+	view, err := fileSys.MountSnapshot("before")
+	assert.Nil(t, err)
+	fl, err := view.OpenFile("/home/notes.txt")
+	assert.Nil(t, err)
+	data, _ := view.ReadFile(fl)
+	assert.Equal(t, "notes before the snapshot", string(data))
+	fl, err = view.OpenFile("/home/docs/a.txt")
+	assert.Nil(t, err)
+	data, _ = view.ReadFile(fl)
+	assert.Equal(t, "document a", string(data))
+	assert.Equal(t, ErrReadOnly, view.WriteFile(fl, []byte("changed")))
+	assert.Equal(t, ErrReadOnly, view.CreateDir("/tmp"))
+	assert.Equal(t, ErrReadOnly, view.DeleteFile("/home/notes.txt"))
+	viewHandle, _ := view.OpenHandle("/home/notes.txt")
+	_, err = viewHandle.WriteAt([]byte("x"), 0)
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = fileSys.MountSnapshot("missing")
+	assert.Equal(t, ErrSnapshotDoesNotExist, err)
+
+	changes, err := fileSys.DiffSnapshots("before", "after")
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Path: "/home/docs/a.txt", Kind: ChangeRemoved},
+		{Path: "/home/new.txt", Kind: ChangeAdded},
+		{Path: "/home/notes.txt", Kind: ChangeModified},
+	}, changes)
+	changes, _ = fileSys.DiffSnapshots("after", "")
+	assert.Empty(t, changes)
+	assert.Nil(t, fileSys.CreateDir("/home/docs/sub"))
+	changes, _ = fileSys.DiffSnapshots("before", "")
+	assert.Equal(t, []Change{
+		{Path: "/home/docs/a.txt", Kind: ChangeRemoved},
+		{Path: "/home/docs/sub", Kind: ChangeAdded},
+		{Path: "/home/new.txt", Kind: ChangeAdded},
+		{Path: "/home/notes.txt", Kind: ChangeModified},
+	}, changes)
+	_, err = fileSys.DiffSnapshots("missing", "")
+	assert.Equal(t, ErrSnapshotDoesNotExist, err)
+
+	//the blocks only the deleted snapshot referred to go back to the disk
+	assert.Nil(t, fileSys.DeleteSnapshot("before"))
+	assert.Equal(t, ErrSnapshotDoesNotExist, fileSys.DeleteSnapshot("before"))
+	assert.Equal(t, free-10+10+10, fileSys.GetAvailableMemory())
+	assert.Nil(t, fileSys.DeleteSnapshot("after"))
+	fl, _ = fileSys.OpenFile("/home/notes.txt")
+	data, _ = fileSys.ReadFile(fl)
+	assert.Equal(t, "NOTES before the snapshot", string(data))
+}
+
+func TestSnapshotSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, snapshotTree)
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.Snapshot("dropped"))
+		assert.Nil(t, fileSys.Snapshot("before"))
+		fl, _ := fileSys.OpenFile("/home/notes.txt")
+		assert.Nil(t, fileSys.AppendFile(fl, []byte(" and after")))
+		assert.Nil(t, fileSys.DeleteSnapshot("dropped"))
+	}, func(restored FileSystem) {
+		assert.Equal(t, []string{"before"}, restored.ListSnapshots())
+		//the restored disk knows the blocks are shared, writing copies them and deleting the snapshot frees them
+		free := restored.GetAvailableMemory()
+		fl, _ := restored.OpenFile("/home/docs/a.txt")
+		assert.Nil(t, restored.AppendFile(fl, []byte("!")))
+		assert.Equal(t, free-10, restored.GetAvailableMemory())
+		view, _ := restored.MountSnapshot("before")
+		fl, _ = view.OpenFile("/home/docs/a.txt")
+		data, _ := view.ReadFile(fl)
+		assert.Equal(t, "document a", string(data))
+		assert.Nil(t, restored.DeleteSnapshot("before"))
+		assert.Equal(t, free, restored.GetAvailableMemory())
+	})
+}
@@ -0,0 +1,78 @@
+package filesystem
+
+import (
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file or directory as it was when Stat was called
+type FileInfo struct {
+	Name string
+	Path string
+	// Ino is the inode number, it stays the same through renames and is shared by every link to a file
+	Ino   uint64
+	IsDir bool
+	// Size is the number of bytes stored in the file and Blocks the number of disk blocks holding them,
+	// both are zero for a directory
+	Size   int
+	Blocks int
+	// Links is the number of directory entries referring to a file
+	Links int
+	// Entries is the number of entries of a directory
+	Entries int
+	// Mode holds the permission bits, and fs.ModeDir for a directory or fs.ModeSymlink for a symlink
+	Mode fs.FileMode
+	// Target is the path a symlink refers to, Lstat is the only way to stat a symlink
+	Target     string
+	UID        int
+	GID        int
+	CreatedAt  time.Time
+	ModifiedAt time.Time
+	AccessedAt time.Time
+	ChangedAt  time.Time
+}
+
+// Stat returns the metadata of the file or directory at path, "/" is the root directory.
+// It reads no data and does not update the access timestamp, the caller only needs to be allowed
+// to search the directories leading to path. A symlink at the end of path is followed, see Lstat
+func (f *fileSystem) Stat(path string) (*FileInfo, error) {
+	return f.statAs(Superuser, path, true)
+}
+
+func (f *fileSystem) statAs(caller Caller, path string, follow bool) (*FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, err := f.lookupAs(caller, path, follow)
+	if err != nil {
+		return nil, err
+	}
+	if path == "/" {
+		return statItem(fsItem, "/", "/"), nil
+	}
+	structure, _ := parseDirStruture(path)
+	return statItem(fsItem, structure[len(structure)-1], "/"+strings.Join(structure, "/")), nil
+}
+
+// statItem describes fsItem found as name, the links to a file each have their own name
+func statItem(fsItem item, name string, path string) *FileInfo {
+	if link, ok := fsItem.(*symlink); ok {
+		return &FileInfo{Name: name, Path: path, Ino: link.ino, Size: len(link.target), Links: 1, Target: link.target,
+			Mode: fs.ModeSymlink | link.perm.mode, UID: link.perm.uid, GID: link.perm.gid,
+			CreatedAt: link.createdAt, ModifiedAt: link.createdAt, AccessedAt: link.createdAt, ChangedAt: link.createdAt}
+	}
+	if fsItem.isFile() {
+		fl := fsItem.(*file)
+		fl.mu.RLock()
+		defer fl.mu.RUnlock()
+		return &FileInfo{Name: name, Path: path, Ino: fl.ino, Size: fl.info.Size(), Blocks: fl.info.BlockCount(), Links: fl.nlink,
+			Mode: fl.perm.mode, UID: fl.perm.uid, GID: fl.perm.gid,
+			CreatedAt: fl.createdAt, ModifiedAt: fl.lastModified, AccessedAt: fl.lastAccessed, ChangedAt: fl.lastChanged}
+	}
+	dir := fsItem.(*directory)
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	return &FileInfo{Name: name, Path: path, Ino: dir.ino, IsDir: true, Entries: len(dir.contents),
+		Mode: fs.ModeDir | dir.perm.mode, UID: dir.perm.uid, GID: dir.perm.gid,
+		CreatedAt: dir.createdAt, ModifiedAt: dir.lastModified, AccessedAt: dir.accessedAt(), ChangedAt: dir.lastChanged}
+}
@@ -0,0 +1,227 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// DefaultMaxSymlinkDepth is how many symlinks a single path walk follows before giving up with
+// ErrTooManyLinks, unless another depth is set with SetMaxSymlinkDepth
+const DefaultMaxSymlinkDepth = 40
+
+var (
+	ErrTooManyLinks        = errors.New("too many levels of symbolic links")
+	ErrNotSymlink          = errors.New("the path is not a symbolic link")
+	ErrInvalidSymlinkDepth = errors.New("the symlink depth must be positive")
+)
+
+// PathOption changes how an operation resolves the last level of its path
+type PathOption int
+
+const (
+	// NoFollow makes an operation act on a symlink at the end of the path instead of on its target
+	NoFollow PathOption = iota + 1
+)
+
+// follows reports whether a symlink at the end of a path is followed under opts
+func follows(opts []PathOption) bool {
+	for _, opt := range opts {
+		if opt == NoFollow {
+			return false
+		}
+	}
+	return true
+}
+
+// symlink is a directory entry holding a path, walking through it continues at its target, relative
+// targets being resolved from the directory holding the symlink. Like a file it is not a directory.
+// Its target never changes, its name and owners only change while the filesystem lock is held exclusively
+type symlink struct {
+	ino       uint64
+	linkName  string
+	target    string
+	createdAt time.Time
+	perm      permissions
+}
+
+func newSymlink(name string, target string) *symlink {
+	return &symlink{linkName: name, target: target, createdAt: time.Now(), perm: permissions{mode: fs.ModePerm}}
+}
+
+func (link *symlink) isFile() bool {
+	return true
+}
+func (link *symlink) name() string {
+	return link.linkName
+}
+
+func (link *symlink) getIno() uint64 {
+	return link.ino
+}
+
+func (link *symlink) getPermissions() permissions {
+	return link.perm
+}
+
+func (link *symlink) setPermissions(perm permissions) {
+	link.perm = perm
+}
+
+func isSymlink(fsItem item) bool {
+	_, ok := fsItem.(*symlink)
+	return ok
+}
+
+// Symlink creates linkPath as a symlink to target, target is stored as given and does not need to exist.
+// Relative targets are resolved from the directory holding linkPath
+func (f *fileSystem) Symlink(target string, linkPath string) error {
+	return f.symlinkAs(Superuser, target, linkPath)
+}
+
+func (f *fileSystem) symlinkAs(caller Caller, target string, linkPath string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(targetLevels(target)) == 0 && !strings.HasPrefix(target, "/") {
+		return ErrMalformedPathStructure
+	}
+	structure, err := f.resolvePath(caller, linkPath, false)
+	if err != nil {
+		return err
+	}
+	if len(structure) == 0 {
+		return ErrDirrAlreadyExist
+	}
+	if err := f.checkParent(caller, structure); err != nil {
+		return err
+	}
+	var charge *quotaCharge
+	if parent, err := f.root.(*directory).findParentDir(structure); err == nil {
+		if charge, err = f.reserveQuota(parent, caller.UID, 0, 1); err != nil {
+			return err
+		}
+	}
+	created := 0
+	defer func() { charge.settle(0, created) }()
+	return f.logged(record{op: opSymlink, path: linkPath, data: []byte(target), caller: caller}, func() error {
+		if err := f.root.(*directory).createSymlink(structure, target, caller.owner(), &f.inodes, &f.quotas); err != nil {
+			return err
+		}
+		created = 1
+		f.notify(Event{Path: "/" + strings.Join(structure, "/"), Kind: EventCreate})
+		return nil
+	})
+}
+
+// Readlink returns the target of the symlink at path
+func (f *fileSystem) Readlink(path string) (string, error) {
+	return f.readlinkAs(Superuser, path)
+}
+
+func (f *fileSystem) readlinkAs(caller Caller, path string) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, err := f.lookupAs(caller, path, false)
+	if err != nil {
+		return "", err
+	}
+	link, ok := fsItem.(*symlink)
+	if !ok {
+		return "", ErrNotSymlink
+	}
+	return link.target, nil
+}
+
+// Lstat is Stat without following a symlink at the end of path, the symlink itself is described
+func (f *fileSystem) Lstat(path string) (*FileInfo, error) {
+	return f.statAs(Superuser, path, false)
+}
+
+// SetMaxSymlinkDepth sets how many symlinks a single path walk follows before failing with ErrTooManyLinks
+func (f *fileSystem) SetMaxSymlinkDepth(depth int) error {
+	if depth < 1 {
+		return ErrInvalidSymlinkDepth
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxSymlinkDepth = depth
+	return nil
+}
+
+// resolvePath parses path and resolves it, see resolve
+func (f *fileSystem) resolvePath(caller Caller, path string, follow bool) ([]string, error) {
+	structure, err := parseDirStruture(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.resolve(caller, structure, follow)
+}
+
+// resolve returns the levels leading to the item at levels through directories only. Every symlink met on
+// the way is followed, the one at the last level only when follow is set, and "." and ".." are walked.
+// caller must be allowed to search every directory looked into. The walk stops at a missing item or a
+// file, the levels left are kept as they are for the operation to report
+func (f *fileSystem) resolve(caller Caller, levels []string, follow bool) ([]string, error) {
+	maxDepth := f.maxSymlinkDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxSymlinkDepth
+	}
+	dirs := []*directory{f.root.(*directory)}
+	resolved := make([]string, 0, len(levels))
+	remaining := append([]string{}, levels...)
+	followed := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+		dir := dirs[len(dirs)-1]
+		if err := caller.check(dir.perm, permExecute); err != nil {
+			return nil, err
+		}
+		switch name {
+		case ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		dir.mu.RLock()
+		child := dir.contents[name]
+		dir.mu.RUnlock()
+		switch child := child.(type) {
+		case *directory:
+			dirs = append(dirs, child)
+			resolved = append(resolved, name)
+			continue
+		case *symlink:
+			if len(remaining) == 0 && !follow {
+				break
+			}
+			followed++
+			if followed > maxDepth {
+				return nil, ErrTooManyLinks
+			}
+			if strings.HasPrefix(child.target, "/") {
+				dirs, resolved = dirs[:1], resolved[:0]
+			}
+			remaining = append(targetLevels(child.target), remaining...)
+			continue
+		}
+		return append(append(resolved, name), remaining...), nil
+	}
+	return resolved, nil
+}
+
+// targetLevels splits the target of a symlink into levels, empty levels are dropped
+func targetLevels(target string) []string {
+	levels := make([]string, 0)
+	for _, level := range strings.Split(target, "/") {
+		if level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
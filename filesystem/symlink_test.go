@@ -0,0 +1,163 @@
+package filesystem
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var symlinkTree = map[string]string{
+	"/home/abs":        "-> /home/docs",
+	"/home/docs/a.txt": "document a",
+	"/home/rel.txt":    "-> docs/a.txt",
+}
+
+func TestSymlink(t *testing.T) {
+	fileSys := newTree(t, 200, symlinkTree)
+	target, err := fileSys.Readlink("/home/rel.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "docs/a.txt", target)
+	_, err = fileSys.Readlink("/home/docs/a.txt")
+	assert.Equal(t, ErrNotSymlink, err)
+	assert.Equal(t, ErrFileAlreadyExist, fileSys.Symlink("/x", "/home/rel.txt"))
+	assert.Equal(t, ErrMalformedPathStructure, fileSys.Symlink("", "/home/empty"))
+
+	//absolute and relative symlinks are followed anywhere in a path
+	for _, path := range []string{"/home/rel.txt", "/home/abs/a.txt", "/home/abs/../rel.txt"} {
+		fl, err := fileSys.OpenFile(path)
+		assert.Nil(t, err, path)
+		data, _ := fileSys.ReadFile(fl)
+		assert.Equal(t, "document a", string(data), path)
+	}
+	assert.Nil(t, fileSys.CreateFile("/home/abs/b.txt"))
+	entries, _ := fileSys.ListDir("/home/abs")
+	assert.ElementsMatch(t, []string{"a.txt", "b.txt"}, entries)
+
+	//Stat follows the symlink, Lstat describes it
+	info, err := fileSys.Stat("/home/rel.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, info.Size)
+	info, err = fileSys.Lstat("/home/rel.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, fs.ModeSymlink|0777, info.Mode)
+	assert.Equal(t, "docs/a.txt", info.Target)
+	assert.Equal(t, len("docs/a.txt"), info.Size)
+
+	//a dangling symlink only fails once followed
+	assert.Nil(t, fileSys.Symlink("missing.txt", "/home/dangling"))
+	_, err = fileSys.OpenFile("/home/dangling")
+	assert.Equal(t, ErrFileDoesNotExist, err)
+	_, err = fileSys.Lstat("/home/dangling")
+	assert.Nil(t, err)
+
+	//renaming moves the symlink, not its target
+	assert.Nil(t, fileSys.Rename("/home/abs", "/home/moved"))
+	target, _ = fileSys.Readlink("/home/moved")
+	assert.Equal(t, "/home/docs", target)
+	_, err = fileSys.Stat("/home/docs/a.txt")
+	assert.Nil(t, err)
+}
+
+func TestSymlinkDelete(t *testing.T) {
+	fileSys := newTree(t, 200, symlinkTree)
+	free := fileSys.GetAvailableMemory()
+	assert.Nil(t, fileSys.DeleteFile("/home/rel.txt", NoFollow))
+	_, err := fileSys.Lstat("/home/rel.txt")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+	_, err = fileSys.Stat("/home/docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+
+	//without NoFollow the target goes and the symlink is left dangling
+	assert.Nil(t, fileSys.Symlink("docs/a.txt", "/home/rel.txt"))
+	assert.Nil(t, fileSys.DeleteFile("/home/rel.txt"))
+	_, err = fileSys.Stat("/home/docs/a.txt")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+	_, err = fileSys.Lstat("/home/rel.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, fileSys.GetAvailableMemory())
+
+	//RemoveAll removes a symlink to a directory and leaves the directory alone
+	_, err = fileSys.RemoveAll("/home/abs")
+	assert.Nil(t, err)
+	_, err = fileSys.Stat("/home/docs")
+	assert.Nil(t, err)
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	fileSys := newTree(t, 200, symlinkTree)
+	assert.Nil(t, fileSys.Symlink("/home/loop-b", "/home/loop-a"))
+	assert.Nil(t, fileSys.Symlink("loop-a", "/home/loop-b"))
+	_, err := fileSys.OpenFile("/home/loop-a")
+	assert.Equal(t, ErrTooManyLinks, err)
+	_, err = fileSys.Stat("/home/loop-b/a.txt")
+	assert.Equal(t, ErrTooManyLinks, err)
+	_, err = fileSys.Lstat("/home/loop-a")
+	assert.Nil(t, err)
+	_, err = fs.ReadFile(NewIOFS(fileSys), "home/loop-a")
+	assert.ErrorIs(t, err, ErrTooManyLinks)
+
+	//a chain is only a loop once it is longer than the allowed depth
+	assert.Nil(t, fileSys.Symlink("abs", "/home/chain-1"))
+	assert.Nil(t, fileSys.Symlink("chain-1", "/home/chain-2"))
+	_, err = fileSys.Stat("/home/chain-2/a.txt")
+	assert.Nil(t, err)
+	assert.Nil(t, fileSys.SetMaxSymlinkDepth(2))
+	_, err = fileSys.Stat("/home/chain-2/a.txt")
+	assert.Equal(t, ErrTooManyLinks, err)
+	assert.Equal(t, ErrInvalidSymlinkDepth, fileSys.SetMaxSymlinkDepth(0))
+	assert.Equal(t, ErrPermissionDenied, as(fileSys, alice).SetMaxSymlinkDepth(10))
+}
+
+func TestSymlinkPermissions(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	assert.Nil(t, fileSys.Chmod("/home/alice", 0700))
+	assert.Nil(t, fileSys.Symlink("/home/alice/shared.txt", "/shared.txt"))
+
+	//following a symlink needs the same search access as the path it holds
+	_, err := as(fileSys, bob).OpenFile("/shared.txt")
+	assert.Equal(t, ErrPermissionDenied, err)
+	_, err = as(fileSys, bob).Lstat("/shared.txt")
+	assert.Nil(t, err)
+	fl, err := as(fileSys, alice).OpenFile("/shared.txt")
+	assert.Nil(t, err)
+	data, _ := fileSys.ReadFile(fl)
+	assert.Equal(t, "alice wrote this", string(data))
+	assert.Equal(t, ErrPermissionDenied, as(fileSys, bob).Symlink("/x", "/home/alice/link"))
+	assert.Nil(t, as(fileSys, alice).Symlink("shared.txt", "/home/alice/link"))
+	info, _ := fileSys.Lstat("/home/alice/link")
+	assert.Equal(t, alice.UID, info.UID)
+}
+
+func TestSymlinkSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 200, symlinkTree)
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.Symlink("../rel.txt", "/home/docs/chained.txt"))
+		assert.Nil(t, fileSys.Snapshot("linked"))
+		assert.Nil(t, fileSys.DeleteFile("/home/docs/chained.txt", NoFollow))
+		assert.Nil(t, fileSys.DeleteFile("/home/rel.txt", NoFollow))
+		assert.Nil(t, fileSys.Symlink("a.txt", "/home/docs/b.txt"))
+	}, func(restored FileSystem) {
+		target, err := restored.Readlink("/home/docs/b.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "a.txt", target)
+		_, err = restored.Lstat("/home/rel.txt")
+		assert.Equal(t, ErrPathDoesNotExists, err)
+		//the snapshot keeps the symlinks deleted since
+		view, _ := restored.MountSnapshot("linked")
+		fl, err := view.OpenFile("/home/docs/chained.txt")
+		assert.Nil(t, err)
+		data, _ := view.ReadFile(fl)
+		assert.Equal(t, "document a", string(data))
+		changes, _ := restored.DiffSnapshots("linked", "")
+		assert.Equal(t, []Change{
+			{Path: "/home/docs/b.txt", Kind: ChangeAdded},
+			{Path: "/home/docs/chained.txt", Kind: ChangeRemoved},
+			{Path: "/home/rel.txt", Kind: ChangeRemoved},
+		}, changes)
+	})
+}
@@ -0,0 +1,176 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// SkipDir is returned by a WalkFunc to skip the directory it was called for, or the remaining entries
+	// of the directory holding the file it was called for. It is fs.SkipDir
+	SkipDir = fs.SkipDir
+	// ErrBadPattern is returned by Glob for a malformed pattern, it is path.ErrBadPattern
+	ErrBadPattern = path.ErrBadPattern
+)
+
+// WalkFunc is called by Walk for every item it visits with its path and metadata. When a directory
+// cannot be listed fn is called a second time for it with the error, and when root or an entry went
+// missing before it was visited fn is called with the error alone. An error other than SkipDir stops the walk
+type WalkFunc func(path string, info *FileInfo, err error) error
+
+// Walk visits the tree below root, root included, calling fn for every item. Entries are visited in
+// lexical order, a directory before its entries. Symlinks are reported and not followed, root included.
+// The tree is not locked while fn runs, fn can change it and Walk sees what is left when it gets there.
+// The caller must be allowed to read and search every directory it walks into
+func (f *fileSystem) Walk(root string, fn WalkFunc) error {
+	return f.walkAs(Superuser, root, fn)
+}
+
+func (f *fileSystem) walkAs(caller Caller, root string, fn WalkFunc) error {
+	info, err := f.statAs(caller, root, false)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = f.walk(caller, info.Path, info, fn)
+	}
+	if errors.Is(err, SkipDir) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileSystem) walk(caller Caller, path string, info *FileInfo, fn WalkFunc) error {
+	if err := fn(path, info, nil); err != nil || !info.IsDir {
+		return err
+	}
+	entries, err := f.walkEntries(caller, path)
+	if err != nil {
+		if err := fn(path, info, err); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		info, err := f.statAs(caller, entry, false)
+		if err != nil {
+			err = fn(entry, nil, err)
+		} else {
+			err = f.walk(caller, entry, info, fn)
+		}
+		if errors.Is(err, SkipDir) {
+			if info != nil && info.IsDir {
+				continue
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkEntries returns the paths of the entries of the directory at dirPath sorted by name
+func (f *fileSystem) walkEntries(caller Caller, dirPath string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, err := f.lookupAs(caller, dirPath, false)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := fsItem.(*directory)
+	if !ok {
+		return nil, ErrNotDirectory
+	}
+	if err := caller.check(dir.perm, permRead|permExecute); err != nil {
+		return nil, err
+	}
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	names := make([]string, 0, len(dir.contents))
+	for name := range dir.contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prefix := dirPath
+	if prefix == "/" {
+		prefix = ""
+	}
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, prefix+"/"+name)
+	}
+	return entries, nil
+}
+
+// Glob returns the paths matching pattern sorted lexically. pattern is an absolute path whose levels are
+// matched as by path.Match, supporting *, ? and [] within a level, while a "**" level matches any number
+// of directory levels, none included. A last "**" level matches everything below the levels before it,
+// one level at least, so "/a/**" does not match "/a" itself. Symlinks are matched but not followed.
+// Directories the caller is not allowed to read and search are left out
+func (f *fileSystem) Glob(pattern string) ([]string, error) {
+	return f.globAs(Superuser, pattern)
+}
+
+func (f *fileSystem) globAs(caller Caller, pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, ErrMalformedPathStructure
+	}
+	levels := targetLevels(pattern)
+	for _, level := range levels {
+		if _, err := path.Match(level, ""); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	matches := map[string]bool{}
+	glob(caller, f.root.(*directory), "", levels, matches)
+	paths := make([]string, 0, len(matches))
+	for match := range matches {
+		paths = append(paths, match)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// glob adds to matches the paths below dir, at dirPath, matching levels
+func glob(caller Caller, dir *directory, dirPath string, levels []string, matches map[string]bool) {
+	if len(levels) == 0 {
+		if dirPath == "" {
+			dirPath = "/"
+		}
+		matches[dirPath] = true
+		return
+	}
+	if levels[0] == "**" && len(levels) > 1 {
+		glob(caller, dir, dirPath, levels[1:], matches)
+	}
+	if !caller.allowed(dir.perm, permRead|permExecute) {
+		return
+	}
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+	for name, fsItem := range dir.contents {
+		childPath := dirPath + "/" + name
+		if levels[0] == "**" {
+			if len(levels) == 1 {
+				matches[childPath] = true
+			}
+			if child, ok := fsItem.(*directory); ok {
+				glob(caller, child, childPath, levels, matches)
+			}
+			continue
+		}
+		if matched, _ := path.Match(levels[0], name); !matched {
+			continue
+		}
+		if len(levels) == 1 {
+			matches[childPath] = true
+		} else if child, ok := fsItem.(*directory); ok {
+			glob(caller, child, childPath, levels[1:], matches)
+		}
+	}
+}
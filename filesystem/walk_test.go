@@ -0,0 +1,138 @@
+package filesystem
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var walkTree = map[string]string{
+	"/home/docs/a.txt":        "",
+	"/home/docs/b.md":         "",
+	"/home/docs/drafts/c.txt": "",
+	"/home/link":              "-> /home/docs",
+	"/home/music/song.mp3":    "",
+	"/tmp/x1.txt":             "",
+}
+
+// walked returns the paths visited by Walk from root, directories ending with a slash
+func walked(t *testing.T, fileSys FileSystem, root string, skip string) []string {
+	paths := make([]string, 0)
+	err := fileSys.Walk(root, func(path string, info *FileInfo, err error) error {
+		assert.Nil(t, err)
+		if info.IsDir {
+			path += "/"
+		}
+		paths = append(paths, path)
+		if path == skip {
+			return SkipDir
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestWalk(t *testing.T) {
+	fileSys := newTree(t, 200, walkTree)
+	assert.Equal(t, []string{
+		"//", "/home/", "/home/docs/", "/home/docs/a.txt", "/home/docs/b.md", "/home/docs/drafts/", "/home/docs/drafts/c.txt",
+		"/home/link", "/home/music/", "/home/music/song.mp3", "/tmp/", "/tmp/x1.txt",
+	}, walked(t, fileSys, "/", ""))
+
+	//SkipDir skips a directory, or the rest of the directory holding a file
+	assert.Equal(t, []string{"/home/", "/home/docs/", "/home/link", "/home/music/", "/home/music/song.mp3"},
+		walked(t, fileSys, "/home", "/home/docs/"))
+	assert.Equal(t, []string{"/home/", "/home/docs/", "/home/docs/a.txt", "/home/link", "/home/music/", "/home/music/song.mp3"},
+		walked(t, fileSys, "/home", "/home/docs/a.txt"))
+	assert.Equal(t, []string{"/home/"}, walked(t, fileSys, "/home", "/home/"))
+	assert.Equal(t, []string{"/tmp/x1.txt"}, walked(t, fileSys, "/tmp/x1.txt", ""))
+
+	//the walk sees the changes fn makes and stops at the first error
+	visited := make([]string, 0)
+	err := fileSys.Walk("/home", func(path string, info *FileInfo, err error) error {
+		if path == "/home/docs" {
+			_, err := fileSys.RemoveAll("/home/music")
+			assert.Nil(t, err)
+		}
+		if err != nil {
+			assert.Nil(t, info)
+			assert.Equal(t, ErrPathDoesNotExists, err)
+			path += " missing"
+		}
+		visited = append(visited, path)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/home", "/home/docs", "/home/docs/a.txt", "/home/docs/b.md", "/home/docs/drafts", "/home/docs/drafts/c.txt",
+		"/home/link", "/home/music missing"}, visited)
+	stop := errors.New("stop")
+	err = fileSys.Walk("/", func(path string, info *FileInfo, err error) error {
+		if path == "/home/docs/b.md" {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	err = fileSys.Walk("/missing", func(path string, info *FileInfo, err error) error {
+		assert.Nil(t, info)
+		return err
+	})
+	assert.Equal(t, ErrPathDoesNotExists, err)
+}
+
+func TestWalkPermissions(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	assert.Nil(t, fileSys.Chmod("/home/alice", 0711))
+	failed := make([]string, 0)
+	err := as(fileSys, bob).Walk("/home", func(path string, info *FileInfo, err error) error {
+		if err != nil {
+			failed = append(failed, path)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/home/alice"}, failed)
+}
+
+func TestGlob(t *testing.T) {
+	fileSys := newTree(t, 200, walkTree)
+	for _, testcase := range []struct {
+		pattern string
+		matches []string
+	}{
+		{"/home/docs/*.txt", []string{"/home/docs/a.txt"}},
+		{"/home/*/?.*", []string{"/home/docs/a.txt", "/home/docs/b.md"}},
+		{"/home/docs/[ab].*", []string{"/home/docs/a.txt", "/home/docs/b.md"}},
+		{"/home/docs/[^a]*", []string{"/home/docs/b.md", "/home/docs/drafts"}},
+		{"/**/*.txt", []string{"/home/docs/a.txt", "/home/docs/drafts/c.txt", "/tmp/x1.txt"}},
+		{"/home/**/drafts/*", []string{"/home/docs/drafts/c.txt"}},
+		{"/home/**/**/c.txt", []string{"/home/docs/drafts/c.txt"}},
+		//a last ** matches one level at least, never the directory before it
+		{"/home/music/**", []string{"/home/music/song.mp3"}},
+		{"/home/docs/**", []string{"/home/docs/a.txt", "/home/docs/b.md", "/home/docs/drafts", "/home/docs/drafts/c.txt"}},
+		{"/home/music/song.mp3/**", []string{}},
+		{"/**/music/**", []string{"/home/music/song.mp3"}},
+		{"/home/l*", []string{"/home/link"}},
+		{"/home/link/*", []string{}},
+		{"/*", []string{"/home", "/tmp"}},
+		{"/", []string{"/"}},
+		{"/missing/*", []string{}},
+	} {
+		matches, err := fileSys.Glob(testcase.pattern)
+		assert.Nil(t, err, testcase.pattern)
+		assert.Equal(t, testcase.matches, matches, testcase.pattern)
+	}
+	_, err := fileSys.Glob("/home/[a")
+	assert.Equal(t, ErrBadPattern, err)
+	_, err = fileSys.Glob("home/*")
+	assert.Equal(t, ErrMalformedPathStructure, err)
+
+	assert.Nil(t, fileSys.Chmod("/home/docs", 0700))
+	matches, _ := as(fileSys, alice).Glob("/home/**/*.txt")
+	assert.Empty(t, matches)
+}
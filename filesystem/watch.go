@@ -0,0 +1,226 @@
+package filesystem
+
+import (
+	"strings"
+	"sync"
+)
+
+// A Watcher receives the changes made below a path. Events are queued by the operation that made the
+// change, in the order the changes were applied, and handed to the consumer from the queue so that
+// operations never wait on a slow consumer. An event is merged into the latest queued event of the same
+// path when both are of the same kind, so repeated writes to a file queue a single event. Once more than
+// WatchBufferSize events are queued they are all dropped for a single EventOverflow, after which the
+// consumer has to list the tree again to catch up
+const WatchBufferSize = 64
+
+type EventKind int
+
+const (
+	EventCreate EventKind = iota
+	EventWrite
+	EventDelete
+	EventRename
+	// EventChmod reports a change of the permissions, owners or extended attributes of an item
+	EventChmod
+	// EventOverflow reports that events were dropped, its path is the watched path
+	EventOverflow
+)
+
+// Event is a change made to the tree, paths are absolute and do not go through symlinks.
+// OldPath is the path a renamed item was moved from
+type Event struct {
+	Path    string
+	OldPath string
+	Kind    EventKind
+}
+
+// Watcher delivers the events of a watch on Events until it is closed
+type Watcher struct {
+	fs        *fileSystem
+	path      string
+	recursive bool
+	events    chan Event
+	//notify wakes up the delivery once events are queued, done stops it
+	notify chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []Event
+	closed  bool
+}
+
+// Watch starts watching path, which must exist. A watch on a directory receives the events of the
+// directory and of its entries, and of everything below it when recursive is set. A renamed item is
+// reported to the watches of both its old and new paths. Watches follow paths rather than items, a watch
+// on a directory that is renamed away receives nothing more until a directory is back at its path.
+// The caller must be allowed to read path, the returned Watcher must be closed once done with
+func (f *fileSystem) Watch(path string, recursive bool) (*Watcher, error) {
+	return f.watchAs(Superuser, path, recursive)
+}
+
+func (f *fileSystem) watchAs(caller Caller, path string, recursive bool) (*Watcher, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fsItem, err := f.lookupAs(caller, path, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := caller.check(fsItem.getPermissions(), permRead); err != nil {
+		return nil, err
+	}
+	watcher := &Watcher{fs: f, path: f.canonicalPath(caller, path, true), recursive: recursive, events: make(chan Event),
+		notify: make(chan struct{}, 1), done: make(chan struct{})}
+	f.watchMu.Lock()
+	if f.watchers == nil {
+		f.watchers = map[*Watcher]struct{}{}
+	}
+	f.watchers[watcher] = struct{}{}
+	f.watchMu.Unlock()
+	go watcher.deliver()
+	return watcher, nil
+}
+
+// Events returns the channel the events are delivered on, it is closed once the Watcher is closed
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close stops the watch and drops the events not yet delivered
+func (w *Watcher) Close() error {
+	w.fs.watchMu.Lock()
+	delete(w.fs.watchers, w)
+	w.fs.watchMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.pending = nil
+	close(w.done)
+	return nil
+}
+
+func (w *Watcher) deliver() {
+	defer close(w.events)
+	for {
+		event, queued := w.next()
+		if !queued {
+			select {
+			case <-w.notify:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// next takes the oldest queued event
+func (w *Watcher) next() (Event, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		return Event{}, false
+	}
+	event := w.pending[0]
+	w.pending = w.pending[1:]
+	return event, true
+}
+
+// queue adds event unless it merges into the latest queued event of its path, it never blocks
+func (w *Watcher) queue(event Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	for i := len(w.pending) - 1; i >= 0; i-- {
+		if w.pending[i].Path != event.Path {
+			continue
+		}
+		if w.pending[i] == event {
+			return
+		}
+		break
+	}
+	if len(w.pending) >= WatchBufferSize {
+		w.pending = []Event{{Path: w.path, Kind: EventOverflow}}
+	} else {
+		w.pending = append(w.pending, event)
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// concerns reports whether path is watched by w
+func (w *Watcher) concerns(path string) bool {
+	if path == "" {
+		return false
+	}
+	if path == w.path {
+		return true
+	}
+	if w.recursive {
+		return w.path == "/" || strings.HasPrefix(path, w.path+"/")
+	}
+	parent := path[:strings.LastIndex(path, "/")]
+	if parent == "" {
+		parent = "/"
+	}
+	return parent == w.path
+}
+
+// notify queues event on every watcher it concerns, callers apply the change it reports while holding
+// the journal lock when there is a journal, so watchers receive the changes in the order of the journal
+func (f *fileSystem) notify(event Event) {
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+	for watcher := range f.watchers {
+		if watcher.concerns(event.Path) || watcher.concerns(event.OldPath) {
+			watcher.queue(event)
+		}
+	}
+}
+
+// notifyTree reports kind for fsItem at path and for everything below it, entries before their directory
+func (f *fileSystem) notifyTree(kind EventKind, path string, fsItem item) {
+	if dir, ok := fsItem.(*directory); ok {
+		dir.mu.RLock()
+		children := make(map[string]item, len(dir.contents))
+		for name, child := range dir.contents {
+			children[name] = child
+		}
+		dir.mu.RUnlock()
+		for name, child := range children {
+			f.notifyTree(kind, path+"/"+name, child)
+		}
+	}
+	f.notify(Event{Path: path, Kind: kind})
+}
+
+// watching reports whether any watcher is registered, so that events are only worked out when needed
+func (f *fileSystem) watching() bool {
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+	return len(f.watchers) > 0
+}
+
+// canonicalPath returns path as an absolute path going through directories only, see resolve
+func (f *fileSystem) canonicalPath(caller Caller, path string, follow bool) string {
+	if path == "/" {
+		return "/"
+	}
+	structure, err := f.resolvePath(caller, path, follow)
+	if err != nil || len(structure) == 0 {
+		return "/"
+	}
+	return "/" + strings.Join(structure, "/")
+}
@@ -0,0 +1,199 @@
+package filesystem
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var watchTree = map[string]string{
+	"/home/docs/a.txt": "",
+}
+
+// eventsUntil collects the events of watcher up to and including the first one for path
+func eventsUntil(t *testing.T, watcher *Watcher, path string) []Event {
+	events := make([]Event, 0)
+	for {
+		select {
+		case event, open := <-watcher.Events():
+			if !open {
+				t.Fatalf("the watcher closed before an event for %s", path)
+				return events
+			}
+			events = append(events, event)
+			if event.Path == path {
+				return events
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %s, got %v", path, events)
+			return events
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	watcher, err := fileSys.Watch("/home/docs", false)
+	assert.Nil(t, err)
+	defer watcher.Close()
+
+	assert.Nil(t, fileSys.CreateFile("/home/docs/b.txt"))
+	fl, _ := fileSys.OpenFile("/home/docs/b.txt")
+	assert.Nil(t, fileSys.WriteFile(fl, []byte("written")))
+	assert.Nil(t, fileSys.Chmod("/home/docs/b.txt", 0600))
+	assert.Nil(t, fileSys.SetXattr("/home/docs", "user.team", []byte("storage")))
+	assert.Nil(t, fileSys.Rename("/home/docs/b.txt", "/home/b.txt"))
+	//changes outside the directory or below its entries are not reported
+	assert.Nil(t, fileSys.CreateFile("/home/c.txt"))
+	assert.Nil(t, fileSys.CreateDir("/home/docs/nested/deeper"))
+	assert.Nil(t, fileSys.Symlink("a.txt", "/home/docs/link"))
+	assert.Nil(t, fileSys.DeleteFile("/home/docs/link", NoFollow))
+	assert.Nil(t, fileSys.CreateFile("/home/docs/last.txt"))
+
+	assert.Equal(t, []Event{
+		{Path: "/home/docs/b.txt", Kind: EventCreate},
+		{Path: "/home/docs/b.txt", Kind: EventWrite},
+		{Path: "/home/docs/b.txt", Kind: EventChmod},
+		{Path: "/home/docs", Kind: EventChmod},
+		{Path: "/home/b.txt", OldPath: "/home/docs/b.txt", Kind: EventRename},
+		{Path: "/home/docs/nested", Kind: EventCreate},
+		{Path: "/home/docs/link", Kind: EventCreate},
+		{Path: "/home/docs/link", Kind: EventDelete},
+		{Path: "/home/docs/last.txt", Kind: EventCreate},
+	}, eventsUntil(t, watcher, "/home/docs/last.txt"))
+}
+
+func TestWatchDotDot(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	assert.Nil(t, fileSys.CreateDir("/home/docs/sub"))
+	watcher, err := fileSys.Watch("/home/docs", false)
+	assert.Nil(t, err)
+	defer watcher.Close()
+
+	//a path ending in .. resolves through the directory it names, which must not be locked meanwhile
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(t, fileSys.SetXattr("/home/docs/sub/..", "user.team", []byte("storage")))
+		assert.Nil(t, fileSys.RemoveXattr("/home/docs/sub/..", "user.team"))
+		assert.Nil(t, fileSys.Chmod("/home/docs/sub/..", 0700))
+		assert.Nil(t, fileSys.CreateFile("/home/docs/last.txt"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("changing the attributes of a path ending in .. deadlocked")
+	}
+	//the three changes of /home/docs coalesce
+	assert.Equal(t, []Event{
+		{Path: "/home/docs", Kind: EventChmod},
+		{Path: "/home/docs/last.txt", Kind: EventCreate},
+	}, eventsUntil(t, watcher, "/home/docs/last.txt"))
+}
+
+func TestWatchRecursive(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	assert.Nil(t, fileSys.Symlink("/home/docs", "/docs"))
+	//a watch through a symlink watches the directory it leads to
+	watcher, err := fileSys.Watch("/docs", true)
+	assert.Nil(t, err)
+	defer watcher.Close()
+
+	assert.Nil(t, fileSys.CreateDir("/home/docs/nested/deeper"))
+	assert.Nil(t, fileSys.Link("/home/docs/a.txt", "/home/docs/nested/deeper/a.txt"))
+	handle, _ := fileSys.OpenHandle("/home/docs/a.txt")
+	_, err = handle.Write([]byte("x"))
+	assert.Nil(t, err)
+	_, err = fileSys.RemoveAll("/home/docs/nested")
+	assert.Nil(t, err)
+	assert.Nil(t, fileSys.CreateFile("/home/outside.txt"))
+	assert.Nil(t, fileSys.Rename("/home/outside.txt", "/home/docs/inside.txt"))
+
+	assert.Equal(t, []Event{
+		{Path: "/home/docs/nested", Kind: EventCreate},
+		{Path: "/home/docs/nested/deeper", Kind: EventCreate},
+		{Path: "/home/docs/nested/deeper/a.txt", Kind: EventCreate},
+		{Path: "/home/docs/a.txt", Kind: EventWrite},
+		{Path: "/home/docs/nested/deeper/a.txt", Kind: EventDelete},
+		{Path: "/home/docs/nested/deeper", Kind: EventDelete},
+		{Path: "/home/docs/nested", Kind: EventDelete},
+		{Path: "/home/docs/inside.txt", OldPath: "/home/outside.txt", Kind: EventRename},
+	}, eventsUntil(t, watcher, "/home/docs/inside.txt"))
+}
+
+func TestWatchCoalesce(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	watcher, _ := fileSys.Watch("/home/docs", false)
+	defer watcher.Close()
+	fl, _ := fileSys.OpenFile("/home/docs/a.txt")
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, fileSys.AppendFile(fl, []byte("x")))
+	}
+	assert.Nil(t, fileSys.CreateFile("/home/docs/b.txt"))
+
+	//the first write may be on its way to the consumer already, the others are merged in the queue
+	events := eventsUntil(t, watcher, "/home/docs/b.txt")
+	assert.LessOrEqual(t, len(events), 3)
+	for _, event := range events[:len(events)-1] {
+		assert.Equal(t, Event{Path: "/home/docs/a.txt", Kind: EventWrite}, event)
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	watcher, _ := fileSys.Watch("/home", true)
+	defer watcher.Close()
+	for i := 0; i < WatchBufferSize+10; i++ {
+		assert.Nil(t, fileSys.CreateFile(fmt.Sprintf("/home/docs/%d.txt", i)))
+	}
+
+	//the first event may be on its way to the consumer already, the ones queued next are dropped
+	events := eventsUntil(t, watcher, "/home")
+	assert.LessOrEqual(t, len(events), 2)
+	assert.Equal(t, Event{Path: "/home", Kind: EventOverflow}, events[len(events)-1])
+
+	//events queued after the overflow are delivered
+	assert.Nil(t, fileSys.CreateFile("/home/last.txt"))
+	events = eventsUntil(t, watcher, "/home/last.txt")
+	assert.LessOrEqual(t, len(events), 11)
+	assert.Equal(t, Event{Path: "/home/docs/73.txt", Kind: EventCreate}, events[len(events)-2])
+}
+
+func TestWatchClose(t *testing.T) {
+	fileSys := newTree(t, 1000, watchTree)
+	watcher, _ := fileSys.Watch("/", true)
+	assert.Nil(t, fileSys.CreateFile("/home/b.txt"))
+	assert.Nil(t, watcher.Close())
+	assert.Nil(t, watcher.Close())
+	assert.Nil(t, fileSys.CreateFile("/home/c.txt"))
+	select {
+	case event, open := <-watcher.Events():
+		//an event already on its way may still be received before the channel closes
+		if open {
+			assert.Equal(t, Event{Path: "/home/b.txt", Kind: EventCreate}, event)
+			_, open = <-watcher.Events()
+		}
+		assert.False(t, open)
+	case <-time.After(time.Second):
+		t.Fatal("the events channel was not closed")
+	}
+}
+
+func TestWatchPermissions(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	_, err := fileSys.Watch("/missing", false)
+	assert.Equal(t, ErrPathDoesNotExists, err)
+	assert.Nil(t, fileSys.Chmod("/home/alice", 0700))
+	_, err = as(fileSys, bob).Watch("/home/alice", false)
+	assert.Equal(t, ErrPermissionDenied, err)
+	watcher, err := as(fileSys, alice).Watch("/home/alice", false)
+	assert.Nil(t, err)
+	defer watcher.Close()
+	assert.Nil(t, as(fileSys, alice).CreateFile("/home/alice/notes.txt"))
+	assert.Equal(t, []Event{{Path: "/home/alice/notes.txt", Kind: EventCreate}}, eventsUntil(t, watcher, "/home/alice/notes.txt"))
+}
@@ -0,0 +1,246 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"sort"
+	"sync"
+
+	"github.com/Saf1u/smpfs/disk"
+)
+
+// Extended attributes are stored on the disk like file contents: an item holding attributes refers to a
+// single record listing them sorted by name, each one being its name and value. Changing an attribute
+// writes a new record before the previous one is released, so attributes take their share of the disk
+// and are shared with snapshots until changed
+const (
+	maxXattrNameLength = 255
+	maxXattrValueSize  = 64 * 1024
+)
+
+var (
+	ErrXattrDoesNotExist = errors.New("the extended attribute does not exist")
+	ErrInvalidXattrName  = errors.New("the extended attribute name is invalid")
+	ErrXattrTooLarge     = errors.New("the extended attribute value is too large")
+)
+
+// xattrHolder is an item carrying extended attributes, files and directories are while symlinks are
+// followed instead. The attributes record is guarded by the lock of the item
+type xattrHolder interface {
+	item
+	getLock() *sync.RWMutex
+	getXattrs() *disk.BlockRecord
+	setXattrs(*disk.BlockRecord)
+}
+
+// SetXattr sets the extended attribute name of path to value, replacing its previous value.
+// The caller must be allowed to write path, a symlink at the end of path is followed
+func (f *fileSystem) SetXattr(path string, name string, value []byte) error {
+	return f.setXattrAs(Superuser, path, name, value)
+}
+
+func (f *fileSystem) setXattrAs(caller Caller, path string, name string, value []byte) error {
+	if err := checkXattr(name); err != nil {
+		return err
+	}
+	if len(value) > maxXattrValueSize {
+		return ErrXattrTooLarge
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	holder, err := f.xattrHolderAs(caller, path, permWrite)
+	if err != nil {
+		return err
+	}
+	//resolving the path read locks the directories along it, holder among them for a path ending in ..
+	eventPath := f.canonicalPath(caller, path, true)
+	holder.getLock().Lock()
+	defer holder.getLock().Unlock()
+	//a file deleted meanwhile has had its attributes released already
+	if fl, ok := holder.(File); ok && fl.isUnlinked() {
+		return ErrFileDoesNotExist
+	}
+	attrs, err := f.readXattrs(holder)
+	if err != nil {
+		return err
+	}
+	data := append([]byte(name), value...)
+	return f.logged(record{op: opSetXattr, path: path, offset: len(name), data: data, caller: caller}, func() error {
+		attrs[name] = value
+		if err := f.writeXattrs(holder, attrs); err != nil {
+			return err
+		}
+		f.notify(Event{Path: eventPath, Kind: EventChmod})
+		return nil
+	})
+}
+
+// GetXattr returns the value of the extended attribute name of path, the caller must be allowed to read path
+func (f *fileSystem) GetXattr(path string, name string) ([]byte, error) {
+	return f.getXattrAs(Superuser, path, name)
+}
+
+func (f *fileSystem) getXattrAs(caller Caller, path string, name string) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	holder, err := f.xattrHolderAs(caller, path, permRead)
+	if err != nil {
+		return nil, err
+	}
+	holder.getLock().RLock()
+	defer holder.getLock().RUnlock()
+	attrs, err := f.readXattrs(holder)
+	if err != nil {
+		return nil, err
+	}
+	value, exist := attrs[name]
+	if !exist {
+		return nil, ErrXattrDoesNotExist
+	}
+	return value, nil
+}
+
+// ListXattr returns the names of the extended attributes of path sorted, the caller must be allowed to read path
+func (f *fileSystem) ListXattr(path string) ([]string, error) {
+	return f.listXattrAs(Superuser, path)
+}
+
+func (f *fileSystem) listXattrAs(caller Caller, path string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	holder, err := f.xattrHolderAs(caller, path, permRead)
+	if err != nil {
+		return nil, err
+	}
+	holder.getLock().RLock()
+	defer holder.getLock().RUnlock()
+	attrs, err := f.readXattrs(holder)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveXattr removes the extended attribute name of path, the caller must be allowed to write path
+func (f *fileSystem) RemoveXattr(path string, name string) error {
+	return f.removeXattrAs(Superuser, path, name)
+}
+
+func (f *fileSystem) removeXattrAs(caller Caller, path string, name string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	holder, err := f.xattrHolderAs(caller, path, permWrite)
+	if err != nil {
+		return err
+	}
+	//resolving the path read locks the directories along it, holder among them for a path ending in ..
+	eventPath := f.canonicalPath(caller, path, true)
+	holder.getLock().Lock()
+	defer holder.getLock().Unlock()
+	attrs, err := f.readXattrs(holder)
+	if err != nil {
+		return err
+	}
+	if _, exist := attrs[name]; !exist {
+		return ErrXattrDoesNotExist
+	}
+	return f.logged(record{op: opRemoveXattr, path: path, data: []byte(name), caller: caller}, func() error {
+		delete(attrs, name)
+		if err := f.writeXattrs(holder, attrs); err != nil {
+			return err
+		}
+		f.notify(Event{Path: eventPath, Kind: EventChmod})
+		return nil
+	})
+}
+
+func checkXattr(name string) error {
+	if name == "" || len(name) > maxXattrNameLength {
+		return ErrInvalidXattrName
+	}
+	return nil
+}
+
+// xattrHolderAs returns the file or directory at path once caller was allowed to search its way to it
+// and holds want on it
+func (f *fileSystem) xattrHolderAs(caller Caller, path string, want fs.FileMode) (xattrHolder, error) {
+	fsItem, err := f.lookupAs(caller, path, true)
+	if err != nil {
+		return nil, err
+	}
+	holder, ok := fsItem.(xattrHolder)
+	if !ok {
+		return nil, ErrPathDoesNotExists
+	}
+	if err := caller.check(holder.getPermissions(), want); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+// readXattrs decodes the attributes of holder, callers hold its lock
+func (f *fileSystem) readXattrs(holder xattrHolder) (map[string][]byte, error) {
+	attrs := map[string][]byte{}
+	if holder.getXattrs() == nil {
+		return attrs, nil
+	}
+	data, err := f.disk.Read(holder.getXattrs())
+	if err != nil {
+		return nil, err
+	}
+	dec := &decoder{r: bytes.NewReader(data)}
+	count := dec.readInt()
+	for i := 0; i < count && dec.err == nil; i++ {
+		name := dec.readString()
+		attrs[name] = dec.readBytes()
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return attrs, nil
+}
+
+// writeXattrs stores attrs as the attributes of holder, callers hold its lock. Without attributes
+// holder refers to no record at all
+func (f *fileSystem) writeXattrs(holder xattrHolder, attrs map[string][]byte) error {
+	var manifest *disk.BlockRecord
+	if len(attrs) > 0 {
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var buffer bytes.Buffer
+		enc := &encoder{w: &buffer}
+		enc.writeInt(len(names))
+		for _, name := range names {
+			enc.writeString(name)
+			enc.writeBytes(attrs[name])
+		}
+		var err error
+		manifest, err = f.disk.Write(buffer.Bytes())
+		if err != nil {
+			if errors.Is(err, disk.ErrInsufficentMemoryError) {
+				return ErrFileCouldNotBeWritten
+			}
+			return ErrUnkonwnError
+		}
+	}
+	f.dropXattrs(holder)
+	holder.setXattrs(manifest)
+	return nil
+}
+
+// dropXattrs returns the blocks of the attributes of holder to the disk, callers hold its lock
+func (f *fileSystem) dropXattrs(holder xattrHolder) {
+	if holder.getXattrs() != nil {
+		f.disk.Delete(holder.getXattrs())
+		holder.setXattrs(nil)
+	}
+}
@@ -0,0 +1,104 @@
+package filesystem
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Saf1u/smpfs/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+var xattrTree = map[string]string{
+	"/home/docs/a.txt": "",
+}
+
+func TestXattr(t *testing.T) {
+	fileSys := newTree(t, 1000, xattrTree)
+	free := fileSys.GetAvailableMemory()
+	assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.content-type", []byte("text/plain")))
+	assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.checksum", []byte("abc")))
+	assert.Nil(t, fileSys.SetXattr("/home/docs", "user.team", []byte("storage")))
+	assert.Less(t, fileSys.GetAvailableMemory(), free)
+
+	value, err := fileSys.GetXattr("/home/docs/a.txt", "user.content-type")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", string(value))
+	names, err := fileSys.ListXattr("/home/docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user.checksum", "user.content-type"}, names)
+	names, _ = fileSys.ListXattr("/home")
+	assert.Empty(t, names)
+	value, _ = fileSys.GetXattr("/home/docs", "user.team")
+	assert.Equal(t, "storage", string(value))
+
+	//a symlink is followed to the item holding the attributes
+	assert.Nil(t, fileSys.Symlink("docs/a.txt", "/home/link"))
+	value, _ = fileSys.GetXattr("/home/link", "user.checksum")
+	assert.Equal(t, "abc", string(value))
+
+	assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.checksum", []byte("def")))
+	value, _ = fileSys.GetXattr("/home/docs/a.txt", "user.checksum")
+	assert.Equal(t, "def", string(value))
+	_, err = fileSys.GetXattr("/home/docs/a.txt", "user.missing")
+	assert.Equal(t, ErrXattrDoesNotExist, err)
+	assert.Equal(t, ErrXattrDoesNotExist, fileSys.RemoveXattr("/home/docs/a.txt", "user.missing"))
+	assert.Equal(t, ErrInvalidXattrName, fileSys.SetXattr("/home/docs/a.txt", "", nil))
+	assert.Equal(t, ErrXattrTooLarge, fileSys.SetXattr("/home/docs/a.txt", "user.big", make([]byte, maxXattrValueSize+1)))
+	_, err = fileSys.ListXattr("/home/missing")
+	assert.Equal(t, ErrPathDoesNotExists, err)
+
+	//the attributes are charged against the disk and released with the item
+	assert.Equal(t, ErrFileCouldNotBeWritten, fileSys.SetXattr("/home/docs", "user.huge", []byte(strings.Repeat("x", 1000))))
+	assert.Nil(t, fileSys.RemoveXattr("/home/docs/a.txt", "user.checksum"))
+	assert.Nil(t, fileSys.RemoveXattr("/home/docs/a.txt", "user.content-type"))
+	names, _ = fileSys.ListXattr("/home/docs/a.txt")
+	assert.Empty(t, names)
+	assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.checksum", []byte("abc")))
+	_, err = fileSys.RemoveAll("/home/docs")
+	assert.Nil(t, err)
+	assert.Equal(t, free, fileSys.GetAvailableMemory())
+}
+
+func TestXattrPermissions(t *testing.T) {
+	d, _ := disk.NewDisk(200, 10)
+	fileSys := NewFileSystem(d)
+	setupPermissions(t, fileSys)
+	aliceFs, bobFs := as(fileSys, alice), as(fileSys, bob)
+	assert.Nil(t, aliceFs.SetXattr("/home/alice/shared.txt", "user.team", []byte("storage")))
+	value, err := bobFs.GetXattr("/home/alice/shared.txt", "user.team")
+	assert.Nil(t, err)
+	assert.Equal(t, "storage", string(value))
+	assert.Equal(t, ErrPermissionDenied, bobFs.SetXattr("/home/alice/shared.txt", "user.team", []byte("bob")))
+	assert.Equal(t, ErrPermissionDenied, bobFs.RemoveXattr("/home/alice/shared.txt", "user.team"))
+	_, err = bobFs.ListXattr("/home/alice/private.txt")
+	assert.Equal(t, ErrPermissionDenied, err)
+}
+
+func TestXattrSaveLoadReplay(t *testing.T) {
+	fileSys := newTree(t, 1000, xattrTree)
+	checkRoundTrip(t, fileSys, func() {
+		assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.checksum", []byte("abc")))
+		assert.Nil(t, fileSys.SetXattr("/home/docs", "user.team", []byte("storage")))
+		assert.Nil(t, fileSys.Snapshot("tagged"))
+		assert.Nil(t, fileSys.SetXattr("/home/docs/a.txt", "user.checksum", []byte("def")))
+		assert.Nil(t, fileSys.RemoveXattr("/home/docs", "user.team"))
+	}, func(restored FileSystem) {
+		value, err := restored.GetXattr("/home/docs/a.txt", "user.checksum")
+		assert.Nil(t, err)
+		assert.Equal(t, "def", string(value))
+		names, _ := restored.ListXattr("/home/docs")
+		assert.Empty(t, names)
+		view, _ := restored.MountSnapshot("tagged")
+		value, _ = view.GetXattr("/home/docs/a.txt", "user.checksum")
+		assert.Equal(t, "abc", string(value))
+		value, _ = view.GetXattr("/home/docs", "user.team")
+		assert.Equal(t, "storage", string(value))
+		assert.Equal(t, ErrReadOnly, view.SetXattr("/home/docs", "user.team", nil))
+		//the snapshot shares the records it has in common with the tree, dropping it frees the others
+		free := restored.GetAvailableMemory()
+		assert.Nil(t, restored.DeleteSnapshot("tagged"))
+		assert.Greater(t, restored.GetAvailableMemory(), free)
+		assert.Nil(t, restored.DeleteFile("/home/docs/a.txt"))
+		assert.Equal(t, 1000, restored.GetAvailableMemory())
+	})
+}